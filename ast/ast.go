@@ -2,14 +2,16 @@ package ast //该包提供了ast的一些方法
 
 import (
 	"bytes"
+	"math/big"
 	"strings"
 
 	"my.com/myfile/token"
 )
 
-type Node interface { //定义了AST(语法树)中所有节点必须实现的两个方法
+type Node interface { //定义了AST(语法树)中所有节点必须实现的方法
 	TokenLiteral() string
 	String() string
+	Pos() token.Position //节点对应token的源码位置,例如中缀表达式返回运算符的位置
 }
 
 // All statement nodes implement this
@@ -37,6 +39,13 @@ func (p *Program) TokenLiteral() string { //接受一个程序，然后返回这
 	}
 }
 
+func (p *Program) Pos() token.Position { //程序的位置就是第一个语句的位置
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+	return token.Position{}
+}
+
 func (p *Program) String() string { //
 	var out bytes.Buffer
 
@@ -49,19 +58,25 @@ func (p *Program) String() string { //
 
 // Statements
 type LetStatement struct { //
-	Token token.Token // the token.LET token
-	Index string
-	Name  *Identifier
-	Value Expression
+	Token   token.Token // the token.LET token
+	Name    *Identifier
+	Pattern Expression // 解构赋值的模式(*ArrayPattern或*HashPattern),此时Name为nil
+	Value   Expression
+	Doc     string // let前面的文档注释,多行之间用换行分隔
 }
 
 func (ls *LetStatement) statementNode()       {}
 func (ls *LetStatement) TokenLiteral() string { return ls.Token.Literal }
+func (ls *LetStatement) Pos() token.Position  { return ls.Token.Pos }
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
 	out.WriteString(ls.TokenLiteral() + " ")
-	out.WriteString(ls.Name.String())
+	if ls.Pattern != nil {
+		out.WriteString(ls.Pattern.String())
+	} else {
+		out.WriteString(ls.Name.String())
+	}
 	out.WriteString(" = ")
 
 	if ls.Value != nil {
@@ -80,6 +95,7 @@ type ReturnStatement struct {
 
 func (rs *ReturnStatement) statementNode()       {}
 func (rs *ReturnStatement) TokenLiteral() string { return rs.Token.Literal }
+func (rs *ReturnStatement) Pos() token.Position  { return rs.Token.Pos }
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
 
@@ -100,6 +116,7 @@ type BreakStatement struct {
 
 func (bs *BreakStatement) statementNode()       {}
 func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) Pos() token.Position  { return bs.Token.Pos }
 func (bs *BreakStatement) String() string       { return bs.Token.Literal }
 
 type ContinueStatement struct {
@@ -108,8 +125,21 @@ type ContinueStatement struct {
 
 func (cs *ContinueStatement) statementNode()       {}
 func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueStatement) Pos() token.Position  { return cs.Token.Pos }
 func (cs *ContinueStatement) String() string       { return cs.Token.Literal }
 
+type ThrowStatement struct {
+	Token token.Token // the 'throw' token
+	Value Expression  // 抛出的值,可以是任意对象
+}
+
+func (ts *ThrowStatement) statementNode()       {}
+func (ts *ThrowStatement) TokenLiteral() string { return ts.Token.Literal }
+func (ts *ThrowStatement) Pos() token.Position  { return ts.Token.Pos }
+func (ts *ThrowStatement) String() string {
+	return ts.TokenLiteral() + " " + ts.Value.String() + ";"
+}
+
 type ExpressionStatement struct { //表达式结构体
 	Token      token.Token // the first token of the expression
 	Expression Expression
@@ -117,6 +147,7 @@ type ExpressionStatement struct { //表达式结构体
 
 func (es *ExpressionStatement) statementNode()       {}
 func (es *ExpressionStatement) TokenLiteral() string { return es.Token.Literal }
+func (es *ExpressionStatement) Pos() token.Position  { return es.Token.Pos }
 func (es *ExpressionStatement) String() string {
 	if es.Expression != nil {
 		return es.Expression.String()
@@ -131,6 +162,7 @@ type BlockStatement struct {
 
 func (bs *BlockStatement) statementNode()       {}
 func (bs *BlockStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BlockStatement) Pos() token.Position  { return bs.Token.Pos }
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer
 
@@ -149,6 +181,7 @@ type Identifier struct {
 
 func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
+func (i *Identifier) Pos() token.Position  { return i.Token.Pos }
 func (i *Identifier) String() string       { return i.Value }
 
 type Boolean struct {
@@ -158,17 +191,30 @@ type Boolean struct {
 
 func (b *Boolean) expressionNode()      {}
 func (b *Boolean) TokenLiteral() string { return b.Token.Literal }
+func (b *Boolean) Pos() token.Position  { return b.Token.Pos }
 func (b *Boolean) String() string       { return b.Token.Literal }
 
 type IntegerLiteral struct {
 	Token token.Token
 	Value int64
+	Big   *big.Int // 超出int64范围的字面量,此时Value无意义
 }
 
 func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
+func (il *IntegerLiteral) Pos() token.Position  { return il.Token.Pos }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
 
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode()      {}
+func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) Pos() token.Position  { return fl.Token.Pos }
+func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
+
 type PrefixExpression struct {
 	Token    token.Token // The prefix token, e.g. !
 	Operator string
@@ -177,6 +223,7 @@ type PrefixExpression struct {
 
 func (pe *PrefixExpression) expressionNode()      {}
 func (pe *PrefixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PrefixExpression) Pos() token.Position  { return pe.Token.Pos }
 func (pe *PrefixExpression) String() string {
 	var out bytes.Buffer
 
@@ -197,6 +244,7 @@ type InfixExpression struct {
 
 func (ie *InfixExpression) expressionNode()      {}
 func (ie *InfixExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *InfixExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ie *InfixExpression) String() string {
 	var out bytes.Buffer
 
@@ -219,6 +267,7 @@ type IfExpression struct {
 func (ie *IfExpression) statementNode()       {}
 func (ie *IfExpression) expressionNode()      {}
 func (ie *IfExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IfExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ie *IfExpression) String() string {
 	var out bytes.Buffer
 
@@ -238,28 +287,158 @@ func (ie *IfExpression) String() string {
 type FunctionLiteral struct {
 	Token      token.Token // The 'fn' token
 	Parameters []*Identifier
+	Defaults   []Expression // 参数的默认值,与Parameters一一对应,没有默认值的为nil;所有参数都没有默认值时为nil
+	Patterns   []Expression // 解构参数的模式,与Parameters一一对应,对应的参数名就是模式的源码;没有解构参数时为nil
+	Rest       *Identifier  // 剩余参数 ...rest,收集多余的参数,没有时为nil
 	Body       *BlockStatement
+	Name       string // fn声明或者let语句绑定的名字,匿名函数为空
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
 func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FunctionLiteral) Pos() token.Position  { return fl.Token.Pos }
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
-	params := []string{}
-	for _, p := range fl.Parameters {
-		params = append(params, p.String())
-	}
-
 	out.WriteString(fl.TokenLiteral())
+	if fl.Name != "" {
+		out.WriteString("<" + fl.Name + ">")
+	}
 	out.WriteString("(")
-	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(ParameterList(fl.Parameters, fl.Defaults, fl.Patterns, fl.Rest))
 	out.WriteString(") ")
 	out.WriteString(fl.Body.String())
 
 	return out.String()
 }
 
+// ParameterList 参数列表的源码形式,例如 x, [a, b], y = 10, ...rest
+func ParameterList(params []*Identifier, defaults []Expression, patterns []Expression, rest *Identifier) string {
+	list := []string{}
+	for i, p := range params {
+		param := p.String()
+		if patterns != nil && patterns[i] != nil { // 解构参数显示模式而不是生成的参数名
+			param = patterns[i].String()
+		}
+		if defaults != nil && defaults[i] != nil {
+			param += " = " + defaults[i].String()
+		}
+		list = append(list, param)
+	}
+	if rest != nil {
+		list = append(list, "..."+rest.String())
+	}
+	return strings.Join(list, ", ")
+}
+
+// FunctionStatement 函数声明 fn name(params) { body }
+// 只有名字被提升:块的开头就定义了这个名字,值为null,执行到声明语句时才创建函数,
+// 所以块中的其他函数可以引用后面声明的函数,但声明语句执行之前不能调用它
+type FunctionStatement struct {
+	Token    token.Token // the 'fn' token
+	Name     *Identifier
+	Function *FunctionLiteral // Function.Name与声明的名字相同
+	Doc      string           // fn前面的文档注释,多行之间用换行分隔
+}
+
+func (fs *FunctionStatement) statementNode()       {}
+func (fs *FunctionStatement) TokenLiteral() string { return fs.Token.Literal }
+func (fs *FunctionStatement) Pos() token.Position  { return fs.Token.Pos }
+func (fs *FunctionStatement) String() string {
+	var out bytes.Buffer
+
+	fn := fs.Function
+	out.WriteString(fs.TokenLiteral() + " ")
+	out.WriteString(fs.Name.String())
+	out.WriteString("(")
+	out.WriteString(ParameterList(fn.Parameters, fn.Defaults, fn.Patterns, fn.Rest))
+	out.WriteString(") ")
+	out.WriteString(fs.Function.Body.String())
+
+	return out.String()
+}
+
+// SpreadExpression 展开数组 ...arr,只能出现在调用的参数和数组字面量中
+type SpreadExpression struct {
+	Token token.Token // the '...' token
+	Value Expression
+}
+
+func (se *SpreadExpression) expressionNode()      {}
+func (se *SpreadExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SpreadExpression) Pos() token.Position  { return se.Token.Pos }
+func (se *SpreadExpression) String() string       { return "..." + se.Value.String() }
+
+// ArrayPattern 数组模式 [a, [b, c], ...rest],元素是变量名或者嵌套的模式,match中还可以是字面量
+// 解构时缺少的元素绑定为null;match中数组的长度必须相同,有rest时不能少于元素个数
+type ArrayPattern struct {
+	Token    token.Token // the '[' token
+	Elements []Expression
+	Rest     *Identifier // 收集剩余元素的变量,没有时为nil
+}
+
+func (ap *ArrayPattern) expressionNode()      {}
+func (ap *ArrayPattern) TokenLiteral() string { return ap.Token.Literal }
+func (ap *ArrayPattern) Pos() token.Position  { return ap.Token.Pos }
+func (ap *ArrayPattern) String() string {
+	elements := []string{}
+	for _, el := range ap.Elements {
+		elements = append(elements, el.String())
+	}
+	if ap.Rest != nil {
+		elements = append(elements, "..."+ap.Rest.String())
+	}
+	return "[" + strings.Join(elements, ", ") + "]"
+}
+
+// HashPattern 哈希模式 {name, age: years},按字符串键取值,解构时缺少的键绑定为null,match中缺少键时不匹配
+type HashPattern struct {
+	Token token.Token // the '{' token
+	Pairs []HashPatternPair
+}
+
+type HashPatternPair struct {
+	Key   *StringLiteral
+	Value Expression // 变量名、嵌套的模式或者字面量,简写{name}时是与键同名的变量
+}
+
+func (hp *HashPattern) expressionNode()      {}
+func (hp *HashPattern) TokenLiteral() string { return hp.Token.Literal }
+func (hp *HashPattern) Pos() token.Position  { return hp.Token.Pos }
+func (hp *HashPattern) String() string {
+	pairs := []string{}
+	for _, pair := range hp.Pairs {
+		if ident, ok := pair.Value.(*Identifier); ok && ident.Value == pair.Key.Value {
+			pairs = append(pairs, ident.String())
+		} else {
+			pairs = append(pairs, pair.Key.String()+": "+pair.Value.String())
+		}
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// AssignExpression 赋值表达式,目标可以是变量或者下标表达式,例如x = 1, arr[0] = 1
+type AssignExpression struct {
+	Token  token.Token // the '=' token
+	Target Expression  // Identifier or IndexExpression
+	Value  Expression
+}
+
+func (ae *AssignExpression) expressionNode()      {}
+func (ae *AssignExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AssignExpression) Pos() token.Position  { return ae.Token.Pos }
+func (ae *AssignExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(ae.Target.String())
+	out.WriteString(" = ")
+	out.WriteString(ae.Value.String())
+	out.WriteString(")")
+
+	return out.String()
+}
+
 type CallExpression struct {
 	Token     token.Token // The '(' token
 	Function  Expression  // Identifier or FunctionLiteral
@@ -268,6 +447,7 @@ type CallExpression struct {
 
 func (ce *CallExpression) expressionNode()      {}
 func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CallExpression) Pos() token.Position  { return ce.Token.Pos }
 func (ce *CallExpression) String() string {
 	var out bytes.Buffer
 
@@ -301,6 +481,7 @@ type ForExpression struct { //For的抽象语法树
 */
 func (fs *ForExpression) expressionNode()      {}
 func (fs *ForExpression) TokenLiteral() string { return fs.Token.Literal }
+func (fs *ForExpression) Pos() token.Position  { return fs.Token.Pos }
 func (fs *ForExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("For")
@@ -320,6 +501,7 @@ type WhileExpression struct {
 
 func (fs *WhileExpression) expressionNode()      {}
 func (fs *WhileExpression) TokenLiteral() string { return fs.Token.Literal }
+func (fs *WhileExpression) Pos() token.Position  { return fs.Token.Pos }
 func (fs *WhileExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("while")
@@ -336,8 +518,32 @@ type StringLiteral struct {
 
 func (sl *StringLiteral) expressionNode()      {}
 func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
+func (sl *StringLiteral) Pos() token.Position  { return sl.Token.Pos }
 func (sl *StringLiteral) String() string       { return sl.Token.Literal }
 
+// TemplateLiteral 带插值的字符串"a${x}b",Parts按顺序由字符串片段(*StringLiteral)和插值表达式组成,空的片段被省略
+type TemplateLiteral struct {
+	Token token.Token // 第一个TEMPLATE词法单元
+	Parts []Expression
+}
+
+func (tl *TemplateLiteral) expressionNode()      {}
+func (tl *TemplateLiteral) TokenLiteral() string { return tl.Token.Literal }
+func (tl *TemplateLiteral) Pos() token.Position  { return tl.Token.Pos }
+func (tl *TemplateLiteral) String() string {
+	var out bytes.Buffer
+	out.WriteString("\"")
+	for _, part := range tl.Parts {
+		if s, ok := part.(*StringLiteral); ok {
+			out.WriteString(s.Value)
+		} else {
+			out.WriteString("${" + part.String() + "}")
+		}
+	}
+	out.WriteString("\"")
+	return out.String()
+}
+
 // ArrayLiteral 数组实现
 type ArrayLiteral struct {
 	Token    token.Token // '['词法单元
@@ -346,6 +552,7 @@ type ArrayLiteral struct {
 
 func (al *ArrayLiteral) expressionNode()      {}
 func (al *ArrayLiteral) TokenLiteral() string { return al.Token.Literal }
+func (al *ArrayLiteral) Pos() token.Position  { return al.Token.Pos }
 func (al *ArrayLiteral) String() string {
 	var out bytes.Buffer
 	elements := []string{}
@@ -366,6 +573,7 @@ type IndexExpression struct {
 
 func (ie *IndexExpression) expressionNode()      {}
 func (ie *IndexExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IndexExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ie *IndexExpression) String() string {
 	var out bytes.Buffer
 
@@ -379,18 +587,24 @@ func (ie *IndexExpression) String() string {
 }
 
 type HashLiteral struct {
-	Token token.Token // '{'词法单元
-	Pairs map[Expression]Expression
+	Token token.Token       // '{'词法单元
+	Pairs []HashLiteralPair // 按源码中的顺序排列
+}
+
+type HashLiteralPair struct {
+	Key   Expression
+	Value Expression
 }
 
 func (hl *HashLiteral) expressionNode()      {}
 func (hl *HashLiteral) TokenLiteral() string { return hl.Token.Literal }
+func (hl *HashLiteral) Pos() token.Position  { return hl.Token.Pos }
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for key, value := range hl.Pairs {
-		pairs = append(pairs, key.String()+":"+value.String())
+	for _, pair := range hl.Pairs {
+		pairs = append(pairs, pair.Key.String()+":"+pair.Value.String())
 	}
 
 	out.WriteString("{")
@@ -399,3 +613,74 @@ func (hl *HashLiteral) String() string {
 
 	return out.String()
 }
+
+// TryExpression try { } catch (e) { } finally { },catch和finally至少有一个
+type TryExpression struct {
+	Token      token.Token // the 'try' token
+	Body       *BlockStatement
+	CatchParam *Identifier     // 绑定异常的变量,可以省略
+	Catch      *BlockStatement // 没有catch时为nil
+	Finally    *BlockStatement // 没有finally时为nil
+}
+
+func (te *TryExpression) expressionNode()      {}
+func (te *TryExpression) TokenLiteral() string { return te.Token.Literal }
+func (te *TryExpression) Pos() token.Position  { return te.Token.Pos }
+func (te *TryExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("try ")
+	out.WriteString(te.Body.String())
+
+	if te.Catch != nil {
+		out.WriteString(" catch ")
+		if te.CatchParam != nil {
+			out.WriteString("(" + te.CatchParam.String() + ") ")
+		}
+		out.WriteString(te.Catch.String())
+	}
+
+	if te.Finally != nil {
+		out.WriteString(" finally ")
+		out.WriteString(te.Finally.String())
+	}
+
+	return out.String()
+}
+
+// MatchExpression match subject { pattern if guard => result, ... },按顺序找到第一个匹配的分支,
+// 都不匹配时结果为null;subject只求值一次
+type MatchExpression struct {
+	Token   token.Token // the 'match' token
+	Subject Expression
+	Arms    []MatchArm
+}
+
+// MatchArm match的一个分支,模式可以是字面量、变量名、通配符_、数组模式和哈希模式
+type MatchArm struct {
+	Pattern Expression
+	Guard   Expression // if后面的条件,没有时为nil
+	Body    *BlockStatement
+}
+
+func (me *MatchExpression) expressionNode()      {}
+func (me *MatchExpression) TokenLiteral() string { return me.Token.Literal }
+func (me *MatchExpression) Pos() token.Position  { return me.Token.Pos }
+func (me *MatchExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("match " + me.Subject.String() + " {")
+	for i, arm := range me.Arms {
+		if i > 0 {
+			out.WriteString(",")
+		}
+		out.WriteString(" " + arm.Pattern.String())
+		if arm.Guard != nil {
+			out.WriteString(" if " + arm.Guard.String())
+		}
+		out.WriteString(" => " + arm.Body.String())
+	}
+	out.WriteString(" }")
+
+	return out.String()
+}
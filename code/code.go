@@ -10,28 +10,33 @@ type Instructions []byte // 字节集合
 
 type Opcode byte // 操作码
 
+// Version 操作码集合的版本,增删操作码或修改操作数宽度时必须加一,序列化的字节码据此判断能否加载
+const Version = 11
+
 const (
-	OpConstant    Opcode = iota // 以操作数为索引检索常量并压栈
-	OpAdd                       // +
-	OpPop                       // 出栈
-	OpSub                       // -
-	OpMul                       // *
-	OpDiv                       // /
-	OpTrue                      // true
-	OpFalse                     // false
-	OpEqual                     // ==
-	OpNotEqual                  // !=
-	OpGreaterThan               // >,因为是>的逆操作所以这里没有定义<
-	// TODO: 实现<=,>=
-	OpMinus         // 对整数取负
-	OpBang          // 布尔值取反
-	OpJumpNotTruthy // 不会真跳转
-	OpJump          // 直接跳转
-	OpNull          // Null,用于产生空值的情况
-	OpGetGlobal     // 获取全局变量
-	OpSetGlobal     // 定义全局变量
-	OpGetLocal      // 获取局部变量
-	OpSetLocal      // 定义局部变量
+	OpConstant      Opcode = iota // 以操作数为索引检索常量并压栈
+	OpAdd                         // +
+	OpPop                         // 出栈
+	OpSub                         // -
+	OpMul                         // *
+	OpDiv                         // /
+	OpTrue                        // true
+	OpFalse                       // false
+	OpEqual                       // ==
+	OpNotEqual                    // !=
+	OpGreaterThan                 // >
+	OpLessThan                    // <
+	OpLessEqual                   // <=
+	OpGreaterEqual                // >=
+	OpMinus                       // 对整数取负
+	OpBang                        // 布尔值取反
+	OpJumpNotTruthy               // 不会真跳转
+	OpJump                        // 直接跳转
+	OpNull                        // Null,用于产生空值的情况
+	OpGetGlobal                   // 获取全局变量
+	OpSetGlobal                   // 定义全局变量
+	OpGetLocal                    // 获取局部变量
+	OpSetLocal                    // 定义局部变量
 	OpArray
 	OpHash
 	OpIndex // 数组和哈希索引
@@ -39,6 +44,32 @@ const (
 	OpReturnValue
 	OpReturn
 	OpGetBuiltin
+	OpClosure      // 将常量池中的函数包装为闭包
+	OpGetFree      // 获取闭包捕获的自由变量
+	OpSetFree      // 修改闭包捕获的自由变量
+	OpSetIndex     // 数组和哈希的下标赋值
+	OpSetupTry     // 登记异常处理器,操作数为catch代码的位置
+	OpPopTry       // 撤销最近登记的异常处理器
+	OpThrow        // 抛出栈顶的值
+	OpMod          // %
+	OpPow          // **
+	OpBitAnd       // &
+	OpBitOr        // |
+	OpBitXor       // ^
+	OpShl          // <<
+	OpShr          // >>
+	OpBitNot       // ~,对整数按位取反
+	OpConcat       // 字符串插值,把栈顶的若干个值转换为字符串后拼接
+	OpCaptureLocal // 把局部变量转换为Cell并压栈,用于创建闭包
+	OpCaptureFree  // 把当前闭包捕获的Cell压栈,用于内层闭包继续捕获
+	OpJumpIfPassed // 参数已经传入时跳过计算默认值的代码
+	OpSpread       // 把栈顶的若干个数组拼接为一个数组,用于展开 ...arr
+	OpCallSpread   // 以栈顶数组的元素为参数调用函数
+	OpUnpackArray  // 按数组模式解构栈顶的值,元素逆序压栈,第一个元素在栈顶
+	OpUnpackHash   // 按栈顶的若干个键解构下面的哈希表,值逆序压栈,第一个键的值在栈顶
+	OpMatchArray   // 判断栈顶的值能否匹配数组模式,结果为布尔值
+	OpMatchHash    // 判断栈顶若干个键下面的值是否为包含这些键的哈希表,结果为布尔值
+	OpCheckDecl    // 栈顶的函数名还是null时报告函数在声明之前被调用
 )
 
 type Definition struct {
@@ -58,6 +89,9 @@ var definitions = map[Opcode]*Definition{ // 不用操作数宽度为0,反之为
 	OpEqual:         {"OpEqual", []int{}},          // ==
 	OpNotEqual:      {"OpNotEqual", []int{}},       // !=
 	OpGreaterThan:   {"OpGreaterThan", []int{}},    // >
+	OpLessThan:      {"OpLessThan", []int{}},       // <
+	OpLessEqual:     {"OpLessEqual", []int{}},      // <=
+	OpGreaterEqual:  {"OpGreaterEqual", []int{}},   // >=
 	OpMinus:         {"OpMinus", []int{}},          // -,直接操作栈顶元素，不用操作数
 	OpBang:          {"OpBang", []int{}},           // !
 	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}}, // 两字节
@@ -74,6 +108,32 @@ var definitions = map[Opcode]*Definition{ // 不用操作数宽度为0,反之为
 	OpSetLocal:      {"OpSetLocal", []int{1}},
 	OpGetLocal:      {"OpGetLocal", []int{1}},
 	OpGetBuiltin:    {"OpGetBuiltin", []int{1}},
+	OpClosure:       {"OpClosure", []int{2, 1}}, // 第一个操作数为函数在常量池中的索引,第二个为自由变量的个数
+	OpGetFree:       {"OpGetFree", []int{1}},
+	OpSetFree:       {"OpSetFree", []int{1}},
+	OpSetIndex:      {"OpSetIndex", []int{}}, // 依次弹出值、下标和被修改的对象,再把值压栈
+	OpSetupTry:      {"OpSetupTry", []int{2}},
+	OpPopTry:        {"OpPopTry", []int{}},
+	OpThrow:         {"OpThrow", []int{}},
+	OpMod:           {"OpMod", []int{}},
+	OpPow:           {"OpPow", []int{}},
+	OpBitAnd:        {"OpBitAnd", []int{}},
+	OpBitOr:         {"OpBitOr", []int{}},
+	OpBitXor:        {"OpBitXor", []int{}},
+	OpShl:           {"OpShl", []int{}},
+	OpShr:           {"OpShr", []int{}},
+	OpBitNot:        {"OpBitNot", []int{}},
+	OpConcat:        {"OpConcat", []int{2}}, // 操作数为拼接的值的个数
+	OpCaptureLocal:  {"OpCaptureLocal", []int{1}},
+	OpCaptureFree:   {"OpCaptureFree", []int{1}},
+	OpJumpIfPassed:  {"OpJumpIfPassed", []int{1, 2}}, // 第一个操作数为参数的下标,第二个为跳转的位置
+	OpSpread:        {"OpSpread", []int{2}},          // 操作数为拼接的数组个数
+	OpCallSpread:    {"OpCallSpread", []int{}},
+	OpUnpackArray:   {"OpUnpackArray", []int{2, 1}}, // 第一个操作数为元素个数,第二个为是否收集剩余元素
+	OpUnpackHash:    {"OpUnpackHash", []int{2}},     // 操作数为键的个数
+	OpMatchArray:    {"OpMatchArray", []int{2, 1}},  // 操作数与OpUnpackArray相同
+	OpMatchHash:     {"OpMatchHash", []int{2}},      // 操作数为键的个数
+	OpCheckDecl:     {"OpCheckDecl", []int{2}},      // 操作数为函数名在常量池中的索引
 }
 
 func Lookup(op byte) (*Definition, error) { // 查找操作码
@@ -144,10 +204,11 @@ func (ins Instructions) String() string { // 返回指令的可读形式
 	var out bytes.Buffer
 
 	i := 0
-	for i <= len(ins) {
+	for i < len(ins) {
 		def, err := Lookup(ins[i])
 		if err != nil {
 			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			i++
 			continue
 		}
 
@@ -174,6 +235,8 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 		return def.Name
 	case 1: //  如果操作数数量为 1，返回指令名称和第一个操作数的字符串表示形式。
 		return fmt.Sprintf("%s, %d", def.Name, operands[0])
+	case 2:
+		return fmt.Sprintf("%s, %d, %d", def.Name, operands[0], operands[1])
 	}
 
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
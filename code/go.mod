@@ -1,3 +1,6 @@
 module code
 
-go 1.22.1
\ No newline at end of file
+go 1.22.1
+
+require "my.com/myfile/token" v0.0.0
+replace "my.com/myfile/token" => "../token"
@@ -0,0 +1,25 @@
+package code
+
+import (
+	"sort"
+
+	"my.com/myfile/token"
+)
+
+// LineEntry 从Offset开始的指令都对应同一个源码位置,直到下一条记录为止
+type LineEntry struct {
+	Offset int
+	Pos    token.Position
+}
+
+// LineTable 指令偏移到源码位置的映射,按Offset递增排列
+type LineTable []LineEntry
+
+// Lookup 返回偏移为offset的指令(或其操作数)对应的源码位置
+func (lt LineTable) Lookup(offset int) (token.Position, bool) {
+	i := sort.Search(len(lt), func(i int) bool { return lt[i].Offset > offset })
+	if i == 0 {
+		return token.Position{}, false
+	}
+	return lt[i-1].Pos, true
+}
@@ -5,18 +5,46 @@ import (
 	"my.com/myfile/ast"
 	"my.com/myfile/code"
 	"my.com/myfile/object"
-	"sort"
+	"my.com/myfile/token"
 )
 
+// MaxLocals 一个函数最多的局部变量个数(包括参数和编译器生成的隐藏变量),
+// 也是最多能捕获的自由变量个数,由OpGetLocal和OpGetFree的一字节操作数决定
+const MaxLocals = 256
+
 type Compiler struct {
 	//instructions        code.Instructions  // 指令
-	constants []object.Object // 常量池
+	constants     []object.Object     // 常量池
+	constantIndex map[constantKey]int // 整数和字符串常量在常量池中的位置,相同的常量只保存一次
 	//lastInstruction     EmittedInstruction // 发出的最后一条指令
 	//previousInstruction EmittedInstruction // 发出的倒数第二条指令
 	SymbolTable *SymbolTable
 
 	scopes     []CompilationScope // 存放函数作用域
 	scopeIndex int
+
+	pos token.Position // 正在编译的节点的源码位置,发出指令时记录到行号表中
+}
+
+// CompileError 编译错误,记录出错节点的源码位置
+type CompileError struct {
+	Pos     token.Position
+	Message string
+}
+
+func (e *CompileError) Error() string {
+	if !e.Pos.IsValid() {
+		return e.Message
+	}
+	return e.Pos.String() + ": " + e.Message
+}
+
+func newCompileError(pos token.Position, format string, a ...interface{}) *CompileError {
+	return &CompileError{Pos: pos, Message: fmt.Sprintf(format, a...)}
+}
+
+func (c *Compiler) errorf(format string, a ...interface{}) error { // 在当前节点的位置生成编译错误
+	return newCompileError(c.pos, format, a...)
 }
 
 type EmittedInstruction struct {
@@ -38,16 +66,24 @@ func New() *Compiler { // 返回Compiler结构指针
 	}
 
 	return &Compiler{
-		constants:   []object.Object{},
-		SymbolTable: NewSymbolTable(),
-		scopes:      []CompilationScope{mainScope},
-		scopeIndex:  0,
+		constants:     []object.Object{},
+		constantIndex: map[constantKey]int{},
+		SymbolTable:   symbolTable,
+		scopes:        []CompilationScope{mainScope},
+		scopeIndex:    0,
 	}
 }
 
 func (c *Compiler) Compile(node ast.Node) error { // 编译器
+	if pos := node.Pos(); pos.IsValid() { // 编译子节点时会修改位置,返回时恢复为当前节点的位置
+		parentPos := c.pos
+		c.pos = pos
+		defer func() { c.pos = parentPos }()
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
+		c.declareFunctions(node.Statements)
 		for _, s := range node.Statements {
 			err := c.Compile(s)
 			if err != nil {
@@ -61,17 +97,10 @@ func (c *Compiler) Compile(node ast.Node) error { // 编译器
 		}
 		c.emit(code.OpPop) // 每次执行表达式后执行一次弹栈操作清理栈
 	case *ast.InfixExpression: // 中缀表达式
-		if node.Operator == "<" { // 实现<的逆操作，也就是>
-			err := c.Compile(node.Right)
-			if err != nil {
-				return err
-			}
-
-			err = c.Compile(node.Left)
-			if err != nil {
-				return err
-			}
+		if node.Operator == "&&" || node.Operator == "||" { // 逻辑运算需要短路,不能先计算两边的值
+			return c.compileLogicalExpression(node)
 		}
+
 		err := c.Compile(node.Left)
 		if err != nil {
 			return err
@@ -91,19 +120,45 @@ func (c *Compiler) Compile(node ast.Node) error { // 编译器
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "%":
+			c.emit(code.OpMod)
+		case "**":
+			c.emit(code.OpPow)
+		case "&":
+			c.emit(code.OpBitAnd)
+		case "|":
+			c.emit(code.OpBitOr)
+		case "^":
+			c.emit(code.OpBitXor)
+		case "<<":
+			c.emit(code.OpShl)
+		case ">>":
+			c.emit(code.OpShr)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case "<":
+			c.emit(code.OpLessThan)
+		case "<=":
+			c.emit(code.OpLessEqual)
+		case ">=":
+			c.emit(code.OpGreaterEqual)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
-			c.emit(code.OpGreaterThan)
+			c.emit(code.OpNotEqual)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return c.errorf("unknown operator %s", node.Operator)
 		}
 
 	case *ast.IntegerLiteral: // 整数字面量,利用object中已有的对象简化工作
-		integer := &object.Integer{Value: node.Value}   // 求值
+		var integer object.Object = &object.Integer{Value: node.Value} // 求值
+		if node.Big != nil {
+			integer = &object.BigInteger{Value: node.Big}
+		}
 		c.emit(code.OpConstant, c.addConstant(integer)) // 生成opConstant指令
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
 	case *ast.StringLiteral:
 		str := &object.String{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(str))
@@ -124,8 +179,10 @@ func (c *Compiler) Compile(node ast.Node) error { // 编译器
 			c.emit(code.OpBang)
 		case "-":
 			c.emit(code.OpMinus)
+		case "~":
+			c.emit(code.OpBitNot)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return c.errorf("unknown operator %s", node.Operator)
 		}
 	case *ast.IfExpression: // 处理if表达式
 		err := c.Compile(node.Condition)
@@ -134,18 +191,18 @@ func (c *Compiler) Compile(node ast.Node) error { // 编译器
 		}
 
 		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+		depth := c.stackDepth()
 		err = c.Compile(node.Consequence)
 		if err != nil {
-			return nil
+			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) { // if语句块的结尾不能执行出栈执行，栈里必须有一个结果，因此这里需要删除最后一个的OpPop指令
-			c.removeLastPop()
-		}
+		c.keepBlockValue() // if语句块的结尾必须在栈里留下一个结果
 		jumpPos := c.emit(code.OpJump, 9999)
 
 		afterConsequencePos := len(c.currentInstructions())
 		c.changeOperand(jumpNotTruthyPos, afterConsequencePos) // 将位置在jumpNotTruthyPos处的OpJumpNotTruthy指令的操作数替换为afterConsequencePos
+		c.setStackDepth(depth)                                 // else分支从条件跳转处开始,栈里没有consequence的结果
 
 		if node.Alternative == nil { // 如果else语句为空,就压栈Null,避免if语句不成立出栈的时候栈没有内容的情况
 			c.emit(code.OpNull)
@@ -155,14 +212,103 @@ func (c *Compiler) Compile(node ast.Node) error { // 编译器
 				return err
 			}
 
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastPop()
-			}
+			c.keepBlockValue()
 		}
 
 		afterAlternativePos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterAlternativePos)
+	case *ast.WhileExpression: // 处理while循环
+		loopStart := len(c.currentInstructions())
+
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+		exitJumpPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		loop := c.enterLoop()
+		loop.continueTarget = loopStart // while的continue直接回到条件判断处
+
+		err = c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpJump, loopStart)
+
+		afterLoopPos := len(c.currentInstructions())
+		c.changeOperand(exitJumpPos, afterLoopPos)
+		c.leaveLoop(afterLoopPos)
+
+		c.emit(code.OpNull) // 循环作为表达式的值为null,与解释器保持一致
+	case *ast.ForExpression: // 处理for循环
+		if node.Initialize != nil {
+			err := c.Compile(node.Initialize)
+			if err != nil {
+				return err
+			}
+		}
+
+		loopStart := len(c.currentInstructions())
+
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+		exitJumpPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		loop := c.enterLoop()
+
+		err = c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+
+		loop.continueTarget = len(c.currentInstructions()) // for的continue需要先执行循环操作再判断条件
+		if node.Cycleop != nil {
+			err = c.Compile(node.Cycleop)
+			if err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpJump, loopStart)
+
+		afterLoopPos := len(c.currentInstructions())
+		c.changeOperand(exitJumpPos, afterLoopPos)
+		c.leaveLoop(afterLoopPos)
+
+		c.emit(code.OpNull)
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return c.errorf("break outside loop")
+		}
+
+		depth := c.popToLoopDepth(loop)
+		err := c.unwindTries(loop.tryDepth) // 跳出循环内的try时先执行finally
+		if err != nil {
+			return err
+		}
+
+		pos := c.emit(code.OpJump, 9999) // 循环结束的位置暂时未知,等离开循环时回填
+		loop.breakJumps = append(loop.breakJumps, pos)
+		c.setStackDepth(depth) // 之后的代码不会执行,按没有跳转计算栈深度
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return c.errorf("continue outside loop")
+		}
+
+		depth := c.popToLoopDepth(loop)
+		err := c.unwindTries(loop.tryDepth)
+		if err != nil {
+			return err
+		}
+
+		pos := c.emit(code.OpJump, 9999)
+		loop.continueJumps = append(loop.continueJumps, pos)
+		c.setStackDepth(depth)
 	case *ast.BlockStatement: // 处理block语句块
+		c.declareFunctions(node.Statements)
 		for _, s := range node.Statements {
 			err := c.Compile(s)
 			if err != nil {
@@ -170,48 +316,104 @@ func (c *Compiler) Compile(node ast.Node) error { // 编译器
 			}
 		}
 	case *ast.LetStatement:
+		if fn, ok := node.Value.(*ast.FunctionLiteral); ok && node.Name != nil {
+			return c.compileFunctionDefinition(node.Name, fn)
+		}
+
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
 
+		if node.Pattern != nil {
+			return c.compileDestructuring(node.Pattern)
+		}
+
 		symbol := c.SymbolTable.Define(node.Name.Value)
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
+		c.storeSymbol(symbol)
+	case *ast.FunctionStatement: // 函数名已经在块的开头定义,这里创建函数
+		return c.compileFunctionDefinition(node.Name, node.Function)
+	case *ast.AssignExpression: // 赋值表达式,执行后栈顶留下被赋的值
+		switch target := node.Target.(type) {
+		case *ast.Identifier:
+			symbol, ok := c.SymbolTable.Resolve(target.Value)
+			if !ok {
+				return newCompileError(target.Pos(), "undefined variable %s", target.Value)
+			}
+
+			err := c.Compile(node.Value)
+			if err != nil {
+				return err
+			}
+
+			switch symbol.Scope {
+			case GlobalScope:
+				c.emit(code.OpSetGlobal, symbol.Index)
+			case LocalScope:
+				c.emit(code.OpSetLocal, symbol.Index)
+			case FreeScope: // 修改捕获的Cell,外层函数和其他捕获它的闭包都能看到
+				c.emit(code.OpSetFree, symbol.Index)
+			default:
+				return newCompileError(target.Pos(), "cannot assign to %s", target.Value)
+			}
+
+			c.loadSymbol(symbol)
+		case *ast.IndexExpression:
+			err := c.Compile(target.Left)
+			if err != nil {
+				return err
+			}
+
+			err = c.Compile(target.Index)
+			if err != nil {
+				return err
+			}
+
+			err = c.Compile(node.Value)
+			if err != nil {
+				return err
+			}
+
+			c.emit(code.OpSetIndex)
+		default:
+			return c.errorf("invalid assignment target %s", node.Target.String())
 		}
 	case *ast.Identifier: // 解析变量名
 		symbol, ok := c.SymbolTable.Resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("undefined variable %s", node.Value)
+			return c.errorf("undefined variable %s", node.Value)
 		}
 
 		c.loadSymbol(symbol)
+	case *ast.TemplateLiteral: // 字符串插值,各部分依次压栈后用一条OpConcat拼接
+		for _, part := range node.Parts {
+			err := c.Compile(part)
+			if err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpConcat, len(node.Parts))
 	case *ast.ArrayLiteral: // 数组
+		if hasSpread(node.Elements) {
+			return c.compileSpreadList(node.Elements)
+		}
+
 		for _, el := range node.Elements {
 			err := c.Compile(el)
 			if err != nil {
-				return nil
+				return err
 			}
 		}
 
 		c.emit(code.OpArray, len(node.Elements))
 	case *ast.HashLiteral: // 哈希
-		keys := []ast.Expression{}
-		for k := range node.Pairs {
-			keys = append(keys, k)
-		}
-		sort.Slice(keys, func(i, j int) bool { // 对键值对排序,避免顺序不一致
-			return keys[i].String() < keys[j].String()
-		})
-
-		for _, k := range keys {
-			err := c.Compile(k)
+		for _, pair := range node.Pairs { // 按源码顺序编译,哈希表保持插入顺序
+			err := c.Compile(pair.Key)
 			if err != nil {
 				return err
 			}
-			err = c.Compile(node.Pairs[k])
+			err = c.Compile(pair.Value)
 			if err != nil {
 				return err
 			}
@@ -231,41 +433,34 @@ func (c *Compiler) Compile(node ast.Node) error { // 编译器
 
 		c.emit(code.OpIndex)
 	case *ast.FunctionLiteral: // 函数字面量,在编译函数时更改发出指令的存储位置
-		c.enterScope()
-
-		for _, p := range node.Parameters {
-			c.SymbolTable.Define(p.Value)
-		}
+		return c.compileFunctionLiteral(node)
 
-		err := c.Compile(node.Body)
+	case *ast.ReturnStatement:
+		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) { // 函数最后一条的出栈指令用return代替
-			c.replaceLastPopWithReturn()
-		}
-		if !c.lastInstructionIs(code.OpReturnValue) { // 考虑到函数没有任何语句的情况
-			c.emit(code.OpReturn)
+		err = c.unwindTries(0) // 返回前执行函数内所有未结束的try的finally
+		if err != nil {
+			return err
 		}
 
-		numLocals := c.SymbolTable.numDefinitions // 计数局部变量
-		instructions := c.leaveScope()
-
-		compiledFn := &object.CompiledFunction{
-			Instructions:  instructions,
-			NumLocals:     numLocals,
-			NumParameters: len(node.Parameters),
-		}
-		c.emit(code.OpConstant, c.addConstant(compiledFn))
+		c.emit(code.OpReturnValue)
 
-	case *ast.ReturnStatement:
-		err := c.Compile(node.ReturnValue)
+	case *ast.ThrowStatement:
+		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
 
-		c.emit(code.OpReturnValue)
+		c.emit(code.OpThrow)
+
+	case *ast.TryExpression:
+		return c.compileTryExpression(node)
+
+	case *ast.MatchExpression:
+		return c.compileMatchExpression(node)
 
 	case *ast.CallExpression:
 		err := c.Compile(node.Function)
@@ -273,6 +468,22 @@ func (c *Compiler) Compile(node ast.Node) error { // 编译器
 			return err
 		}
 
+		if ident, ok := node.Function.(*ast.Identifier); ok { // 调用fn声明的函数时检查声明语句是否已经执行
+			if symbol, _ := c.SymbolTable.Resolve(ident.Value); symbol.Function {
+				c.emit(code.OpCheckDecl, c.addConstant(&object.String{Value: ident.Value}))
+			}
+		}
+
+		if hasSpread(node.Arguments) { // 参数个数在运行时才知道,先把参数组成数组
+			err := c.compileSpreadList(node.Arguments)
+			if err != nil {
+				return err
+			}
+
+			c.emit(code.OpCallSpread)
+			return nil
+		}
+
 		for _, a := range node.Arguments {
 			err := c.Compile(a)
 			if err != nil {
@@ -288,17 +499,44 @@ func (c *Compiler) Compile(node ast.Node) error { // 编译器
 type Bytecode struct {
 	Instructions code.Instructions // 字节码
 	Constants    []object.Object   // 切片类型，常量池
+	Lines        code.LineTable    // 指令对应的源码位置
 }
 
 func (c *Compiler) Bytecode() *Bytecode {
 	return &Bytecode{
 		Instructions: c.currentInstructions(),
 		Constants:    c.constants,
+		Lines:        c.scopes[c.scopeIndex].lines,
+	}
+}
+
+// constantKey 可以复用的常量,类型和值都相同时是同一个常量
+type constantKey struct {
+	Type  object.ObjectType
+	Int   int64
+	Value string
+}
+
+func keyOfConstant(obj object.Object) (constantKey, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return constantKey{Type: obj.Type(), Int: obj.Value}, true
+	case *object.String:
+		return constantKey{Type: obj.Type(), Value: obj.Value}, true
 	}
+	return constantKey{}, false
 }
 
 func (c *Compiler) addConstant(obj object.Object) int { // 将求值结果添加到常量池中
+	key, reusable := keyOfConstant(obj)
+	if index, ok := c.constantIndex[key]; reusable && ok { // match的模式和内联的finally块会反复用到同样的常量
+		return index
+	}
+
 	c.constants = append(c.constants, obj)
+	if reusable {
+		c.constantIndex[key] = len(c.constants) - 1
+	}
 	return len(c.constants) - 1 // 添加到编译器constants切片末尾，返回其在constants切片中的索引来为其提供标识符，用作opConstant指令的操作数
 }
 
@@ -308,6 +546,8 @@ func (c *Compiler) emit(op code.Opcode, operands ...int) int { // 根据操作
 
 	// 将指令添加到指令集中
 	pos := c.addInstruction(ins)
+	c.addLine(pos)
+	c.scopes[c.scopeIndex].stackDepth += stackEffect(op, operands)
 
 	// 记录最后生成的指令和位置
 	c.setLastInstruction(op, pos)
@@ -327,6 +567,17 @@ func (c *Compiler) addInstruction(ins []byte) int {
 	return posNewInstruction
 }
 
+func (c *Compiler) addLine(offset int) { // 记录新指令的源码位置,位置与上一条记录相同时不需要新的记录
+	lines := c.scopes[c.scopeIndex].lines
+	if !c.pos.IsValid() {
+		return
+	}
+	if len(lines) > 0 && lines[len(lines)-1].Pos == c.pos {
+		return
+	}
+	c.scopes[c.scopeIndex].lines = append(lines, code.LineEntry{Offset: offset, Pos: c.pos})
+}
+
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) { // 获得最后发出指令的两个操作码
 	previous := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{Opcode: op, Position: pos}
@@ -352,6 +603,13 @@ func (c *Compiler) removeLastPop() { // 移除最后一条指令，做法是将
 
 	c.scopes[c.scopeIndex].instructions = new
 	c.scopes[c.scopeIndex].lastInstruction = previous
+	c.scopes[c.scopeIndex].stackDepth++ // 被移除的OpPop不再弹出值
+
+	lines := c.scopes[c.scopeIndex].lines // 同时删除被移除指令的行号记录
+	for len(lines) > 0 && lines[len(lines)-1].Offset >= last.Position {
+		lines = lines[:len(lines)-1]
+	}
+	c.scopes[c.scopeIndex].lines = lines
 }
 
 func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) { // 替换指令
@@ -373,6 +631,13 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler { // 新
 	compiler := New()
 	compiler.SymbolTable = s
 	compiler.constants = constants
+	for i, constant := range constants { // 之前编译的常量同样可以复用
+		if key, ok := keyOfConstant(constant); ok {
+			if _, seen := compiler.constantIndex[key]; !seen {
+				compiler.constantIndex[key] = i
+			}
+		}
+	}
 	return compiler
 }
 
@@ -380,6 +645,26 @@ type CompilationScope struct {
 	instructions        code.Instructions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+	lines               code.LineTable // 行号表
+
+	loops []*LoopContext // 当前函数中正在编译的循环,break和continue只能跳转到同一函数内的循环
+	tries []*TryContext  // 当前函数中正在编译的try,return、break和continue离开时需要执行它们的finally
+
+	stackDepth int // 执行到当前位置时操作数栈上属于这个函数的值的个数,由emit按指令累计
+}
+
+type LoopContext struct { // 记录一个循环中需要回填的跳转指令
+	continueTarget int   // continue跳转的目标位置
+	breakJumps     []int // break发出的OpJump指令位置
+	continueJumps  []int // continue发出的OpJump指令位置
+	tryDepth       int   // 进入循环时tries的长度,break和continue只离开循环内的try
+	stackDepth     int   // 进入循环时的栈深度,break和continue跳转前弹出多出的值
+}
+
+type TryContext struct {
+	finally   *ast.BlockStatement // 离开try时要执行的代码,可以为nil
+	handler   bool                // 虚拟机中是否登记着这个try的异常处理器
+	loopDepth int                 // 进入try时loops的长度
 }
 
 func (c *Compiler) currentInstructions() code.Instructions { // 返回当前作用域
@@ -424,5 +709,639 @@ func (c *Compiler) loadSymbol(s Symbol) { // 判断符号表表达内容
 		c.emit(code.OpGetLocal, s.Index)
 	case BuiltinScope:
 		c.emit(code.OpGetBuiltin, s.Index)
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	}
+}
+
+// captureSymbol 创建闭包时加载被捕获的变量:局部变量和自由变量加载它们的Cell,
+// 这样闭包和外层函数修改的是同一个变量;全局变量和内置函数不会被捕获
+func (c *Compiler) captureSymbol(s Symbol) {
+	switch s.Scope {
+	case LocalScope:
+		c.emit(code.OpCaptureLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpCaptureFree, s.Index)
+	}
+}
+
+func (c *Compiler) storeSymbol(s Symbol) { // 将栈顶的值保存到let定义的变量中
+	if s.Scope == GlobalScope {
+		c.emit(code.OpSetGlobal, s.Index)
+	} else {
+		c.emit(code.OpSetLocal, s.Index)
+	}
+}
+
+// declareFunctions 在块的开头定义块中用fn声明的所有函数名,并先赋值为null,
+// 这样函数体可以引用之后才声明的函数,例如两个函数互相递归;函数本身在声明语句处创建
+// 声明语句执行之前调用函数时由OpCheckDecl报错
+func (c *Compiler) declareFunctions(statements []ast.Statement) {
+	for _, s := range statements {
+		if decl, ok := s.(*ast.FunctionStatement); ok {
+			symbol := c.SymbolTable.DefineFunction(decl.Name.Value)
+			c.emit(code.OpNull)
+			c.storeSymbol(symbol)
+		}
+	}
+}
+
+// compileFunctionDefinition 编译let或者fn声明定义的函数,函数名在创建函数之前定义,
+// 与解释器一样,函数体中的函数名引用这个变量,变量被重新赋值后函数体看到的是新的值
+// 局部函数捕获自己的名字时与外层函数共用同一个Cell,所以能看到这里赋的值
+func (c *Compiler) compileFunctionDefinition(name *ast.Identifier, fn *ast.FunctionLiteral) error {
+	symbol := c.SymbolTable.Define(name.Value)
+
+	err := c.compileFunctionLiteral(fn)
+	if err != nil {
+		return err
+	}
+
+	c.storeSymbol(symbol)
+	return nil
+}
+
+// compileFunctionLiteral 编译函数并生成创建闭包的指令
+// 有名字的函数都由let或fn声明定义,函数名在外层作用域中已经定义,递归调用时按普通变量引用
+func (c *Compiler) compileFunctionLiteral(node *ast.FunctionLiteral) error {
+	c.enterScope()
+
+	for _, p := range node.Parameters {
+		c.SymbolTable.DefineParameter(p.Value)
+	}
+	if node.Rest != nil { // 剩余参数是参数之后的局部变量,调用时由虚拟机收集
+		c.SymbolTable.DefineParameter(node.Rest.Value)
 	}
+
+	for i := range node.Parameters { // 函数开头按顺序为没有传入的参数计算默认值,再解构参数
+		if node.Defaults != nil && node.Defaults[i] != nil {
+			jumpPos := c.emit(code.OpJumpIfPassed, i, 9999)
+			err := c.Compile(node.Defaults[i])
+			if err != nil {
+				return err
+			}
+			c.emit(code.OpSetLocal, i)
+			c.replaceInstruction(jumpPos, code.Make(code.OpJumpIfPassed, i, len(c.currentInstructions())))
+		}
+
+		if node.Patterns != nil && node.Patterns[i] != nil {
+			parentPos := c.pos
+			c.pos = node.Patterns[i].Pos() // 解构失败时报告参数模式的位置,与解释器一致
+			c.emit(code.OpGetLocal, i)
+			err := c.compileDestructuring(node.Patterns[i])
+			c.pos = parentPos
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := c.Compile(node.Body)
+	if err != nil {
+		return err
+	}
+
+	if c.lastInstructionIs(code.OpPop) { // 函数最后一条的出栈指令用return代替
+		c.replaceLastPopWithReturn()
+	}
+	if !c.lastInstructionIs(code.OpReturnValue) { // 考虑到函数没有任何语句的情况
+		c.emit(code.OpReturn)
+	}
+
+	freeSymbols := c.SymbolTable.FreeSymbols
+	numLocals := c.SymbolTable.numDefinitions // 计数局部变量
+	// 局部变量的下标只有一个字节,超出时会访问到错误的槽位
+	if numLocals > MaxLocals {
+		return c.errorf("too many local variables in function: %d, max %d", numLocals, MaxLocals)
+	}
+	if len(freeSymbols) > MaxLocals {
+		return c.errorf("too many captured variables in function: %d, max %d", len(freeSymbols), MaxLocals)
+	}
+	lines := c.scopes[c.scopeIndex].lines
+	instructions := c.leaveScope()
+
+	for _, s := range freeSymbols { // 在外层作用域中加载被捕获的变量,由OpClosure收集
+		c.captureSymbol(s)
+	}
+
+	compiledFn := &object.CompiledFunction{
+		Instructions:  instructions,
+		NumLocals:     numLocals,
+		NumParameters: len(node.Parameters),
+		NumDefaults:   numDefaults(node.Defaults),
+		Variadic:      node.Rest != nil,
+		Lines:         lines,
+		Name:          node.Name,
+	}
+	fnIndex := c.addConstant(compiledFn)
+	c.emit(code.OpClosure, fnIndex, len(freeSymbols))
+	return nil
+}
+
+// compileDestructuring 按模式解构栈顶的值,依次定义模式中的变量并赋值
+// OpUnpackArray和OpUnpackHash把取出的值逆序压栈,按源码顺序处理的每一项正好从栈顶取到自己的值
+func (c *Compiler) compileDestructuring(pattern ast.Expression) error {
+	switch pattern := pattern.(type) {
+	case *ast.Identifier:
+		if pattern.Value == "_" { // 通配符,丢弃对应的值
+			c.emit(code.OpPop)
+			return nil
+		}
+		symbol := c.SymbolTable.Define(pattern.Value)
+		c.storeSymbol(symbol)
+	case *ast.ArrayPattern:
+		rest := 0
+		if pattern.Rest != nil {
+			rest = 1
+		}
+		c.emit(code.OpUnpackArray, len(pattern.Elements), rest)
+
+		for _, el := range pattern.Elements {
+			err := c.compileDestructuring(el)
+			if err != nil {
+				return err
+			}
+		}
+		if pattern.Rest != nil {
+			return c.compileDestructuring(pattern.Rest)
+		}
+	case *ast.HashPattern:
+		for _, pair := range pattern.Pairs {
+			c.emit(code.OpConstant, c.addConstant(&object.String{Value: pair.Key.Value}))
+		}
+		c.emit(code.OpUnpackHash, len(pattern.Pairs))
+
+		for _, pair := range pattern.Pairs {
+			err := c.compileDestructuring(pair.Value)
+			if err != nil {
+				return err
+			}
+		}
+	default: // match中的字面量只用于比较,不绑定变量
+		c.emit(code.OpPop)
+	}
+	return nil
+}
+
+// compileMatchExpression 编译match表达式,subject只求值一次,保存在一个隐藏的变量中供每个分支比较
+// 每个分支先比较模式,匹配后再绑定变量、检查guard,任何一步失败都跳到下一个分支;都不匹配时结果为null
+func (c *Compiler) compileMatchExpression(node *ast.MatchExpression) error {
+	err := c.Compile(node.Subject)
+	if err != nil {
+		return err
+	}
+
+	subject := c.SymbolTable.DefineHidden("match subject") // 每个match使用自己的槽位,guard或分支中嵌套的match不会覆盖它
+	c.storeSymbol(subject)
+	load := func() { c.loadSymbol(subject) }
+
+	depth := c.stackDepth()
+	endJumps := []int{}
+	for _, arm := range node.Arms {
+		c.setStackDepth(depth) // 每个分支都从不匹配时的跳转处开始
+		failJumps, err := c.compileMatchTest(arm.Pattern, load)
+		if err != nil {
+			return err
+		}
+
+		if bindsVariables(arm.Pattern) {
+			load()
+			err := c.compileDestructuring(arm.Pattern)
+			if err != nil {
+				return err
+			}
+		}
+
+		if arm.Guard != nil {
+			err := c.Compile(arm.Guard)
+			if err != nil {
+				return err
+			}
+			failJumps = append(failJumps, c.emit(code.OpJumpNotTruthy, 9999))
+		}
+
+		err = c.Compile(arm.Body)
+		if err != nil {
+			return err
+		}
+		c.keepBlockValue()
+		endJumps = append(endJumps, c.emit(code.OpJump, 9999))
+
+		nextArmPos := len(c.currentInstructions())
+		for _, pos := range failJumps {
+			c.changeOperand(pos, nextArmPos)
+		}
+	}
+
+	c.setStackDepth(depth)
+	c.emit(code.OpNull)
+
+	afterMatchPos := len(c.currentInstructions())
+	for _, pos := range endJumps {
+		c.changeOperand(pos, afterMatchPos)
+	}
+	return nil
+}
+
+// compileMatchTest 生成比较模式的指令,load生成把被比较的值压栈的指令;返回不匹配时的跳转指令,由调用者回填
+func (c *Compiler) compileMatchTest(pattern ast.Expression, load func()) ([]int, error) {
+	switch pattern := pattern.(type) {
+	case *ast.Identifier: // 变量名和通配符匹配任何值
+		return nil, nil
+	case *ast.ArrayPattern:
+		rest := 0
+		if pattern.Rest != nil {
+			rest = 1
+		}
+		load()
+		c.emit(code.OpMatchArray, len(pattern.Elements), rest)
+		jumps := []int{c.emit(code.OpJumpNotTruthy, 9999)}
+
+		for i, el := range pattern.Elements {
+			index := c.addConstant(&object.Integer{Value: int64(i)})
+			elJumps, err := c.compileMatchTest(el, func() {
+				load()
+				c.emit(code.OpConstant, index)
+				c.emit(code.OpIndex)
+			})
+			if err != nil {
+				return nil, err
+			}
+			jumps = append(jumps, elJumps...)
+		}
+		return jumps, nil
+	case *ast.HashPattern:
+		keys := make([]int, len(pattern.Pairs))
+		for i, pair := range pattern.Pairs {
+			keys[i] = c.addConstant(&object.String{Value: pair.Key.Value})
+		}
+		load()
+		for _, key := range keys {
+			c.emit(code.OpConstant, key)
+		}
+		c.emit(code.OpMatchHash, len(pattern.Pairs))
+		jumps := []int{c.emit(code.OpJumpNotTruthy, 9999)}
+
+		for i, pair := range pattern.Pairs {
+			key := keys[i]
+			valueJumps, err := c.compileMatchTest(pair.Value, func() {
+				load()
+				c.emit(code.OpConstant, key)
+				c.emit(code.OpIndex)
+			})
+			if err != nil {
+				return nil, err
+			}
+			jumps = append(jumps, valueJumps...)
+		}
+		return jumps, nil
+	default: // 字面量,用==比较
+		load()
+		err := c.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		c.emit(code.OpEqual)
+		return []int{c.emit(code.OpJumpNotTruthy, 9999)}, nil
+	}
+}
+
+func bindsVariables(pattern ast.Expression) bool { // 模式中是否有需要绑定的变量
+	switch pattern := pattern.(type) {
+	case *ast.Identifier:
+		return pattern.Value != "_"
+	case *ast.ArrayPattern:
+		if pattern.Rest != nil {
+			return true
+		}
+		for _, el := range pattern.Elements {
+			if bindsVariables(el) {
+				return true
+			}
+		}
+	case *ast.HashPattern:
+		for _, pair := range pattern.Pairs {
+			if bindsVariables(pair.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func numDefaults(defaults []ast.Expression) int { // 有默认值的参数个数
+	n := 0
+	for _, def := range defaults {
+		if def != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func hasSpread(elements []ast.Expression) bool {
+	for _, el := range elements {
+		if _, ok := el.(*ast.SpreadExpression); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// compileSpreadList 编译含有展开的调用参数或者数组元素,结果为一个数组
+// 连续的普通元素先用OpArray组成数组,再和展开的数组一起用OpSpread按顺序拼接
+func (c *Compiler) compileSpreadList(elements []ast.Expression) error {
+	parts := 0
+	pending := 0 // 还没有组成数组的普通元素个数
+	for _, el := range elements {
+		spread, ok := el.(*ast.SpreadExpression)
+		if !ok {
+			err := c.Compile(el)
+			if err != nil {
+				return err
+			}
+			pending++
+			continue
+		}
+
+		if pending > 0 {
+			c.emit(code.OpArray, pending)
+			parts++
+			pending = 0
+		}
+		err := c.Compile(spread.Value)
+		if err != nil {
+			return err
+		}
+		parts++
+	}
+	if pending > 0 {
+		c.emit(code.OpArray, pending)
+		parts++
+	}
+
+	c.emit(code.OpSpread, parts)
+	return nil
+}
+
+func (c *Compiler) keepBlockValue() { // 块语句作为表达式使用时,保证栈里留下一个结果
+	if c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull) // 块以let等不产生值的语句结尾或者为空
+	}
+}
+
+func (c *Compiler) enterLoop() *LoopContext { // 进入循环
+	loop := &LoopContext{tryDepth: len(c.scopes[c.scopeIndex].tries), stackDepth: c.stackDepth()}
+	c.scopes[c.scopeIndex].loops = append(c.scopes[c.scopeIndex].loops, loop)
+	return loop
+}
+
+func (c *Compiler) currentLoop() *LoopContext { // 返回最内层的循环,不在循环中则返回nil
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops[len(loops)-1]
+}
+
+func (c *Compiler) leaveLoop(afterLoopPos int) { // 离开循环,回填break和continue的跳转目标
+	loop := c.currentLoop()
+
+	for _, pos := range loop.breakJumps {
+		c.changeOperand(pos, afterLoopPos)
+	}
+	for _, pos := range loop.continueJumps {
+		c.changeOperand(pos, loop.continueTarget)
+	}
+
+	loops := c.scopes[c.scopeIndex].loops
+	c.scopes[c.scopeIndex].loops = loops[:len(loops)-1]
+}
+
+// popToLoopDepth 弹出break或continue所在的表达式已经压栈的值,例如数组字面量中已经计算的元素,
+// 使跳转后的栈深度与进入循环时相同;返回弹出前的栈深度
+func (c *Compiler) popToLoopDepth(loop *LoopContext) int {
+	depth := c.stackDepth()
+	for i := loop.stackDepth; i < depth; i++ {
+		c.emit(code.OpPop)
+	}
+	return depth
+}
+
+func (c *Compiler) stackDepth() int {
+	return c.scopes[c.scopeIndex].stackDepth
+}
+
+func (c *Compiler) setStackDepth(depth int) { // 只能通过跳转到达的代码从跳转处的栈深度开始
+	c.scopes[c.scopeIndex].stackDepth = depth
+}
+
+// stackEffect 指令执行后栈深度的变化
+func stackEffect(op code.Opcode, operands []int) int {
+	switch op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull, code.OpGetGlobal, code.OpGetLocal,
+		code.OpGetBuiltin, code.OpGetFree, code.OpCaptureLocal, code.OpCaptureFree:
+		return 1
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPow,
+		code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShl, code.OpShr,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan, code.OpLessEqual, code.OpGreaterEqual,
+		code.OpPop, code.OpJumpNotTruthy, code.OpSetGlobal, code.OpSetLocal, code.OpSetFree, code.OpIndex,
+		code.OpReturnValue, code.OpThrow, code.OpCallSpread, code.OpUnpackHash:
+		return -1
+	case code.OpSetIndex:
+		return -2
+	case code.OpArray, code.OpHash, code.OpConcat, code.OpSpread:
+		return 1 - operands[0]
+	case code.OpClosure:
+		return 1 - operands[1]
+	case code.OpCall, code.OpMatchHash:
+		return -operands[0]
+	case code.OpUnpackArray:
+		return operands[0] + operands[1] - 1
+	case code.OpMinus, code.OpBang, code.OpBitNot, code.OpMatchArray, // 弹出一个值再压入结果
+		code.OpJump, code.OpJumpIfPassed, code.OpReturn, code.OpSetupTry, code.OpPopTry, code.OpCheckDecl:
+		return 0
+	}
+	// 新增的操作码必须在这里登记,否则break和continue弹出的值的个数会出错
+	panic(fmt.Sprintf("stack effect of opcode %d is unknown", op))
+}
+
+// compileLogicalExpression 用条件跳转实现&&和||的短路求值,结果为按isTruthy判断得到的布尔值
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	endJumps := []int{}
+	falseJumps := []int{}
+
+	var depth int
+	if node.Operator == "&&" {
+		falseJumps = append(falseJumps, c.emit(code.OpJumpNotTruthy, 9999)) // 左边为假时直接得到false
+		depth = c.stackDepth()
+	} else {
+		checkRightPos := c.emit(code.OpJumpNotTruthy, 9999) // 左边为假时才需要计算右边
+		depth = c.stackDepth()
+		c.emit(code.OpTrue)
+		endJumps = append(endJumps, c.emit(code.OpJump, 9999))
+		c.changeOperand(checkRightPos, len(c.currentInstructions()))
+		c.setStackDepth(depth)
+	}
+
+	err = c.Compile(node.Right)
+	if err != nil {
+		return err
+	}
+
+	falseJumps = append(falseJumps, c.emit(code.OpJumpNotTruthy, 9999))
+	c.emit(code.OpTrue)
+	endJumps = append(endJumps, c.emit(code.OpJump, 9999))
+
+	c.setStackDepth(depth)
+	falsePos := c.emit(code.OpFalse)
+	for _, pos := range falseJumps {
+		c.changeOperand(pos, falsePos)
+	}
+
+	afterPos := len(c.currentInstructions())
+	for _, pos := range endJumps {
+		c.changeOperand(pos, afterPos)
+	}
+
+	return nil
+}
+
+// compileTryExpression 编译try表达式,生成的代码如下:
+//
+//	OpSetupTry catch
+//	try块                 // 结果留在栈顶
+//	OpPopTry
+//	OpJump after
+//	catch:                // 虚拟机跳转到这里时栈顶为异常值
+//	绑定catch参数
+//	OpSetupTry rethrow    // 只有存在finally时才需要
+//	catch块
+//	OpPopTry
+//	OpJump after
+//	rethrow:              // catch块抛出异常,执行finally后重新抛出
+//	finally块
+//	OpThrow
+//	after:
+//	finally块
+//
+// 没有catch时,catch处直接执行finally块后重新抛出异常
+func (c *Compiler) compileTryExpression(node *ast.TryExpression) error {
+	scope := &c.scopes[c.scopeIndex]
+	try := &TryContext{finally: node.Finally, handler: true, loopDepth: len(scope.loops)}
+	scope.tries = append(scope.tries, try)
+	leaveTry := func() {
+		tries := c.scopes[c.scopeIndex].tries
+		c.scopes[c.scopeIndex].tries = tries[:len(tries)-1]
+	}
+
+	depth := c.stackDepth() // 虚拟机跳转到catch时把栈恢复到登记处理器时的深度,再压入异常值
+	setupPos := c.emit(code.OpSetupTry, 9999)
+	err := c.Compile(node.Body)
+	if err != nil {
+		return err
+	}
+	c.keepBlockValue()
+	c.emit(code.OpPopTry)
+	try.handler = false
+
+	afterJumps := []int{c.emit(code.OpJump, 9999)}
+	c.changeOperand(setupPos, len(c.currentInstructions()))
+	c.setStackDepth(depth + 1)
+
+	if node.Catch != nil {
+		if node.CatchParam != nil {
+			symbol := c.SymbolTable.Define(node.CatchParam.Value)
+			if symbol.Scope == GlobalScope {
+				c.emit(code.OpSetGlobal, symbol.Index)
+			} else {
+				c.emit(code.OpSetLocal, symbol.Index)
+			}
+		} else {
+			c.emit(code.OpPop)
+		}
+
+		rethrowPos := -1
+		if node.Finally != nil { // catch块中的异常也要先执行finally
+			rethrowPos = c.emit(code.OpSetupTry, 9999)
+			try.handler = true
+		}
+
+		err = c.Compile(node.Catch)
+		if err != nil {
+			return err
+		}
+		c.keepBlockValue()
+
+		if node.Finally != nil {
+			c.emit(code.OpPopTry)
+			try.handler = false
+		}
+		afterJumps = append(afterJumps, c.emit(code.OpJump, 9999))
+
+		if rethrowPos != -1 {
+			c.changeOperand(rethrowPos, len(c.currentInstructions()))
+			c.setStackDepth(depth + 1)
+		}
+	}
+
+	leaveTry() // finally块不在try的保护范围内
+	if node.Finally != nil {
+		err = c.Compile(node.Finally)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+	}
+
+	afterPos := len(c.currentInstructions())
+	for _, pos := range afterJumps {
+		c.changeOperand(pos, afterPos)
+	}
+	c.setStackDepth(depth + 1)
+
+	if node.Finally != nil {
+		err = c.Compile(node.Finally)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unwindTries 在return、break或continue离开try之前,撤销depth之后的异常处理器并执行对应的finally块
+func (c *Compiler) unwindTries(depth int) error {
+	scope := &c.scopes[c.scopeIndex]
+	tries, loops := scope.tries, scope.loops
+	defer func() {
+		c.scopes[c.scopeIndex].tries = tries
+		c.scopes[c.scopeIndex].loops = loops
+	}()
+
+	for i := len(tries) - 1; i >= depth; i-- {
+		if tries[i].handler {
+			c.emit(code.OpPopTry)
+		}
+		if tries[i].finally == nil {
+			continue
+		}
+
+		// finally块中的return、break只能看到try外层的try和循环
+		c.scopes[c.scopeIndex].tries = tries[:i]
+		c.scopes[c.scopeIndex].loops = loops[:tries[i].loopDepth]
+		err := c.Compile(tries[i].finally)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
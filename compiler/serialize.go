@@ -0,0 +1,407 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+
+	"my.com/myfile/code"
+	"my.com/myfile/object"
+)
+
+// 字节码文件格式(整数均为变长编码):
+//
+//	magic    "WZBC"
+//	format   uint16,大端序,等于formatVersion
+//	version  uint16,大端序,等于code.Version
+//	main     指令 + 行号表
+//	consts   常量个数 + 每个常量(一字节类型标记 + 内容)
+//
+// 行号表中的文件名只写一次,之后的记录用序号引用
+const magic = "WZBC"
+
+// formatVersion 文件格式的版本,常量的编码方式改变时加一;指令集的变化由code.Version区分
+const formatVersion = 5
+
+const headerSize = len(magic) + 4
+
+// 常量的类型标记
+const (
+	tagInteger  byte = 1
+	tagFloat    byte = 2
+	tagString   byte = 3
+	tagFunction byte = 4
+	tagBigInt   byte = 5
+)
+
+// ErrNotBytecode 数据不是以magic开头
+var ErrNotBytecode = errors.New("not a Wizard bytecode file")
+
+// Marshal 将字节码序列化为二进制格式
+func Marshal(bytecode *Bytecode) ([]byte, error) {
+	e := &encoder{files: map[string]int{}}
+	e.buf.WriteString(magic)
+	binary.Write(&e.buf, binary.BigEndian, uint16(formatVersion))
+	binary.Write(&e.buf, binary.BigEndian, uint16(code.Version))
+
+	e.writeBytes(bytecode.Instructions)
+	e.writeLines(bytecode.Lines)
+
+	e.writeUint(uint64(len(bytecode.Constants)))
+	for _, constant := range bytecode.Constants {
+		if err := e.writeConstant(constant); err != nil {
+			return nil, err
+		}
+	}
+
+	return e.buf.Bytes(), nil
+}
+
+// Unmarshal 从Marshal生成的数据还原字节码
+func Unmarshal(data []byte) (*Bytecode, error) {
+	if len(data) < headerSize || string(data[:len(magic)]) != magic {
+		return nil, ErrNotBytecode
+	}
+	format := binary.BigEndian.Uint16(data[len(magic):])
+	if format != formatVersion {
+		return nil, fmt.Errorf("unsupported bytecode format %d, want %d", format, formatVersion)
+	}
+	version := binary.BigEndian.Uint16(data[len(magic)+2:])
+	if version != code.Version {
+		return nil, fmt.Errorf("unsupported bytecode version %d, want %d", version, code.Version)
+	}
+
+	d := &decoder{r: bytes.NewReader(data[headerSize:])}
+	bytecode := &Bytecode{
+		Instructions: d.readBytes(),
+		Lines:        d.readLines(),
+	}
+
+	n := d.readCount()
+	bytecode.Constants = make([]object.Object, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		bytecode.Constants = append(bytecode.Constants, d.readConstant())
+	}
+
+	if d.err == nil {
+		d.checkProgram(bytecode)
+	}
+	if d.err == nil && d.r.Len() != 0 {
+		d.err = fmt.Errorf("%d bytes of trailing data", d.r.Len())
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid bytecode: %w", d.err)
+	}
+	return bytecode, nil
+}
+
+type encoder struct {
+	buf   bytes.Buffer
+	files map[string]int // 已写入的文件名及其序号
+}
+
+func (e *encoder) writeUint(v uint64) {
+	e.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (e *encoder) writeInt(v int64) {
+	e.buf.Write(binary.AppendVarint(nil, v))
+}
+
+func (e *encoder) writeBool(b bool) {
+	if b {
+		e.writeUint(1)
+	} else {
+		e.writeUint(0)
+	}
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.writeUint(uint64(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) writeLines(lines code.LineTable) {
+	e.writeUint(uint64(len(lines)))
+	for _, entry := range lines {
+		e.writeUint(uint64(entry.Offset))
+		if idx, ok := e.files[entry.Pos.File]; ok { // 文件名已经写过,写入序号+1
+			e.writeUint(uint64(idx + 1))
+		} else { // 新文件名,写入0后跟文件名
+			e.files[entry.Pos.File] = len(e.files)
+			e.writeUint(0)
+			e.writeBytes([]byte(entry.Pos.File))
+		}
+		e.writeUint(uint64(entry.Pos.Line))
+		e.writeUint(uint64(entry.Pos.Column))
+	}
+}
+
+func (e *encoder) writeConstant(obj object.Object) error {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		e.buf.WriteByte(tagInteger)
+		e.writeInt(obj.Value)
+	case *object.Float:
+		e.buf.WriteByte(tagFloat)
+		binary.Write(&e.buf, binary.BigEndian, math.Float64bits(obj.Value))
+	case *object.BigInteger:
+		e.buf.WriteByte(tagBigInt)
+		e.writeBytes(obj.Value.Append(nil, 10)) // 十进制文本
+	case *object.String:
+		e.buf.WriteByte(tagString)
+		e.writeBytes([]byte(obj.Value))
+	case *object.CompiledFunction:
+		e.buf.WriteByte(tagFunction)
+		e.writeBytes(obj.Instructions)
+		e.writeUint(uint64(obj.NumLocals))
+		e.writeUint(uint64(obj.NumParameters))
+		e.writeUint(uint64(obj.NumDefaults))
+		e.writeBool(obj.Variadic)
+		e.writeLines(obj.Lines)
+		e.writeBytes([]byte(obj.Name))
+	default:
+		return fmt.Errorf("cannot serialize constant of type %s", obj.Type())
+	}
+	return nil
+}
+
+type decoder struct {
+	r     *bytes.Reader
+	files []string // 按序号保存已读到的文件名
+	err   error    // 第一个错误,出错后的读取都返回零值
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errors.New("unexpected end of data")
+		}
+		d.err = err
+	}
+}
+
+func (d *decoder) readUint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		d.fail(err)
+	}
+	return v
+}
+
+func (d *decoder) readInt() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(d.r)
+	if err != nil {
+		d.fail(err)
+	}
+	return v
+}
+
+func (d *decoder) readCount() int { // 读取长度,不能超过剩余的数据量
+	n := d.readUint()
+	if n > uint64(d.r.Len()) {
+		d.fail(fmt.Errorf("length %d exceeds remaining data", n))
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) readBytes() []byte {
+	n := d.readCount()
+	if d.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.fail(err)
+		return nil
+	}
+	return b
+}
+
+func (d *decoder) readLines() code.LineTable {
+	n := d.readCount()
+	if n == 0 {
+		return nil
+	}
+
+	lines := make(code.LineTable, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		entry := code.LineEntry{Offset: int(d.readUint())}
+
+		idx := d.readUint()
+		switch {
+		case idx == 0:
+			d.files = append(d.files, string(d.readBytes()))
+			entry.Pos.File = d.files[len(d.files)-1]
+		case idx <= uint64(len(d.files)):
+			entry.Pos.File = d.files[idx-1]
+		default:
+			d.fail(fmt.Errorf("unknown file index %d", idx))
+		}
+
+		entry.Pos.Line = int(d.readUint())
+		entry.Pos.Column = int(d.readUint())
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func (d *decoder) readConstant() object.Object {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		d.fail(err)
+		return nil
+	}
+
+	switch tag {
+	case tagInteger:
+		return &object.Integer{Value: d.readInt()}
+	case tagFloat:
+		var bits uint64
+		if err := binary.Read(d.r, binary.BigEndian, &bits); err != nil {
+			d.fail(err)
+		}
+		return &object.Float{Value: math.Float64frombits(bits)}
+	case tagString:
+		return &object.String{Value: string(d.readBytes())}
+	case tagBigInt:
+		text := d.readBytes()
+		value, ok := new(big.Int).SetString(string(text), 10)
+		if !ok && d.err == nil {
+			d.fail(fmt.Errorf("invalid big integer %q", text))
+		}
+		return &object.BigInteger{Value: value}
+	case tagFunction:
+		fn := &object.CompiledFunction{
+			Instructions:  d.readBytes(),
+			NumLocals:     int(d.readUint()),
+			NumParameters: int(d.readUint()),
+			NumDefaults:   int(d.readUint()),
+			Variadic:      d.readUint() != 0,
+			Lines:         d.readLines(),
+			Name:          string(d.readBytes()),
+		}
+		locals := fn.NumParameters
+		if fn.Variadic {
+			locals++
+		}
+		if d.err == nil && (fn.NumDefaults > fn.NumParameters || locals > fn.NumLocals) { // 虚拟机调用时按参数个数写入局部变量
+			d.fail(fmt.Errorf("invalid parameters for function %q", fn.Name))
+		}
+		return fn
+	}
+
+	d.fail(fmt.Errorf("unknown constant tag %d", tag))
+	return nil
+}
+
+// checkProgram 检查主程序和各个函数的指令,保证虚拟机执行时不会因为错误的操作数越界
+func (d *decoder) checkProgram(bytecode *Bytecode) {
+	c := &checker{d: d, constants: bytecode.Constants, numFree: map[*object.CompiledFunction]int{}}
+
+	if c.checkInstructions(bytecode.Instructions, 0) > 0 { // 主程序没有捕获任何变量
+		d.fail(errors.New("main program reads free variables"))
+	}
+	for _, constant := range bytecode.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok && d.err == nil {
+			c.numFree[fn] = c.checkInstructions(fn.Instructions, fn.NumLocals)
+		}
+	}
+
+	for _, cl := range c.closures { // 创建闭包时传入的自由变量要够函数使用
+		if d.err == nil && cl.numFree < c.numFree[cl.fn] {
+			d.fail(fmt.Errorf("closure of %q captures %d variables, needs %d", cl.fn.Name, cl.numFree, c.numFree[cl.fn]))
+		}
+	}
+}
+
+type checker struct {
+	d         *decoder
+	constants []object.Object
+	numFree   map[*object.CompiledFunction]int // 函数用到的自由变量个数
+	closures  []closureSite                    // 所有OpClosure指令
+}
+
+type closureSite struct {
+	fn      *object.CompiledFunction
+	numFree int
+}
+
+// checkInstructions 检查每条指令的操作码都已定义、操作数完整,常量、内置函数和局部变量的下标不越界,
+// 跳转目标是某条指令的开头;返回指令用到的自由变量个数
+func (c *checker) checkInstructions(ins code.Instructions, numLocals int) int {
+	d := c.d
+	starts := map[int]bool{len(ins): true} // 指令的开头,跳到末尾等于执行结束
+	var jumps []int
+	numFree := 0
+
+	for i := 0; i < len(ins) && d.err == nil; {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			d.fail(fmt.Errorf("offset %d: %w", i, err))
+			return 0
+		}
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if i+1+width > len(ins) {
+			d.fail(fmt.Errorf("offset %d: truncated operands for %s", i, def.Name))
+			return 0
+		}
+		starts[i] = true
+		operands, _ := code.ReadOperands(def, ins[i+1:])
+
+		switch code.Opcode(ins[i]) {
+		case code.OpConstant, code.OpCheckDecl:
+			c.checkIndex(i, def, "constant", operands[0], len(c.constants))
+		case code.OpClosure:
+			if c.checkIndex(i, def, "constant", operands[0], len(c.constants)) {
+				fn, ok := c.constants[operands[0]].(*object.CompiledFunction)
+				if !ok {
+					d.fail(fmt.Errorf("offset %d: %s operand is not a function", i, def.Name))
+				} else {
+					c.closures = append(c.closures, closureSite{fn: fn, numFree: operands[1]})
+				}
+			}
+		case code.OpGetBuiltin:
+			c.checkIndex(i, def, "builtin", operands[0], len(object.Builtins))
+		case code.OpGetLocal, code.OpSetLocal, code.OpCaptureLocal:
+			c.checkIndex(i, def, "local", operands[0], numLocals)
+		case code.OpGetFree, code.OpSetFree, code.OpCaptureFree:
+			numFree = max(numFree, operands[0]+1)
+		case code.OpJump, code.OpJumpNotTruthy, code.OpSetupTry:
+			jumps = append(jumps, i, operands[0])
+		case code.OpJumpIfPassed:
+			jumps = append(jumps, i, operands[1])
+		}
+		i += 1 + width
+	}
+
+	for j := 0; j < len(jumps) && d.err == nil; j += 2 {
+		if !starts[jumps[j+1]] {
+			d.fail(fmt.Errorf("offset %d: jump target %d is not an instruction", jumps[j], jumps[j+1]))
+		}
+	}
+	return numFree
+}
+
+func (c *checker) checkIndex(offset int, def *code.Definition, kind string, index, limit int) bool {
+	if index >= limit {
+		c.d.fail(fmt.Errorf("offset %d: %s %s index %d out of range", offset, def.Name, kind, index))
+		return false
+	}
+	return true
+}
@@ -10,12 +10,14 @@ const (
 	GlobalScope  SymbolScope = "GLOBAL"
 	LocalScope   SymbolScope = "LOCAL"
 	BuiltinScope SymbolScope = "BUILTIN"
+	FreeScope    SymbolScope = "FREE" // 闭包捕获的自由变量
 )
 
 type Symbol struct {
-	Name  string // 符号的名称。
-	Scope SymbolScope
-	Index int // 表示符号在特定作用域中的索引
+	Name     string // 符号的名称。
+	Scope    SymbolScope
+	Index    int  // 表示符号在特定作用域中的索引
+	Function bool // 由fn声明定义,声明语句执行之前值为null
 }
 
 type SymbolTable struct { // 表示符号表
@@ -23,6 +25,8 @@ type SymbolTable struct { // 表示符号表
 
 	store          map[string]Symbol // 将符号的名称（字符串）映射到 Symbol 结构体。
 	numDefinitions int               // 是一个计数器，跟踪定义的符号数量。
+
+	FreeSymbols []Symbol // 当前函数捕获的外层局部变量,按捕获顺序排列
 }
 
 func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
@@ -33,10 +37,23 @@ func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 
 func NewSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
-	return &SymbolTable{store: s}
+	free := []Symbol{}
+	return &SymbolTable{store: s, FreeSymbols: free}
 }
 
 func (s *SymbolTable) Define(name string) Symbol { // 将标识符作为参数,创建定义并返回Symbol
+	if existing, ok := s.store[name]; ok { // 同一作用域内重复let时复用原来的槽位,与解释器中env.Set覆盖的行为一致
+		if existing.Scope == GlobalScope || existing.Scope == LocalScope {
+			return existing
+		}
+	}
+
+	return s.DefineParameter(name)
+}
+
+// DefineParameter 定义函数参数,总是分配新的槽位,参数的个数与槽位一一对应;
+// 重名的参数与解释器一样以后面的为准
+func (s *SymbolTable) DefineParameter(name string) Symbol {
 	symbol := Symbol{Name: name, Index: s.numDefinitions}
 	if s.Outer == nil { // Outer为空则设置为全局变量
 		symbol.Scope = GlobalScope
@@ -49,17 +66,54 @@ func (s *SymbolTable) Define(name string) Symbol { // 将标识符作为参数,
 	return symbol
 }
 
+// DefineHidden 定义一个源码无法引用的变量,不记录名字,每次都分配新的槽位,嵌套使用时不会互相覆盖
+func (s *SymbolTable) DefineHidden(name string) Symbol {
+	symbol := Symbol{Name: name, Index: s.numDefinitions, Scope: LocalScope}
+	if s.Outer == nil {
+		symbol.Scope = GlobalScope
+	}
+	s.numDefinitions++
+	return symbol
+}
+
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) { // 将一个先前定义的标识符交给符号表,并返回关联的symbol
 	obj, ok := s.store[name]
 	if !ok && s.Outer != nil {
 		obj, ok = s.Outer.Resolve(name)
-		return obj, ok
+		if !ok {
+			return obj, ok
+		}
+
+		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope { // 全局变量和内置函数不需要捕获
+			return obj, ok
+		}
+
+		free := s.defineFree(obj) // 外层函数的局部变量,作为自由变量捕获
+		return free, true
 	}
 	return obj, ok
 }
 
+// DefineFunction 定义fn声明的函数名,与Define一样在同一作用域内复用原来的槽位
+func (s *SymbolTable) DefineFunction(name string) Symbol {
+	symbol := s.Define(name)
+	symbol.Function = true
+	s.store[name] = symbol
+	return symbol
+}
+
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol { // 定义内置函数的作用域
 	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
 	s.store[name] = symbol
 	return symbol
 }
+
+func (s *SymbolTable) defineFree(original Symbol) Symbol { // 记录被捕获的原始符号,并在当前作用域中以FreeScope重新定义
+	s.FreeSymbols = append(s.FreeSymbols, original)
+
+	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1, Function: original.Function}
+	symbol.Scope = FreeScope
+
+	s.store[original.Name] = symbol
+	return symbol
+}
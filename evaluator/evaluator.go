@@ -2,18 +2,31 @@ package evaluator
 
 import (
 	"fmt"
+	"math"
+	"strings"
 
 	"my.com/myfile/ast"
 	"my.com/myfile/object"
+	"my.com/myfile/token"
 )
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL  = object.NULL
+	TRUE  = object.TRUE
+	FALSE = object.FALSE
 )
 
 func Eval(node ast.Node, env *object.Environment) object.Object { //repl调用的函数
+	result := eval(node, env)
+
+	if err, ok := result.(*object.Error); ok && !err.Pos.IsValid() { //错误由最内层产生它的节点标记位置
+		err.Pos = node.Pos()
+	}
+
+	return result
+}
+
+func eval(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) { //观察这个switch语句，尽管对于不同的ast结构体有不同的处理函数，但是实际上都会返回一个接口
 
 	// Statements
@@ -28,56 +41,73 @@ func Eval(node ast.Node, env *object.Environment) object.Object { //repl调用
 
 	case *ast.ReturnStatement:
 		val := Eval(node.ReturnValue, env)
-		if isError(val) {
+		if isAbrupt(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
 
 	case *ast.BreakStatement:
-		return &object.BreakValue{Value: NULL}
+		return &object.BreakValue{Value: NULL, Pos: node.Pos()}
 
 	case *ast.ContinueStatement:
-		return &object.ContinueValue{Value: NULL}
+		return &object.ContinueValue{Value: NULL, Pos: node.Pos()}
+
+	case *ast.ThrowStatement:
+		val := Eval(node.Value, env)
+		if isAbrupt(val) {
+			return val
+		}
+		return &object.Error{Message: "uncaught exception: " + object.ThrownMessage(val), Value: val}
 
 	case *ast.LetStatement:
 		val := Eval(node.Value, env)
-		if isError(val) {
+		if isAbrupt(val) {
 			return val
 		}
-		if val.Type() == object.HASH_OBJ {
-			hashObj := val.(*object.Hash)
-			hashObj.Name = node.Name.Value
-			env.Set(hashObj.Name, hashObj)
-		} else {
-			env.Set(node.Name.Value, val)
+		if node.Pattern != nil {
+			return bindPattern(node.Pattern, val, env)
 		}
+		env.Set(node.Name.Value, val)
+
+	case *ast.AssignExpression:
+		return evalAssignExpression(node, env)
 
 	// 表达式
 	case *ast.IntegerLiteral:
+		if node.Big != nil {
+			return &object.BigInteger{Value: node.Big}
+		}
 		return &object.Integer{Value: node.Value}
 
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
+
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 
 	case *ast.PrefixExpression:
 		right := Eval(node.Right, env)
-		if isError(right) {
+		if isAbrupt(right) {
 			return right
 		}
-		return evalPrefixExpression(node.Operator, right)
+		return evalPrefixExpression(node.Operator, right, env.CheckedArithmetic)
 
 	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, env)
+		}
+
 		left := Eval(node.Left, env)
-		if isError(left) {
+		if isAbrupt(left) {
 			return left
 		}
 
 		right := Eval(node.Right, env)
-		if isError(right) {
+		if isAbrupt(right) {
 			return right
 		}
 
-		return evalInfixExpression(node.Operator, left, right)
+		return evalInfixExpression(node.Operator, left, right, env.CheckedArithmetic)
 
 	// 控制语句
 	case *ast.IfExpression:
@@ -86,45 +116,52 @@ func Eval(node ast.Node, env *object.Environment) object.Object { //repl调用
 		return evalForExpression(node, env)
 	case *ast.WhileExpression:
 		return evalWhileExpression(node, env)
+	case *ast.TryExpression:
+		return evalTryExpression(node, env)
+	case *ast.MatchExpression:
+		return evalMatchExpression(node, env)
 	case *ast.Identifier:
-		result := evalIdentifier(node, env)
-		if result.Type() == object.HASH_OBJ {
-			hashObj, ok := result.(*object.Hash)
-			if !ok {
-				return newError("identifier not found: " + node.Value)
-			}
-			env.Set(hashObj.Name, hashObj)
-			return hashObj
-		} else {
-			return result
-		}
+		return evalIdentifier(node, env)
+	case *ast.FunctionStatement: // 函数名已经在块的开头定义,这里创建函数
+		env.Set(node.Name.Value, Eval(node.Function, env))
+
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Env: env, Body: body}
+		return &object.Function{Parameters: params, Defaults: node.Defaults, Patterns: node.Patterns, Rest: node.Rest, Env: env, Body: body, Name: node.Name}
 
 		// 表达式处理
 	case *ast.CallExpression:
 		function := Eval(node.Function, env)
-		if isError(function) {
+		if isAbrupt(function) {
 			return function
 		}
+		if ident, ok := node.Function.(*ast.Identifier); ok && function == NULL && env.IsDeclaredFunction(ident.Value) {
+			return newError("function %s called before its declaration", ident.Value)
+		}
 
 		args := evalExpressions(node.Arguments, env) //
-		if len(args) == 1 && isError(args[0]) {
+		if len(args) == 1 && isAbrupt(args[0]) {
 			return args[0]
 		}
 
-		return applyFunction(function, args)
+		result := applyFunction(function, args)
+		if errObj, ok := result.(*object.Error); ok {
+			recordCallPos(errObj, node.Pos())
+		}
+		return result
 
 		// 字符串求值
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 
+	case *ast.TemplateLiteral:
+		return evalTemplateLiteral(node, env)
+
 		// 数组表达式求值
 	case *ast.ArrayLiteral:
 		elements := evalExpressions(node.Elements, env)
-		if len(elements) == 1 && isError(elements[0]) {
+		if len(elements) == 1 && isAbrupt(elements[0]) {
 			return elements[0]
 		}
 		return &object.Array{Elements: elements}
@@ -132,11 +169,11 @@ func Eval(node ast.Node, env *object.Environment) object.Object { //repl调用
 	// 处理下标读取
 	case *ast.IndexExpression:
 		left := Eval(node.Left, env)
-		if isError(left) {
+		if isAbrupt(left) {
 			return left
 		}
 		index := Eval(node.Index, env)
-		if isError(index) {
+		if isAbrupt(index) {
 			return index
 		}
 		return evalIndexExpression(left, index)
@@ -151,6 +188,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object { //repl调用
 func evalProgram(program *ast.Program, env *object.Environment) object.Object {
 	var result object.Object
 
+	declareFunctions(program.Statements, env)
 	for _, statement := range program.Statements { //通过循环遍历所有语句，对每个语句调用Eval函数
 		result = Eval(statement, env)
 
@@ -159,6 +197,8 @@ func evalProgram(program *ast.Program, env *object.Environment) object.Object {
 			return result.Value //如果遇到了Return类型，则提早返回这个值
 		case *object.Error:
 			return result //异常处理
+		case *object.BreakValue, *object.ContinueValue:
+			return loopControlError(result)
 		}
 	}
 
@@ -171,20 +211,35 @@ func evalBlockStatement(
 ) object.Object { //处理块
 	var result object.Object
 
+	declareFunctions(block.Statements, env)
 	for _, statement := range block.Statements {
 		result = Eval(statement, env) //对每个语句求值
 
 		if result != nil {
 			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ ||
+				rt == object.BREAK_VALUE_OBJ || rt == object.CONTINUE_VALUE_OBJ { // break和continue需要一直传递到最近的循环
 				return result
 			}
 		}
 	}
 
+	if result == nil { // 空块或最后一个语句是let、fn等声明时,块的值为null,与虚拟机一致
+		return NULL
+	}
 	return result //返回
 }
 
+// declareFunctions 在块的开头定义块中用fn声明的函数名,值为null,函数在声明语句处创建,与编译器一致
+// 只有名字被提升,声明语句执行之前调用函数会报错
+func declareFunctions(statements []ast.Statement, env *object.Environment) {
+	for _, s := range statements {
+		if decl, ok := s.(*ast.FunctionStatement); ok {
+			env.DeclareFunction(decl.Name.Value, NULL)
+		}
+	}
+}
+
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
 		return TRUE
@@ -192,12 +247,17 @@ func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	return FALSE
 }
 
-func evalPrefixExpression(operator string, right object.Object) object.Object { //处理前缀表达式
+func evalPrefixExpression(operator string, right object.Object, checked bool) object.Object { //处理前缀表达式
 	switch operator {
 	case "!":
 		return evalBangOperatorExpression(right)
 	case "-":
-		return evalMinusPrefixOperatorExpression(right)
+		return evalMinusPrefixOperatorExpression(right, checked)
+	case "~":
+		if !object.IsInteger(right) { // 按位取反只能用于整数
+			return newError("unknown operator: ~%s", right.Type())
+		}
+		return object.ComplementInteger(right)
 	default:
 		return newError("unknown operator: %s%s", operator, right.Type())
 	}
@@ -206,20 +266,19 @@ func evalPrefixExpression(operator string, right object.Object) object.Object {
 func evalInfixExpression(
 	operator string,
 	left, right object.Object,
+	checked bool, // 为true时整数运算溢出报错
 ) object.Object {
 	switch {
-	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
-		return evalIntegerInfixExpression(operator, left, right)
+	case object.IsInteger(left) && object.IsInteger(right):
+		return evalIntegerInfixExpression(operator, left, right, checked)
+	case isNumber(left) && isNumber(right): // 整数与浮点数混合运算时统一按浮点数处理
+		return evalFloatInfixExpression(operator, left, right)
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
 		return evalStringInfixExpression(operator, left, right)
-	case operator == "&&":
-		return nativeBoolToBooleanObject(left.ToBoolean() && right.ToBoolean())
-	case operator == "||":
-		return nativeBoolToBooleanObject(left.ToBoolean() || right.ToBoolean())
-	case operator == "==":
-		return nativeBoolToBooleanObject(left == right)
+	case operator == "==": // 数组和哈希表按内容比较
+		return nativeBoolToBooleanObject(object.Equals(left, right))
 	case operator == "!=":
-		return nativeBoolToBooleanObject(left != right)
+		return nativeBoolToBooleanObject(!object.Equals(left, right))
 	case left.Type() != right.Type():
 		return newError("type mismatch: %s %s %s",
 			left.Type(), operator, right.Type())
@@ -228,6 +287,29 @@ func evalInfixExpression(
 			left.Type(), operator, right.Type())
 	}
 }
+
+// evalLogicalExpression 短路求值,左边已经能决定结果时不再计算右边,真值判断与isTruthy一致
+func evalLogicalExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	left := Eval(node.Left, env)
+	if isAbrupt(left) {
+		return left
+	}
+
+	if node.Operator == "&&" && !isTruthy(left) {
+		return FALSE
+	}
+	if node.Operator == "||" && isTruthy(left) {
+		return TRUE
+	}
+
+	right := Eval(node.Right, env)
+	if isAbrupt(right) {
+		return right
+	}
+
+	return nativeBoolToBooleanObject(isTruthy(right))
+}
+
 func evalBangOperatorExpression(right object.Object) object.Object {
 	switch right {
 	case TRUE:
@@ -241,13 +323,31 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 	}
 }
 
-func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
+func evalMinusPrefixOperatorExpression(right object.Object, checked bool) object.Object {
+	switch right := right.(type) {
+	case *object.Integer, *object.BigInteger:
+		value, err := object.NegateInteger(right, checked)
+		if err != nil {
+			return newError("%s", err)
+		}
+		return value
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
+}
 
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
+func evalTemplateLiteral(node *ast.TemplateLiteral, env *object.Environment) object.Object { //字符串插值,各部分按str()的规则转换后拼接
+	var out strings.Builder
+	for _, part := range node.Parts {
+		value := Eval(part, env)
+		if isAbrupt(value) {
+			return value
+		}
+		out.WriteString(value.Inspect())
+	}
+	return &object.String{Value: out.String()}
 }
 
 func evalStringInfixExpression( //字符串比较
@@ -257,10 +357,6 @@ func evalStringInfixExpression( //字符串比较
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
 	switch operator {
-	case "&&":
-		return nativeBoolToBooleanObject(left.ToBoolean() && right.ToBoolean())
-	case "||":
-		return nativeBoolToBooleanObject(left.ToBoolean() || right.ToBoolean())
 	case "+":
 		return &object.String{Value: leftVal + rightVal}
 	case "<":
@@ -281,42 +377,101 @@ func evalStringInfixExpression( //字符串比较
 	}
 }
 
-func evalIntegerInfixExpression(
+func evalIntegerInfixExpression( // 整数运算,Integer和BigInteger都在这里处理
+	operator string,
+	left, right object.Object,
+	checked bool,
+) object.Object {
+	switch operator {
+	case "+", "-", "*", "/", "%", "**", "&", "|", "^", "<<", ">>":
+		result, err := object.IntegerArithmetic(operator, left, right, checked)
+		if err != nil {
+			return newError("%s", err)
+		}
+		return result
+	case "<":
+		return nativeBoolToBooleanObject(object.CompareIntegers(left, right) < 0)
+	case ">":
+		return nativeBoolToBooleanObject(object.CompareIntegers(left, right) > 0)
+	case "<=":
+		return nativeBoolToBooleanObject(object.CompareIntegers(left, right) <= 0)
+	case ">=":
+		return nativeBoolToBooleanObject(object.CompareIntegers(left, right) >= 0)
+	case "==":
+		return nativeBoolToBooleanObject(object.CompareIntegers(left, right) == 0)
+	case "!=":
+		return nativeBoolToBooleanObject(object.CompareIntegers(left, right) != 0)
+	default:
+		return newError("unknown operator: %s %s %s",
+			left.Type(), operator, right.Type())
+	}
+}
+
+func evalFloatInfixExpression(
 	operator string,
 	left, right object.Object,
 ) object.Object {
-	leftVal := left.(*object.Integer).Value
-	rightVal := right.(*object.Integer).Value
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
 
 	switch operator {
-	case "&&":
-		return nativeBoolToBooleanObject(left.ToBoolean() && right.ToBoolean())
-	case "||":
-		return nativeBoolToBooleanObject(left.ToBoolean() || right.ToBoolean())
 	case "+":
-		return &object.Integer{Value: leftVal + rightVal}
+		return &object.Float{Value: leftVal + rightVal}
 	case "-":
-		return &object.Integer{Value: leftVal - rightVal}
+		return &object.Float{Value: leftVal - rightVal}
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		return &object.Float{Value: leftVal * rightVal}
 	case "/":
-		return &object.Integer{Value: leftVal / rightVal}
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
+	case "**":
+		return &object.Float{Value: math.Pow(leftVal, rightVal)}
+	case "<", ">", "<=", ">=", "==", "!=":
+		return evalNumberComparison(operator, left, right)
+	default:
+		return newError("unknown operator: %s %s %s",
+			left.Type(), operator, right.Type())
+	}
+}
+
+// evalNumberComparison 整数与浮点数混合比较时按精确的数值比较,NaN与任何数都不相等,也没有大小
+func evalNumberComparison(operator string, left, right object.Object) object.Object {
+	result, ok := object.CompareNumbers(left, right)
+	if !ok {
+		return nativeBoolToBooleanObject(operator == "!=")
+	}
+
+	switch operator {
 	case "<":
-		return nativeBoolToBooleanObject(leftVal < rightVal)
+		return nativeBoolToBooleanObject(result < 0)
 	case ">":
-		return nativeBoolToBooleanObject(leftVal > rightVal)
+		return nativeBoolToBooleanObject(result > 0)
 	case "<=":
-		return nativeBoolToBooleanObject(leftVal <= rightVal)
+		return nativeBoolToBooleanObject(result <= 0)
 	case ">=":
-		return nativeBoolToBooleanObject(leftVal >= rightVal)
+		return nativeBoolToBooleanObject(result >= 0)
 	case "==":
-		return nativeBoolToBooleanObject(leftVal == rightVal)
-	case "!=":
-		return nativeBoolToBooleanObject(leftVal != rightVal)
+		return nativeBoolToBooleanObject(result == 0)
 	default:
-		return newError("unknown operator: %s %s %s",
-			left.Type(), operator, right.Type())
+		return nativeBoolToBooleanObject(result != 0)
+	}
+}
+
+func isNumber(obj object.Object) bool { // 判断是否为整数或浮点数
+	return object.IsInteger(obj) || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 { // 将整数或浮点数转换为go的float64
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.BigInteger:
+		return obj.Float64()
+	case *object.Float:
+		return obj.Value
 	}
+	return 0
 }
 
 func evalIfExpression(
@@ -324,7 +479,7 @@ func evalIfExpression(
 	env *object.Environment,
 ) object.Object {
 	condition := Eval(ie.Condition, env)
-	if isError(condition) {
+	if isAbrupt(condition) {
 		return condition
 	}
 
@@ -368,9 +523,12 @@ func newError(format string, a ...interface{}) *object.Error {
 	return &object.Error{Message: fmt.Sprintf(format, a...)}
 }
 
-func isError(obj object.Object) bool {
-	if obj != nil {
-		return obj.Type() == object.ERROR_OBJ
+// isAbrupt 判断求值是否被错误、return、break或continue中断,中断时子表达式的结果要原样向外传递,
+// 直到被函数调用、循环或程序处理,与虚拟机直接跳转的行为一致
+func isAbrupt(obj object.Object) bool {
+	switch obj.(type) {
+	case *object.Error, *object.ReturnValue, *object.BreakValue, *object.ContinueValue:
+		return true
 	}
 	return false
 }
@@ -382,11 +540,25 @@ func evalExpressions( //计算表达式，表达式可能有多个
 	var result []object.Object
 
 	for _, e := range exps {
+		spread, isSpread := e.(*ast.SpreadExpression)
+		if isSpread { // 展开数组,把元素依次加入结果
+			e = spread.Value
+		}
+
 		evaluated := Eval(e, env)
-		if isError(evaluated) {
+		if isAbrupt(evaluated) {
 			return []object.Object{evaluated}
 		}
-		result = append(result, evaluated)
+
+		if !isSpread {
+			result = append(result, evaluated)
+			continue
+		}
+		arr, ok := evaluated.(*object.Array)
+		if !ok {
+			return []object.Object{newError("spread operand must be ARRAY, got %s", evaluated.Type())}
+		}
+		result = append(result, arr.Elements...)
 	}
 
 	return result
@@ -396,12 +568,23 @@ func applyFunction(fn object.Object, args []object.Object) object.Object { //如
 	switch fn := fn.(type) {
 
 	case *object.Function:
-		extendedEnv := extendFunctionEnv(fn, args)
-		evaluated := Eval(fn.Body, extendedEnv)
+		required := fn.RequiredParameters()
+		if len(args) < required || (fn.Rest == nil && len(args) > len(fn.Parameters)) { // 与虚拟机一致,参数个数不对时报错
+			return newError("%s", object.ArgumentCountMessage(fn.Name, required, len(fn.Parameters), fn.Rest != nil, len(args)))
+		}
+		extendedEnv, evaluated := extendFunctionEnv(fn, args)
+		if extendedEnv != nil {
+			evaluated = Eval(fn.Body, extendedEnv)
+		}
+		// break和continue不能跳出函数,参数的默认值中也一样
+		evaluated = loopControlError(evaluated)
+		if errObj, ok := evaluated.(*object.Error); ok { // 记录错误经过的函数,调用位置由调用表达式补上
+			errObj.Calls = append(errObj.Calls, object.CallSite{Function: functionName(fn)})
+		}
 		return unwrapReturnValue(evaluated)
 
 	case *object.Builtin:
-		if result := fn.Fn(args...); result != nil {
+		if result := fn.Fn(callContext{}, args...); result != nil {
 			return result
 		}
 		return NULL
@@ -411,17 +594,188 @@ func applyFunction(fn object.Object, args []object.Object) object.Object { //如
 	}
 }
 
+// extendFunctionEnv 创建函数调用的环境,绑定参数;多余的参数收集为剩余参数的数组,
+// 没有传入的参数先绑定为null,再按顺序计算默认值并解构参数,默认值可以引用前面的参数;出错时返回错误
 func extendFunctionEnv(
 	fn *object.Function,
 	args []object.Object,
-) *object.Environment {
-	env := object.NewEnclosedEnvironment(fn.Env)
+) (*object.Environment, object.Object) {
+	env := object.NewFunctionEnvironment(fn)
+
+	for paramIdx, param := range fn.Parameters {
+		if paramIdx < len(args) {
+			env.Set(param.Value, args[paramIdx])
+		} else {
+			env.Set(param.Value, NULL)
+		}
+	}
+
+	if fn.Rest != nil {
+		rest := []object.Object{}
+		if len(args) > len(fn.Parameters) {
+			rest = append(rest, args[len(fn.Parameters):]...)
+		}
+		env.Set(fn.Rest.Value, &object.Array{Elements: rest})
+	}
 
 	for paramIdx, param := range fn.Parameters {
-		env.Set(param.Value, args[paramIdx])
+		value, _ := env.Get(param.Value)
+		if paramIdx >= len(args) && fn.Defaults != nil && fn.Defaults[paramIdx] != nil {
+			value = Eval(fn.Defaults[paramIdx], env)
+			if isAbrupt(value) {
+				return nil, value
+			}
+			env.Set(param.Value, value)
+		}
+
+		if fn.Patterns != nil && fn.Patterns[paramIdx] != nil {
+			if errObj := bindPattern(fn.Patterns[paramIdx], value, env); errObj != nil {
+				if err, ok := errObj.(*object.Error); ok && !err.Pos.IsValid() { // 报告参数模式的位置,而不是调用的位置
+					err.Pos = fn.Patterns[paramIdx].Pos()
+				}
+				return nil, errObj
+			}
+		}
 	}
 
-	return env
+	return env, nil
+}
+
+// bindPattern 按模式解构value并在env中绑定变量,与虚拟机一样按源码顺序绑定;出错时返回错误,否则返回nil
+func bindPattern(pattern ast.Expression, value object.Object, env *object.Environment) object.Object {
+	switch pattern := pattern.(type) {
+	case *ast.Identifier:
+		if pattern.Value != "_" { // 通配符不绑定变量
+			env.Set(pattern.Value, value)
+		}
+	case *ast.ArrayPattern:
+		values, err := object.UnpackArray(value, len(pattern.Elements), pattern.Rest != nil)
+		if err != nil {
+			return newError("%s", err)
+		}
+
+		for i, el := range pattern.Elements {
+			if errObj := bindPattern(el, values[i], env); errObj != nil {
+				return errObj
+			}
+		}
+		if pattern.Rest != nil {
+			return bindPattern(pattern.Rest, values[len(pattern.Elements)], env)
+		}
+	case *ast.HashPattern:
+		keys := make([]object.Object, len(pattern.Pairs))
+		for i, pair := range pattern.Pairs {
+			keys[i] = &object.String{Value: pair.Key.Value}
+		}
+		values, err := object.UnpackHash(value, keys)
+		if err != nil {
+			return newError("%s", err)
+		}
+
+		for i, pair := range pattern.Pairs {
+			if errObj := bindPattern(pair.Value, values[i], env); errObj != nil {
+				return errObj
+			}
+		}
+	}
+	return nil // match中的字面量只用于比较,不绑定变量
+}
+
+// evalMatchExpression subject只求值一次,按顺序找到第一个模式匹配且guard成立的分支;都不匹配时结果为null
+// 模式匹配后才绑定变量,与虚拟机一样绑定在当前环境中
+func evalMatchExpression(node *ast.MatchExpression, env *object.Environment) object.Object {
+	subject := Eval(node.Subject, env)
+	if isAbrupt(subject) {
+		return subject
+	}
+
+	for _, arm := range node.Arms {
+		matched, errObj := matchPattern(arm.Pattern, subject, env)
+		if errObj != nil {
+			return errObj
+		}
+		if !matched {
+			continue
+		}
+
+		if errObj := bindPattern(arm.Pattern, subject, env); errObj != nil {
+			return errObj
+		}
+
+		if arm.Guard != nil {
+			condition := Eval(arm.Guard, env)
+			if isAbrupt(condition) {
+				return condition
+			}
+			if !isTruthy(condition) {
+				continue
+			}
+		}
+
+		return Eval(arm.Body, env)
+	}
+
+	return NULL
+}
+
+// matchPattern 判断value是否匹配模式,字面量用==的规则比较
+func matchPattern(pattern ast.Expression, value object.Object, env *object.Environment) (bool, object.Object) {
+	switch pattern := pattern.(type) {
+	case *ast.Identifier: // 变量名和通配符匹配任何值
+		return true, nil
+	case *ast.ArrayPattern:
+		if !object.MatchArray(value, len(pattern.Elements), pattern.Rest != nil) {
+			return false, nil
+		}
+
+		elements := value.(*object.Array).Elements
+		for i, el := range pattern.Elements {
+			matched, errObj := matchPattern(el, elements[i], env)
+			if !matched || errObj != nil {
+				return false, errObj
+			}
+		}
+		return true, nil
+	case *ast.HashPattern:
+		keys := make([]object.Object, len(pattern.Pairs))
+		for i, pair := range pattern.Pairs {
+			keys[i] = &object.String{Value: pair.Key.Value}
+		}
+		if !object.MatchHash(value, keys) {
+			return false, nil
+		}
+
+		hash := value.(*object.Hash)
+		for i, pair := range pattern.Pairs {
+			entry, _ := hash.Lookup(keys[i])
+			matched, errObj := matchPattern(pair.Value, entry.Value, env)
+			if !matched || errObj != nil {
+				return false, errObj
+			}
+		}
+		return true, nil
+	default:
+		literal := Eval(pattern, env)
+		if isAbrupt(literal) {
+			return false, literal
+		}
+		return object.Equals(literal, value), nil
+	}
+}
+
+// loopControlError 把没有被循环处理的break和continue转换为错误,与编译器一样报错;其他值原样返回
+func loopControlError(obj object.Object) object.Object {
+	switch obj := obj.(type) {
+	case *object.BreakValue:
+		err := newError("break outside loop")
+		err.Pos = obj.Pos
+		return err
+	case *object.ContinueValue:
+		err := newError("continue outside loop")
+		err.Pos = obj.Pos
+		return err
+	}
+	return obj
 }
 
 func unwrapReturnValue(obj object.Object) object.Object {
@@ -432,119 +786,192 @@ func unwrapReturnValue(obj object.Object) object.Object {
 	return obj
 }
 
-func evalForExpression(fs *ast.ForExpression, env *object.Environment) object.Object {
-	if !(fs.Initialize == nil) { //初始化
-		Eval(fs.Initialize, env)
+// recordCallPos 为错误经过的、还没有调用位置的函数调用补上位置,
+// 内置函数回调的函数没有调用表达式,使用调用内置函数的位置
+func recordCallPos(err *object.Error, pos token.Position) {
+	for i := len(err.Calls) - 1; i >= 0 && !err.Calls[i].Pos.IsValid(); i-- {
+		err.Calls[i].Pos = pos
 	}
-	for isTruthy(Eval(fs.Condition, env)) {
-		evaluated := Eval(fs.Body, env)
+}
 
-		// 检查循环体内语句执行后的返回值类型
-		switch evaluated := evaluated.(type) {
-		case *object.ReturnValue:
-			return evaluated.Value
-		case *object.BreakValue:
-			// 当遇到 break 语句时，直接返回 NULL，即退出循环
-			return NULL
-		case *object.ContinueValue:
-			// 当遇到 continue 语句时，重新评估条件，继续下一次循环
-			continue
+func functionName(fn *object.Function) string { // 与虚拟机的调用栈使用同样的名字
+	switch {
+	case fn == nil:
+		return "<main>"
+	case fn.Name == "":
+		return "<anonymous>"
+	default:
+		return fn.Name
+	}
+}
+
+func evalTryExpression(node *ast.TryExpression, env *object.Environment) object.Object {
+	result := Eval(node.Body, env)
+
+	if errObj, ok := result.(*object.Error); ok && node.Catch != nil {
+		if node.CatchParam != nil {
+			env.Set(node.CatchParam.Value, exceptionValue(errObj, env))
 		}
+		result = Eval(node.Catch, env)
+	}
 
-		// 如果在循环体内遇到了 if 语句块，则需要对其进行评估
-		if ifExpr, ok := fs.Body.Statements[len(fs.Body.Statements)-1].(*ast.IfExpression); ok {
-			if isTruthy(Eval(ifExpr.Condition, env)) {
-				// 如果条件满足，则执行 if 语句块的 Consequence
-				evaluated := Eval(ifExpr.Consequence, env)
-				switch evaluated := evaluated.(type) {
-				case *object.ReturnValue:
-					return evaluated.Value
-				case *object.BreakValue:
-					return NULL
-				case *object.ContinueValue:
-					continue
-				}
-			} else if ifExpr.Alternative != nil {
-				// 如果条件不满足且存在 Alternative，则执行 Alternative
-				evaluated := Eval(ifExpr.Alternative, env)
-				switch evaluated := evaluated.(type) {
-				case *object.ReturnValue:
-					return evaluated.Value
-				case *object.BreakValue:
-					return nil
-				case *object.ContinueValue:
-					continue
-				}
-			}
+	if node.Finally != nil {
+		switch finally := Eval(node.Finally, env).(type) {
+		case *object.Error, *object.ReturnValue, *object.BreakValue, *object.ContinueValue: // finally中的跳转和错误取代原来的结果
+			return finally
 		}
-		//执行循环操作
-		evaluated = Eval(fs.Cycleop, env)
-		// 重新评估条件
-		// 如果条件不再满足，则退出循环
-		if !isTruthy(Eval(fs.Condition, env)) {
+	}
+
+	return result
+}
+
+// exceptionValue 返回catch得到的值,throw抛出的值原样返回,运行时错误包装成带有调用栈的哈希表,
+// 调用栈从出错的函数开始,到执行try的函数为止
+func exceptionValue(err *object.Error, env *object.Environment) object.Object {
+	if err.Value != nil {
+		return err.Value
+	}
+
+	trace := make([]string, 0, len(err.Calls)+1)
+	pos := err.Pos
+	for _, call := range err.Calls {
+		trace = append(trace, fmt.Sprintf("%s (%s)", call.Function, pos))
+		pos = call.Pos
+	}
+	trace = append(trace, fmt.Sprintf("%s (%s)", functionName(env.Function()), pos))
+
+	return object.ErrorValue(err.Message, trace)
+}
+
+func evalForExpression(fs *ast.ForExpression, env *object.Environment) object.Object {
+	if fs.Initialize != nil { //初始化
+		init := Eval(fs.Initialize, env)
+		if isAbrupt(init) {
+			return init
+		}
+	}
+
+	for {
+		condition := Eval(fs.Condition, env)
+		if isAbrupt(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
 			break
 		}
+
+		evaluated := Eval(fs.Body, env)
+		if result, done := loopControl(evaluated); done {
+			return result
+		}
+
+		//执行循环操作,continue之后同样需要执行;其中的break与虚拟机一样结束这个循环
+		if fs.Cycleop != nil {
+			op := Eval(fs.Cycleop, env)
+			if result, done := loopControl(op); done {
+				return result
+			}
+		}
 	}
 	return NULL
 }
 
 func evalWhileExpression(fs *ast.WhileExpression, env *object.Environment) object.Object {
-	for isTruthy(Eval(fs.Condition, env)) {
-		evaluated := Eval(fs.Body, env)
+	for {
+		condition := Eval(fs.Condition, env)
+		if isAbrupt(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			break
+		}
 
-		// 检查循环体内语句执行后的返回值类型
-		switch evaluated := evaluated.(type) {
-		case *object.ReturnValue:
-			return evaluated.Value
-		case *object.BreakValue:
-			// 当遇到 break 语句时，直接返回 NULL，即退出循环
-			return NULL
-		case *object.ContinueValue:
-			// 当遇到 continue 语句时，重新评估条件，继续下一次循环
-			continue
+		evaluated := Eval(fs.Body, env)
+		if result, done := loopControl(evaluated); done {
+			return result
 		}
+	}
 
-		// 如果在循环体内遇到了 if 语句块，则需要对其进行评估
-		if ifExpr, ok := fs.Body.Statements[len(fs.Body.Statements)-1].(*ast.IfExpression); ok {
-			if isTruthy(Eval(ifExpr.Condition, env)) {
-				// 如果条件满足，则执行 if 语句块的 Consequence
-				evaluated := Eval(ifExpr.Consequence, env)
-				switch evaluated := evaluated.(type) {
-				case *object.ReturnValue:
-					return evaluated.Value
-				case *object.BreakValue:
-					return NULL
-				case *object.ContinueValue:
-					continue
-				}
-			} else if ifExpr.Alternative != nil {
-				// 如果条件不满足且存在 Alternative，则执行 Alternative
-				evaluated := Eval(ifExpr.Alternative, env)
-				switch evaluated := evaluated.(type) {
-				case *object.ReturnValue:
-					return evaluated.Value
-				case *object.BreakValue:
-					return nil
-				case *object.ContinueValue:
-					continue
-				}
-			}
+	return NULL
+}
+
+// loopControl 检查循环体执行后的返回值类型,done为true时循环应当结束并返回result
+func loopControl(evaluated object.Object) (result object.Object, done bool) {
+	switch evaluated := evaluated.(type) {
+	case *object.ReturnValue, *object.Error:
+		// return和错误需要继续向外传递
+		return evaluated, true
+	case *object.BreakValue:
+		// 当遇到 break 语句时，直接返回 NULL，即退出循环
+		return NULL, true
+	}
+	// continue或正常结束时，重新评估条件，继续下一次循环
+	return nil, false
+}
+
+func evalAssignExpression(node *ast.AssignExpression, env *object.Environment) object.Object { //赋值表达式的值就是被赋的值
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		val := Eval(node.Value, env)
+		if isAbrupt(val) {
+			return val
+		}
+		if _, ok := env.Assign(target.Value, val); !ok {
+			return newError("identifier not found: " + target.Value)
 		}
+		return val
 
-		// 重新评估条件
-		// 如果条件不再满足，则退出循环
-		if !isTruthy(Eval(fs.Condition, env)) {
-			break
+	case *ast.IndexExpression:
+		left := Eval(target.Left, env)
+		if isAbrupt(left) {
+			return left
+		}
+		index := Eval(target.Index, env)
+		if isAbrupt(index) {
+			return index
 		}
+		val := Eval(node.Value, env)
+		if isAbrupt(val) {
+			return val
+		}
+		return evalIndexAssignment(left, index, val)
+
+	default:
+		return newError("invalid assignment target: %s", node.Target.String())
 	}
+}
 
-	return NULL
+func evalIndexAssignment(left, index, val object.Object) object.Object { //修改数组元素或哈希表的值
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		arrayObject := left.(*object.Array)
+		idx := index.(*object.Integer).Value
+		if idx < 0 || idx >= int64(len(arrayObject.Elements)) {
+			return newError("index out of range: %d", idx)
+		}
+		arrayObject.Elements[idx] = val
+		return val
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.BIG_INTEGER_OBJ:
+		return newError("index out of range: %s", index.Inspect())
+	case left.Type() == object.HASH_OBJ:
+		hashObject := left.(*object.Hash)
+		if !hashObject.Set(index, val) {
+			return newError("unusable as hash key: %s", index.Type())
+		}
+		return val
+	default:
+		return newError("index assignment not supported: %s", left.Type())
+	}
 }
 
 func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalStringIndexExpression(left, index)
+	case (left.Type() == object.ARRAY_OBJ || left.Type() == object.STRING_OBJ) && index.Type() == object.BIG_INTEGER_OBJ:
+		return NULL // 超出int64的下标不可能在范围内,与其他越界的下标一样得到null
 		// hash表
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
@@ -563,43 +990,49 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 	return arrayObject.Elements[idx]
 }
 
+func evalStringIndexExpression(str, index object.Object) object.Object { //字符串按字符下标取值,结果是只包含一个字符的字符串
+	runes := []rune(str.(*object.String).Value)
+	idx := index.(*object.Integer).Value
+	if idx < 0 || idx >= int64(len(runes)) {
+		return NULL
+	}
+	return &object.String{Value: string(runes[idx])}
+}
+
 func evalHashLiteral(
 	node *ast.HashLiteral,
 	env *object.Environment,
 ) object.Object {
-	pairs := make(map[object.HashKey]object.HashPair)
+	hash := object.NewHash()
 
-	for keyNode, valueNode := range node.Pairs {
-		key := Eval(keyNode, env)
-		if isError(key) {
+	for _, pair := range node.Pairs { // 按源码顺序求值,哈希表保持插入顺序
+		key := Eval(pair.Key, env)
+		if isAbrupt(key) {
 			return key
 		}
 
-		hashKey, ok := key.(object.Hashable)
-		if !ok {
+		if _, ok := object.HashKeyOf(key); !ok {
 			return newError("unusable as hash key: %s", key.Type())
 		}
 
-		value := Eval(valueNode, env)
-		if isError(value) {
+		value := Eval(pair.Value, env)
+		if isAbrupt(value) {
 			return value
 		}
 
-		hashed := hashKey.HashKey()
-		pairs[hashed] = object.HashPair{Key: key, Value: value}
+		hash.Set(key, value)
 	}
 
-	return &object.Hash{Pairs: pairs}
+	return hash
 }
 
 func evalHashIndexExpression(hash, index object.Object) object.Object {
 	hashObject := hash.(*object.Hash)
 
-	key, ok := index.(object.Hashable)
-	if !ok {
+	if _, ok := object.HashKeyOf(index); !ok {
 		return newError("unusable as hash key: %s", index.Type())
 	}
-	pair, ok := hashObject.Pairs[key.HashKey()]
+	pair, ok := hashObject.Lookup(index)
 	if !ok {
 		return NULL
 	}
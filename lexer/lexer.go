@@ -2,22 +2,42 @@
 package lexer
 
 import (
-	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"my.com/myfile/token"
 )
 
 type Lexer struct { //Lexer的主体
 	input        string //所有int类型的成员都被自动初始化为0
-	position     int    //正在获取的字符的位置
-	readPosition int    //需要读取的字符的位置
-	ch           byte   //正在处理的字符
+	position     int    //正在获取的字符的位置(字节偏移)
+	readPosition int    //需要读取的字符的位置(字节偏移)
+	ch           rune   //正在处理的字符,按UTF-8解码后的完整字符
+
+	file   string //源文件名,用于错误信息
+	line   int    //ch所在的行号
+	column int    //ch所在的列号
+
+	templates []template //正在读取的字符串插值,嵌套的字符串插值对应多层
+}
+
+type template struct {
+	braces int         //插值表达式中还没有闭合的{的个数
+	err    token.Token //字符串前面部分的转义错误,在字符串结束时报告
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input} //将input作为Lexer结构体的input初始化l
-	l.readChar()              //next操作，使得position=0,readposition=1
-	return l                  //返回一个Lexer结构体的指针
+	return NewWithFile(input, "")
+}
+
+// NewWithFile 创建词法分析器,生成的token位置中带有文件名
+func NewWithFile(input string, file string) *Lexer {
+	l := &Lexer{input: input, file: file, line: 1} //将input作为Lexer结构体的input初始化l
+	l.readChar()                                   //next操作，使得position=0,readposition=1
+	return l                                       //返回一个Lexer结构体的指针
 }
 
 func (l *Lexer) NextToken() token.Token { //受parser.nextToken调用
@@ -25,6 +45,24 @@ func (l *Lexer) NextToken() token.Token { //受parser.nextToken调用
 
 	l.skipWhitespace() //跳过空格，制表符，换行符
 
+	for l.ch == '/' && (l.peekChar() == '/' || l.peekChar() == '*') { //跳过注释
+		pos := l.currentPosition()
+		if l.isDocComment() {
+			return token.Token{Type: token.DOC, Literal: l.readLineComment(), Pos: pos}
+		}
+
+		if l.peekChar() == '*' {
+			if !l.skipBlockComment() {
+				return token.Token{Type: token.ILLEGAL, Literal: "unterminated comment", Pos: pos}
+			}
+		} else {
+			l.readLineComment()
+		}
+		l.skipWhitespace()
+	}
+
+	pos := l.currentPosition() //记录token开始的位置
+
 	switch l.ch { //运算符判断
 	case '=':
 		if l.peekChar() == '=' {
@@ -32,14 +70,18 @@ func (l *Lexer) NextToken() token.Token { //受parser.nextToken调用
 			l.readChar()
 			literal := string(ch) + string(l.ch)
 			tok = token.Token{Type: token.EQ, Literal: literal}
+		} else if l.peekChar() == '>' {
+			l.readChar()
+			tok = token.Token{Type: token.ARROW, Literal: "=>"}
 		} else {
 			tok = newToken(token.ASSIGN, l.ch)
 		}
 	case '+':
 		tok = newToken(token.PLUS, l.ch)
 	case '"':
-		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		tok = l.readString(false, token.Token{})
+	case '`':
+		tok = l.readRawString()
 	case '-':
 		tok = newToken(token.MINUS, l.ch)
 	case '!':
@@ -54,13 +96,31 @@ func (l *Lexer) NextToken() token.Token { //受parser.nextToken调用
 	case '/':
 		tok = newToken(token.SLASH, l.ch)
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		if l.peekChar() == '*' {
+			ch := l.ch
+			l.readChar()
+			literal := string(ch) + string(l.ch)
+			tok = token.Token{Type: token.POWER, Literal: literal}
+		} else {
+			tok = newToken(token.ASTERISK, l.ch)
+		}
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
+	case '^':
+		tok = newToken(token.BIT_XOR, l.ch)
+	case '~':
+		tok = newToken(token.BIT_NOT, l.ch)
 	case '<':
 		if l.peekChar() == '=' {
 			ch := l.ch
 			l.readChar()
 			literal := string(ch) + string(l.ch)
 			tok = token.Token{Type: token.LE, Literal: literal} //LE就是<=
+		} else if l.peekChar() == '<' {
+			ch := l.ch
+			l.readChar()
+			literal := string(ch) + string(l.ch)
+			tok = token.Token{Type: token.SHL, Literal: literal}
 		} else {
 			tok = newToken(token.LT, l.ch)
 		}
@@ -70,6 +130,11 @@ func (l *Lexer) NextToken() token.Token { //受parser.nextToken调用
 			l.readChar()
 			literal := string(ch) + string(l.ch)
 			tok = token.Token{Type: token.GE, Literal: literal} //GE就是>=
+		} else if l.peekChar() == '>' {
+			ch := l.ch
+			l.readChar()
+			literal := string(ch) + string(l.ch)
+			tok = token.Token{Type: token.SHR, Literal: literal}
 		} else {
 			tok = newToken(token.GT, l.ch)
 		}
@@ -79,13 +144,25 @@ func (l *Lexer) NextToken() token.Token { //受parser.nextToken调用
 			l.readChar()
 			literal := string(ch) + string(l.ch)
 			tok = token.Token{Type: token.AND, Literal: literal}
+		} else {
+			tok = newToken(token.BIT_AND, l.ch)
 		}
 	case '|':
 		if l.peekChar() == '|' {
 			ch := l.ch
 			l.readChar()
 			literal := string(ch) + string(l.ch)
-			tok = token.Token{Type: token.AND, Literal: literal}
+			tok = token.Token{Type: token.OR, Literal: literal}
+		} else {
+			tok = newToken(token.BIT_OR, l.ch)
+		}
+	case '.':
+		if strings.HasPrefix(l.input[l.readPosition:], "..") {
+			l.readChar()
+			l.readChar()
+			tok = token.Token{Type: token.ELLIPSIS, Literal: "..."}
+		} else {
+			tok = token.Token{Type: token.ILLEGAL, Literal: fmt.Sprintf("illegal character %q", l.ch)}
 		}
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
@@ -94,8 +171,20 @@ func (l *Lexer) NextToken() token.Token { //受parser.nextToken调用
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case '{':
+		if n := len(l.templates); n > 0 {
+			l.templates[n-1].braces++
+		}
 		tok = newToken(token.LBRACE, l.ch)
 	case '}':
+		if n := len(l.templates); n > 0 {
+			if l.templates[n-1].braces == 0 { //插值表达式结束,继续读取字符串剩下的部分
+				err := l.templates[n-1].err
+				l.templates = l.templates[:n-1]
+				tok = l.readString(true, err)
+				break
+			}
+			l.templates[n-1].braces--
+		}
 		tok = newToken(token.RBRACE, l.ch)
 	case '(':
 		tok = newToken(token.LPAREN, l.ch)
@@ -106,12 +195,18 @@ func (l *Lexer) NextToken() token.Token { //受parser.nextToken调用
 	case ']':
 		tok = newToken(token.RBRACKET, l.ch)
 	case 0:
+		if len(l.templates) > 0 { //插值表达式没有结束,只报告一次错误,之后返回EOF
+			l.templates = nil
+			tok = token.Token{Type: token.ILLEGAL, Literal: "unterminated string"}
+			break
+		}
 		tok.Literal = ""
 		tok.Type = token.EOF
 	default:
 		if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()       //
 			tok.Type = token.LookupId(tok.Literal) //判断是否为关键字，若不是返回ID作为类型，若是返回关键字map中对应的类型
+			tok.Pos = pos
 			return tok
 		} else if isDigit(l.ch) {
 			tok.Type = token.INT
@@ -122,7 +217,8 @@ func (l *Lexer) NextToken() token.Token { //受parser.nextToken调用
 				l.readChar()
 				tok.Literal += l.readNumber()
 			}
-			if l.ch == 'E' || l.ch == 'e' {
+			if l.ch == 'E' || l.ch == 'e' { // 科学计数法同样是浮点数,例如1e-3
+				tok.Type = token.FLOAT
 				tok.Literal += string(l.ch)
 				l.readChar()
 				if l.ch == '+' || l.ch == '-' {
@@ -131,37 +227,90 @@ func (l *Lexer) NextToken() token.Token { //受parser.nextToken调用
 				}
 				tok.Literal += l.readNumber()
 			}
+			tok.Pos = pos
 			return tok
 		} else {
-			tok = newToken(token.ILLEGAL, l.ch)
+			tok = token.Token{Type: token.ILLEGAL, Literal: fmt.Sprintf("illegal character %q", l.ch)}
 		}
 	}
 
 	l.readChar()
+	if !tok.Pos.IsValid() { //字符串中的转义错误带有自己的位置
+		tok.Pos = pos
+	}
 	return tok //返回一个token
 }
 
+func (l *Lexer) currentPosition() token.Position { //当前字符在源码中的位置
+	return token.Position{File: l.file, Line: l.line, Column: l.column}
+}
+
 func (l *Lexer) skipWhitespace() { //跳过
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
 		l.readChar()
 	}
 }
 
-func (l *Lexer) readChar() { //next操作
+func (l *Lexer) isDocComment() bool { //以三个斜杠开头的行注释是文档注释，四个及以上的斜杠只是普通注释
+	rest := l.input[l.position:]
+	return strings.HasPrefix(rest, "///") && !strings.HasPrefix(rest, "////")
+}
+
+func (l *Lexer) readLineComment() string { //读取到行尾，返回去掉斜杠和首尾空白后的注释内容
+	for l.ch == '/' {
+		l.readChar()
+	}
+	position := l.position
+	for l.ch != '\n' && l.ch != 0 {
+		l.readChar()
+	}
+	return strings.TrimSpace(l.input[position:l.position])
+}
+
+func (l *Lexer) skipBlockComment() bool { //跳过块注释，支持嵌套，没有找到结尾时返回false
+	depth := 0
+	for {
+		switch {
+		case l.ch == 0:
+			return false
+		case l.ch == '/' && l.peekChar() == '*':
+			depth++
+			l.readChar()
+		case l.ch == '*' && l.peekChar() == '/':
+			depth--
+			l.readChar()
+			if depth == 0 {
+				l.readChar()
+				return true
+			}
+		}
+		l.readChar()
+	}
+}
+
+func (l *Lexer) readChar() { //next操作，一次读取一个UTF-8字符
+	if l.ch == '\n' { //上一个字符是换行符时进入下一行
+		l.line++
+		l.column = 0
+	}
+	l.column++
+
+	width := 1
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
-		l.ch = l.input[l.readPosition]
+		l.ch, width = utf8.DecodeRuneInString(l.input[l.readPosition:])
 	}
 	l.position = l.readPosition
-	l.readPosition += 1
+	l.readPosition += width
 }
 
-func (l *Lexer) peekChar() byte { //peekChar读取当前字符的后一个字符，如果有则返回进一步判断
+func (l *Lexer) peekChar() rune { //peekChar读取当前字符的后一个字符，如果有则返回进一步判断
 	if l.readPosition >= len(l.input) {
 		return 0
 	} else {
-		return l.input[l.readPosition]
+		ch, _ := utf8.DecodeRuneInString(l.input[l.readPosition:])
+		return ch
 	}
 }
 
@@ -181,45 +330,97 @@ func (l *Lexer) readNumber() string {
 	return l.input[position:l.position]
 }
 
-func isLetter(ch byte) bool { //isLetter里面也接受下划线
-	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
+func isLetter(ch rune) bool { //isLetter里面也接受下划线和各种语言的文字，例如中文标识符
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_' || ch >= utf8.RuneSelf && unicode.IsLetter(ch)
 }
 
-func isDigit(ch byte) bool {
+func isDigit(ch rune) bool {
 	return '0' <= ch && ch <= '9'
 }
 
-func newToken(tokenType token.TokenType, ch byte) token.Token {
+func newToken(tokenType token.TokenType, ch rune) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)} //用来处理token的值是一个字符串的情况
 }
 
-func (l *Lexer) readString() string {
-	var escaped bool     //标记当前解析的字符是否是转义字符
-	var out bytes.Buffer //使用bytes.Buffer类型的out变量来累积解析出来的字符，这样能高效地构建字符串
+// readString 读取字符串,从开头的"或者插值表达式结尾的}开始,结束时ch为"或者${中的{
+// 遇到${时返回TEMPLATE,之后的token属于插值表达式,直到与它配对的};
+// 字符串结束时,continued为true(即前面有插值)返回TEMPLATE_END,否则返回STRING
+// 转义字符的错误等到整个字符串结束时才作为ILLEGAL返回,避免字符串剩下的内容被当作代码,err是前面部分的错误
+func (l *Lexer) readString(continued bool, err token.Token) token.Token {
+	var out strings.Builder //使用strings.Builder累积解析出来的字符，这样能高效地构建字符串
 
 	for {
 		l.readChar() //首先消耗一个字符
-		if l.ch == '"' || l.ch == 0 {
-			break
-		}
-
-		if escaped {
-			switch l.ch {
-			case 'n':
-				out.WriteRune('\n')
-			case 't':
-				out.WriteRune('\t')
-			default:
-				out.WriteByte(l.ch)
+		switch {
+		case l.ch == 0:
+			return token.Token{Type: token.ILLEGAL, Literal: "unterminated string"}
+		case l.ch == '"':
+			if err.Type == token.ILLEGAL {
+				return err
 			}
-			escaped = false
-		} else {
-			if l.ch == '\\' {
-				escaped = true
-			} else {
-				out.WriteByte(l.ch)
+			if continued {
+				return token.Token{Type: token.TEMPLATE_END, Literal: out.String()}
+			}
+			return token.Token{Type: token.STRING, Literal: out.String()}
+		case l.ch == '$' && l.peekChar() == '{':
+			l.readChar()
+			l.templates = append(l.templates, template{err: err})
+			return token.Token{Type: token.TEMPLATE, Literal: out.String()}
+		case l.ch == '\\':
+			pos := l.currentPosition()
+			l.readChar()
+			if msg := l.readEscape(&out); msg != "" && err.Type != token.ILLEGAL {
+				err = token.Token{Type: token.ILLEGAL, Literal: msg, Pos: pos}
 			}
+		default:
+			out.WriteRune(l.ch)
+		}
+	}
+}
+
+func (l *Lexer) readEscape(out *strings.Builder) string { //解析\后面的转义字符,出错时返回错误信息
+	switch l.ch {
+	case 'n':
+		out.WriteByte('\n')
+	case 't':
+		out.WriteByte('\t')
+	case 'r':
+		out.WriteByte('\r')
+	case 'u': // \u{1F600},1到6位十六进制数
+		if l.peekChar() != '{' {
+			return `invalid unicode escape: expected \u{...}`
+		}
+		l.readChar()
+		start := l.readPosition
+		for l.peekChar() != '}' && l.peekChar() != '"' && l.peekChar() != 0 {
+			l.readChar()
+		}
+		digits := l.input[start:l.readPosition]
+		if l.peekChar() != '}' {
+			return fmt.Sprintf("unterminated unicode escape \\u{%s", digits)
+		}
+		l.readChar()
+		value, err := strconv.ParseUint(digits, 16, 32)
+		if err != nil || len(digits) > 6 || !utf8.ValidRune(rune(value)) {
+			return fmt.Sprintf("invalid unicode escape \\u{%s}", digits)
+		}
+		out.WriteRune(rune(value))
+	case 0: //字符串在\之后结束,由readString报告
+	default: //包括\"、\\和\$,其他字符也原样保留
+		out.WriteRune(l.ch)
+	}
+	return ""
+}
+
+func (l *Lexer) readRawString() token.Token { //反引号字符串,内容原样保留,可以跨行,没有转义和插值
+	position := l.readPosition
+	for {
+		l.readChar()
+		switch l.ch {
+		case '`':
+			return token.Token{Type: token.STRING, Literal: l.input[position:l.position]}
+		case 0:
+			return token.Token{Type: token.ILLEGAL, Literal: "unterminated raw string"}
 		}
 	}
-	return out.String()
 }
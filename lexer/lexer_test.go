@@ -15,7 +15,7 @@ let add = fn(x, y) {
 };
 
 let result = add(five, ten);
-!-/*5;
+!-/ *5;
 5 < 10 > 5;
 
 if (5 < 10) {
@@ -26,7 +26,11 @@ if (5 < 10) {
 
 10 == 10;
 10 != 9;
-[1, 2]
+[1, 2];
+a && b || c;
+a % b ** c & d | e ^ ~f << g >> h;
+f(...xs);
+match x { _ => 1 }
 `
 
 	tests := []struct {
@@ -106,13 +110,130 @@ if (5 < 10) {
 		{token.NOT_EQ, "!="},
 		{token.INT, "9"},
 		{token.SEMICOLON, ";"},
-		{token.EOF, ""},
 		{token.LBRACKET, "["},
 		{token.INT, "1"},
 		{token.COMMA, ","},
 		{token.INT, "2"},
 		{token.RBRACKET, "]"},
 		{token.SEMICOLON, ";"},
+		{token.ID, "a"},
+		{token.AND, "&&"},
+		{token.ID, "b"},
+		{token.OR, "||"},
+		{token.ID, "c"},
+		{token.SEMICOLON, ";"},
+		{token.ID, "a"},
+		{token.PERCENT, "%"},
+		{token.ID, "b"},
+		{token.POWER, "**"},
+		{token.ID, "c"},
+		{token.BIT_AND, "&"},
+		{token.ID, "d"},
+		{token.BIT_OR, "|"},
+		{token.ID, "e"},
+		{token.BIT_XOR, "^"},
+		{token.BIT_NOT, "~"},
+		{token.ID, "f"},
+		{token.SHL, "<<"},
+		{token.ID, "g"},
+		{token.SHR, ">>"},
+		{token.ID, "h"},
+		{token.SEMICOLON, ";"},
+		{token.ID, "f"},
+		{token.LPAREN, "("},
+		{token.ELLIPSIS, "..."},
+		{token.ID, "xs"},
+		{token.RPAREN, ")"},
+		{token.SEMICOLON, ";"},
+		{token.MATCH, "match"},
+		{token.ID, "x"},
+		{token.LBRACE, "{"},
+		{token.ID, "_"},
+		{token.ARROW, "=>"},
+		{token.INT, "1"},
+		{token.RBRACE, "}"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// 行注释
+let a = 1; // 行尾注释
+/* 块注释 /* 可以嵌套 */ 仍然是注释 */
+/// 文档注释
+let b = a / 2;
+//// 分隔线
+/* 没有结束的块注释`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.LET, "let"},
+		{token.ID, "a"},
+		{token.ASSIGN, "="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.DOC, "文档注释"},
+		{token.LET, "let"},
+		{token.ID, "b"},
+		{token.ASSIGN, "="},
+		{token.ID, "a"},
+		{token.SLASH, "/"},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.ILLEGAL, "unterminated comment"},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestUnicode(t *testing.T) {
+	input := `let 计数 = "你好，世界";
+计数_2 + é`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.LET, "let"},
+		{token.ID, "计数"},
+		{token.ASSIGN, "="},
+		{token.STRING, "你好，世界"},
+		{token.SEMICOLON, ";"},
+		{token.ID, "计数_2"},
+		{token.PLUS, "+"},
+		{token.ID, "é"},
 		{token.EOF, ""},
 	}
 
@@ -132,3 +253,109 @@ if (5 < 10) {
 		}
 	}
 }
+
+func TestPositions(t *testing.T) {
+	input := "let a = 1;\n  计数 + \"b\";"
+
+	tests := []struct {
+		expectedLiteral string
+		line            int
+		column          int
+	}{
+		{"let", 1, 1},
+		{"a", 1, 5},
+		{"=", 1, 7},
+		{"1", 1, 9},
+		{";", 1, 10},
+		{"计数", 2, 3},
+		{"+", 2, 6},
+		{"b", 2, 8},
+		{";", 2, 11},
+		{"", 2, 12},
+	}
+
+	l := NewWithFile(input, "main.wz")
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Pos.File != "main.wz" || tok.Pos.Line != tt.line || tok.Pos.Column != tt.column {
+			t.Fatalf("tests[%d] - position wrong. expected=%d:%d, got=%s",
+				i, tt.line, tt.column, tok.Pos)
+		}
+	}
+}
+
+func TestStrings(t *testing.T) {
+	input := `"a\"b\\c\r\$\u{4e2d}\u{1F600}"
+"x${n + 1}y${ {"k": "${v}"}["k"] }z"
+` + "`raw \\n ${x}\nline`" + `
+"\u{110000}${1}"
+"${a`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+		line            int
+		column          int
+	}{
+		{token.STRING, "a\"b\\c\r$中😀", 1, 1},
+		{token.TEMPLATE, "x", 2, 1},
+		{token.ID, "n", 2, 5},
+		{token.PLUS, "+", 2, 7},
+		{token.INT, "1", 2, 9},
+		{token.TEMPLATE, "y", 2, 10},
+		{token.LBRACE, "{", 2, 15},
+		{token.STRING, "k", 2, 16},
+		{token.COLON, ":", 2, 19},
+		{token.TEMPLATE, "", 2, 21},
+		{token.ID, "v", 2, 24},
+		{token.TEMPLATE_END, "", 2, 25},
+		{token.RBRACE, "}", 2, 27},
+		{token.LBRACKET, "[", 2, 28},
+		{token.STRING, "k", 2, 29},
+		{token.RBRACKET, "]", 2, 32},
+		{token.TEMPLATE_END, "z", 2, 34},
+		{token.STRING, "raw \\n ${x}\nline", 3, 1},
+		{token.TEMPLATE, "", 5, 1},
+		{token.INT, "1", 5, 14},
+		{token.ILLEGAL, `invalid unicode escape \u{110000}`, 5, 2},
+		{token.TEMPLATE, "", 6, 1},
+		{token.ID, "a", 6, 4},
+		{token.ILLEGAL, "unterminated string", 6, 5},
+		{token.EOF, "", 6, 6},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Pos.Line != tt.line || tok.Pos.Column != tt.column {
+			t.Fatalf("tests[%d] - position wrong. expected=%d:%d, got=%s",
+				i, tt.line, tt.column, tok.Pos)
+		}
+	}
+
+	for _, input := range []string{`"abc`, "`abc", `"\u{41`} {
+		tok := New(input).NextToken()
+		if tok.Type != token.ILLEGAL {
+			t.Errorf("%s: expected ILLEGAL token. got=%q (%q)", input, tok.Type, tok.Literal)
+		}
+	}
+}
@@ -1,18 +1,380 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"my.com/myfile/repl"
+	"io"
 	"os"
 	"os/user"
+	"path/filepath"
+	"strings"
+
+	"my.com/myfile/ast"
+	"my.com/myfile/compiler"
+	"my.com/myfile/evaluator"
+	"my.com/myfile/lexer"
+	"my.com/myfile/object"
+	"my.com/myfile/parser"
+	"my.com/myfile/repl"
+	"my.com/myfile/token"
+	"my.com/myfile/vm"
 )
 
+// 退出码
+const (
+	exitOK    = 0
+	exitError = 1 // 程序解析、编译或执行失败
+	exitUsage = 2 // 命令行参数错误
+)
+
+const argsName = "ARGS" // 保存脚本参数的全局变量名
+
+const usage = `Wizard 程序语言
+
+用法:
+  wizard                              启动交互式环境
+  wizard run [-engine vm|eval] [-checked] 文件 [参数...]  运行Wizard源文件
+  wizard repl [-engine vm|eval]        启动交互式环境
+  wizard build [-o 输出文件] 文件        将源文件编译为字节码文件(默认扩展名 .wzc)
+  wizard exec [-checked] 字节码文件 [参数...]  运行编译好的字节码文件
+  wizard dis 文件                      输出源文件编译后的字节码
+  wizard tokens 文件                   输出源文件的词法单元
+  wizard ast 文件                      输出源文件的抽象语法树
+  wizard 文件 [参数...]                同 wizard run,用于 #! 脚本
+
+脚本参数保存在全局数组 ARGS 中,ARGS[0] 为脚本路径。
+-checked 开启整数溢出检查,运算结果超出 int64 的范围时报错而不是转换为大整数。
+`
+
 func main() {
-	user, err := user.Current()
+	os.Exit(runCommand(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func runCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int { // 根据子命令执行,返回退出码
+	if len(args) == 0 {
+		return cmdRepl(nil, stdin, stdout, stderr)
+	}
+
+	switch args[0] {
+	case "run":
+		return cmdRun(args[1:], stdout, stderr)
+	case "repl":
+		return cmdRepl(args[1:], stdin, stdout, stderr)
+	case "build":
+		return cmdBuild(args[1:], stderr)
+	case "exec":
+		return cmdExec(args[1:], stderr)
+	case "dis":
+		return cmdDis(args[1:], stdout, stderr)
+	case "tokens":
+		return cmdTokens(args[1:], stdout, stderr)
+	case "ast":
+		return cmdAst(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	}
+
+	if strings.HasPrefix(args[0], "-") {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	return cmdRun(args, stdout, stderr) // wizard 文件 参数...
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+func parseEngine(name string) (repl.Engine, bool) {
+	switch repl.Engine(name) {
+	case repl.EngineVM, repl.EngineEval:
+		return repl.Engine(name), true
+	}
+	return "", false
+}
+
+func cmdRepl(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("repl", stderr)
+	engineName := fs.String("engine", string(repl.EngineVM), "执行引擎: vm 或 eval")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	engine, ok := parseEngine(*engineName)
+	if !ok {
+		fmt.Fprintf(stderr, "unknown engine %q\n", *engineName)
+		return exitUsage
+	}
+
+	username := "there"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	fmt.Fprintf(stdout, "Hello %s! This is the Wizard program language!\n", username)
+	fmt.Fprintf(stdout, "Feel free to type in commands\n")
+	repl.StartWithEngine(stdin, stdout, engine)
+	return exitOK
+}
+
+func cmdRun(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("run", stderr)
+	engineName := fs.String("engine", string(repl.EngineVM), "执行引擎: vm 或 eval")
+	checked := fs.Bool("checked", false, "整数运算溢出时报错")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	engine, ok := parseEngine(*engineName)
+	if !ok {
+		fmt.Fprintf(stderr, "unknown engine %q\n", *engineName)
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(stderr, "usage: wizard run [-engine vm|eval] [-checked] 文件 [参数...]")
+		return exitUsage
+	}
+
+	path := fs.Arg(0)
+	src, program, ok := loadProgram(path, stderr)
+	if !ok {
+		return exitError
+	}
+	scriptArgs := newArgsArray(fs.Args())
+
+	if engine == repl.EngineEval {
+		env := object.NewEnvironment()
+		env.Set(argsName, scriptArgs)
+		env.CheckedArithmetic = *checked
+
+		evaluated := evaluator.Eval(program, env)
+		if errObj, ok := evaluated.(*object.Error); ok {
+			io.WriteString(stderr, repl.FormatError(src, errObj.Pos, errObj.Message))
+			return exitError
+		}
+		return exitOK
+	}
+
+	comp := newScriptCompiler()
+	if err := comp.Compile(program); err != nil {
+		repl.PrintError(stderr, map[string]string{path: src}, err)
+		return exitError
+	}
+
+	return runBytecode(comp.Bytecode(), scriptArgs, map[string]string{path: src}, *checked, stderr)
+}
+
+func cmdBuild(args []string, stderr io.Writer) int {
+	fs := newFlagSet("build", stderr)
+	output := fs.String("o", "", "输出文件,默认为源文件名加 .wzc")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: wizard build [-o 输出文件] 文件")
+		return exitUsage
+	}
+
+	path := fs.Arg(0)
+	src, program, ok := loadProgram(path, stderr)
+	if !ok {
+		return exitError
+	}
+
+	comp := newScriptCompiler()
+	if err := comp.Compile(program); err != nil {
+		repl.PrintError(stderr, map[string]string{path: src}, err)
+		return exitError
+	}
+
+	data, err := compiler.Marshal(comp.Bytecode())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	out := *output
+	if out == "" {
+		out = strings.TrimSuffix(path, filepath.Ext(path)) + ".wzc"
+	}
+	if err := os.WriteFile(out, data, 0644); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	return exitOK
+}
+
+func cmdExec(args []string, stderr io.Writer) int {
+	fs := newFlagSet("exec", stderr)
+	checked := fs.Bool("checked", false, "整数运算溢出时报错")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(stderr, "usage: wizard exec [-checked] 字节码文件 [参数...]")
+		return exitUsage
+	}
+
+	path := fs.Arg(0)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	bytecode, err := compiler.Unmarshal(data)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", path, err)
+		return exitError
+	}
+
+	// 字节码中记录的是源文件的位置,源文件还在的话用来显示出错的代码行
+	sources := map[string]string{}
+	for _, entry := range bytecode.Lines {
+		if _, ok := sources[entry.Pos.File]; !ok {
+			if src, err := os.ReadFile(entry.Pos.File); err == nil {
+				sources[entry.Pos.File] = stripShebang(string(src))
+			}
+		}
+	}
+
+	return runBytecode(bytecode, newArgsArray(fs.Args()), sources, *checked, stderr)
+}
+
+func runBytecode(bytecode *compiler.Bytecode, scriptArgs *object.Array, sources map[string]string, checked bool, stderr io.Writer) int { // 在虚拟机中执行脚本的字节码
+	globals := make([]object.Object, vm.GlobalsSize)
+	_, argsSymbol := newScriptSymbolTable()
+	globals[argsSymbol.Index] = scriptArgs
+
+	machine := vm.NewWithGlobalsStore(bytecode, globals)
+	machine.CheckedArithmetic = checked
+	if err := machine.Run(); err != nil {
+		repl.PrintError(stderr, sources, err)
+		return exitError
+	}
+	return exitOK
+}
+
+func cmdDis(args []string, stdout, stderr io.Writer) int {
+	path, ok := singleFileArg("dis", args, stderr)
+	if !ok {
+		return exitUsage
+	}
+	src, program, ok := loadProgram(path, stderr)
+	if !ok {
+		return exitError
+	}
+
+	comp := newScriptCompiler()
+	if err := comp.Compile(program); err != nil {
+		repl.PrintError(stderr, map[string]string{path: src}, err)
+		return exitError
+	}
+
+	fmt.Fprint(stdout, repl.Disassemble(comp.Bytecode()))
+	return exitOK
+}
+
+func cmdTokens(args []string, stdout, stderr io.Writer) int {
+	path, ok := singleFileArg("tokens", args, stderr)
+	if !ok {
+		return exitUsage
+	}
+	src, ok := readSource(path, stderr)
+	if !ok {
+		return exitError
+	}
+
+	l := lexer.NewWithFile(src, path)
+	for {
+		tok := l.NextToken()
+		fmt.Fprintf(stdout, "%-8s %-10s %q\n", fmt.Sprintf("%d:%d", tok.Pos.Line, tok.Pos.Column), tok.Type, tok.Literal)
+		if tok.Type == token.EOF {
+			break
+		}
+	}
+	return exitOK
+}
+
+func cmdAst(args []string, stdout, stderr io.Writer) int {
+	path, ok := singleFileArg("ast", args, stderr)
+	if !ok {
+		return exitUsage
+	}
+	_, program, ok := loadProgram(path, stderr)
+	if !ok {
+		return exitError
+	}
+
+	for _, stmt := range program.Statements { // 每个顶层语句输出一行
+		fmt.Fprintf(stdout, "%-8s %s\n", fmt.Sprintf("%d:%d", stmt.Pos().Line, stmt.Pos().Column), stmt.String())
+	}
+	return exitOK
+}
+
+func singleFileArg(name string, args []string, stderr io.Writer) (string, bool) {
+	if len(args) != 1 {
+		fmt.Fprintf(stderr, "usage: wizard %s 文件\n", name)
+		return "", false
+	}
+	return args[0], true
+}
+
+func readSource(path string, stderr io.Writer) (string, bool) { // 读取源文件,并去掉开头的 #! 行
+	data, err := os.ReadFile(path)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(stderr, err)
+		return "", false
+	}
+	return stripShebang(string(data)), true
+}
+
+func stripShebang(src string) string { // 只清空 #! 行的内容,保留换行使后面的行号不变
+	if !strings.HasPrefix(src, "#!") {
+		return src
+	}
+	if i := strings.IndexByte(src, '\n'); i >= 0 {
+		return src[i:]
+	}
+	return ""
+}
+
+func loadProgram(path string, stderr io.Writer) (string, *ast.Program, bool) { // 读取并解析源文件,出错时输出错误
+	src, ok := readSource(path, stderr)
+	if !ok {
+		return "", nil, false
+	}
+
+	p := parser.New(lexer.NewWithFile(src, path))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		sources := map[string]string{path: src}
+		for _, err := range p.ParseErrors() {
+			repl.PrintError(stderr, sources, err)
+		}
+		return "", nil, false
+	}
+	return src, program, true
+}
+
+func newScriptSymbolTable() (*compiler.SymbolTable, compiler.Symbol) { // 脚本的全局符号表,预先定义保存脚本参数的全局变量
+	symbolTable := compiler.NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+	argsSymbol := symbolTable.Define(argsName)
+
+	return symbolTable, argsSymbol
+}
+
+func newScriptCompiler() *compiler.Compiler {
+	symbolTable, _ := newScriptSymbolTable()
+	return compiler.NewWithState(symbolTable, []object.Object{})
+}
+
+func newArgsArray(args []string) *object.Array { // 将脚本路径和参数转换为字符串数组
+	elements := make([]object.Object, len(args))
+	for i, arg := range args {
+		elements[i] = &object.String{Value: arg}
 	}
-	fmt.Printf("Hello %s! This is the Wizard program language!\n", user.Username)
-	fmt.Printf("Feel free to type in commands\n")
-	repl.Start(os.Stdin, os.Stdout)
+	return &object.Array{Elements: elements}
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeScript 在临时目录中写入脚本,返回它的路径
+func writeScript(t *testing.T, dir, name, src string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunCommand(t *testing.T) {
+	dir := t.TempDir()
+	ok := writeScript(t, dir, "ok.wz", "#!/usr/bin/env wizard\nlet x = 1 + 2;\nif (x != 3) { throw \"wrong\" }\n")
+	args := writeScript(t, dir, "args.wz", `if (len(ARGS) != 3 || ARGS[1] != "a") { throw "bad args" }`)
+	failing := writeScript(t, dir, "fail.wz", "let x = 1;\nx / 0;\n")
+	syntax := writeScript(t, dir, "syntax.wz", "let = 1;\n")
+	undefined := writeScript(t, dir, "undefined.wz", "y;\n")
+	missing := filepath.Join(dir, "missing.wz")
+
+	tests := []struct {
+		name       string
+		args       []string
+		stdin      string
+		wantCode   int
+		wantStdout string // 标准输出中应包含的内容,为空时不检查
+		wantStderr string // 标准错误中应包含的内容,为空时要求没有输出
+	}{
+		{"run vm", []string{"run", ok}, "", exitOK, "", ""},
+		{"run eval", []string{"run", "-engine", "eval", ok}, "", exitOK, "", ""},
+		{"run without subcommand", []string{ok}, "", exitOK, "", ""},
+		{"script arguments", []string{"run", args, "a", "b"}, "", exitOK, "", ""},
+		{"wrong script arguments", []string{"run", args}, "", exitError, "", "bad args"},
+		{"runtime error vm", []string{"run", failing}, "", exitError, "", "fail.wz:2:3: division by zero"},
+		{"runtime error eval", []string{"run", "-engine", "eval", failing}, "", exitError, "", "division by zero"},
+		{"syntax error", []string{"run", syntax}, "", exitError, "", "syntax.wz:1:5"},
+		{"compile error", []string{"run", undefined}, "", exitError, "", "undefined variable y"},
+		{"missing file", []string{"run", missing}, "", exitError, "", "no such file or directory"},
+		{"unknown engine", []string{"run", "-engine", "jit", ok}, "", exitUsage, "", `unknown engine "jit"`},
+		{"run without file", []string{"run"}, "", exitUsage, "", "usage: wizard run"},
+		{"unknown flag", []string{"run", "-fast", ok}, "", exitUsage, "", "flag provided but not defined"},
+		{"unknown option", []string{"-x"}, "", exitUsage, "", "用法"},
+		{"help", []string{"help"}, "", exitOK, "wizard run", ""},
+		{"dis", []string{"dis", ok}, "", exitOK, "0000 OpConstant 0", ""},
+		{"dis missing file", []string{"dis", missing}, "", exitError, "", "no such file or directory"},
+		{"dis without file", []string{"dis"}, "", exitUsage, "", "usage: wizard dis"},
+		{"tokens", []string{"tokens", ok}, "", exitOK, `2:5      ID         "x"`, ""},
+		{"ast", []string{"ast", ok}, "", exitOK, "2:1      let x = (1 + 2);", ""},
+		{"ast syntax error", []string{"ast", syntax}, "", exitError, "", "syntax.wz:1:5"},
+		{"repl", []string{"repl"}, "1 + 2\n", exitOK, ">> 3", ""},
+		{"repl eval", []string{"repl", "-engine", "eval"}, "let x = 4; x * 2\n", exitOK, ">> 8", ""},
+		{"repl unknown engine", []string{"repl", "-engine", "jit"}, "", exitUsage, "", `unknown engine "jit"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := runCommand(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+
+			if code != tt.wantCode {
+				t.Errorf("exit code wrong. got=%d, want=%d (stderr: %q)", code, tt.wantCode, stderr.String())
+			}
+			if !strings.Contains(stdout.String(), tt.wantStdout) {
+				t.Errorf("stdout does not contain %q. got=%q", tt.wantStdout, stdout.String())
+			}
+			if tt.wantStderr == "" && stderr.Len() != 0 {
+				t.Errorf("unexpected stderr: %q", stderr.String())
+			}
+			if !strings.Contains(stderr.String(), tt.wantStderr) {
+				t.Errorf("stderr does not contain %q. got=%q", tt.wantStderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestBuildAndExec(t *testing.T) {
+	dir := t.TempDir()
+	script := writeScript(t, dir, "prog.wz", "fn add(a, b) { a + b }\nif (add(len(ARGS), 1) != 3) { throw \"bad args\" }\n")
+	failing := writeScript(t, dir, "fail.wz", "let x = 1;\nx / 0;\n")
+	garbage := writeScript(t, dir, "garbage.wzc", "not bytecode")
+
+	run := func(args ...string) (int, string) {
+		var stdout, stderr bytes.Buffer
+		code := runCommand(args, strings.NewReader(""), &stdout, &stderr)
+		return code, stderr.String()
+	}
+
+	// 默认输出文件为源文件名加 .wzc
+	if code, stderr := run("build", script); code != exitOK {
+		t.Fatalf("build failed with code %d: %s", code, stderr)
+	}
+	compiled := filepath.Join(dir, "prog.wzc")
+	if code, stderr := run("exec", compiled, "arg"); code != exitOK {
+		t.Errorf("exec failed with code %d: %s", code, stderr)
+	}
+	if code, stderr := run("exec", compiled); code != exitError || !strings.Contains(stderr, "bad args") {
+		t.Errorf("exec with wrong arguments: got code %d, stderr %q", code, stderr)
+	}
+
+	// -o 指定输出文件,运行时错误仍然指向源文件的位置
+	out := filepath.Join(dir, "out.bin")
+	if code, stderr := run("build", "-o", out, failing); code != exitOK {
+		t.Fatalf("build -o failed with code %d: %s", code, stderr)
+	}
+	if code, stderr := run("exec", out); code != exitError || !strings.Contains(stderr, "fail.wz:2:3: division by zero") {
+		t.Errorf("exec of failing program: got code %d, stderr %q", code, stderr)
+	}
+
+	tests := []struct {
+		args       []string
+		wantCode   int
+		wantStderr string
+	}{
+		{[]string{"exec", garbage}, exitError, "not a Wizard bytecode file"},
+		{[]string{"exec", filepath.Join(dir, "missing.wzc")}, exitError, "no such file or directory"},
+		{[]string{"exec"}, exitUsage, "usage: wizard exec"},
+		{[]string{"build"}, exitUsage, "usage: wizard build"},
+		{[]string{"build", filepath.Join(dir, "missing.wz")}, exitError, "no such file or directory"},
+	}
+
+	for _, tt := range tests {
+		code, stderr := run(tt.args...)
+		if code != tt.wantCode || !strings.Contains(stderr, tt.wantStderr) {
+			t.Errorf("%v: got code %d, stderr %q; want code %d, stderr containing %q",
+				tt.args, code, stderr, tt.wantCode, tt.wantStderr)
+		}
+	}
+}
@@ -1,14 +1,24 @@
 package object
 
-import "fmt"
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
 
+// Builtins 内置函数的注册表,解释器和编译器都从这里读取内置函数
+// 编译器按下标生成OpGetBuiltin指令,所以只能在末尾追加新的内置函数
 var Builtins = []struct {
 	Name    string
 	Builtin *Builtin
 }{
 	{
 		"puts",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Fn: func(_ CallContext, args ...Object) Object {
 			for _, arg := range args {
 				fmt.Println(arg.Inspect())
 			}
@@ -19,7 +29,7 @@ var Builtins = []struct {
 	},
 	{
 		Name: "push",
-		Builtin: &Builtin{Fn: func(args ...Object) Object {
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object {
 			if len(args) != 2 && len(args) != 3 {
 				return newError("wrong number of arguments. got=%d, want=2 or 3", len(args))
 			}
@@ -44,20 +54,339 @@ var Builtins = []struct {
 				key := args[1]
 				value := args[2]
 
-				hashedKey := HashKey{
-					Type: key.Type(),
+				newHash := hash.Copy()
+				if !newHash.Set(key, value) {
+					return newError("unusable as hash key: %s", key.Type())
 				}
 
-				newPairs := make(map[HashKey]HashPair)
-				for k, v := range hash.Pairs {
-					newPairs[k] = v
+				return newHash
+			} else {
+				return newError("argument to `push` must be ARRAY or HASH, got %s", args[0].Type())
+			}
+		}},
+	},
+	{
+		Name: "len",
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+
+			switch arg := args[0].(type) {
+			case *String: // 字符串的长度按字符计算而不是字节
+				return &Integer{Value: int64(utf8.RuneCountInString(arg.Value))}
+			case *Array:
+				return &Integer{Value: int64(len(arg.Elements))}
+			case *Hash:
+				return &Integer{Value: int64(arg.Len())}
+			default:
+				return newError("argument to `len` not supported, got %s", args[0].Type())
+			}
+		}},
+	},
+	{
+		Name: "first",
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object {
+			arr, err := arrayArgument("first", args)
+			if err != nil {
+				return err
+			}
+			if len(arr.Elements) > 0 {
+				return arr.Elements[0]
+			}
+			return nil
+		}},
+	},
+	{
+		Name: "last",
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object {
+			arr, err := arrayArgument("last", args)
+			if err != nil {
+				return err
+			}
+			length := len(arr.Elements)
+			if length > 0 {
+				return arr.Elements[length-1]
+			}
+			return nil
+		}},
+	},
+	{
+		Name: "rest",
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object { // 返回去掉第一个元素的新数组
+			arr, err := arrayArgument("rest", args)
+			if err != nil {
+				return err
+			}
+			length := len(arr.Elements)
+			if length > 0 {
+				newElements := make([]Object, length-1, length-1)
+				copy(newElements, arr.Elements[1:length])
+				return &Array{Elements: newElements}
+			}
+			return nil
+		}},
+	},
+	{
+		Name: "type",
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object { // 返回值的类型名,两种引擎中的函数都是FUNCTION
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+
+			switch args[0].(type) {
+			case *Function, *CompiledFunction, *Closure:
+				return &String{Value: FUNCTION_OBJ}
+			}
+			return &String{Value: string(args[0].Type())}
+		}},
+	},
+	{
+		Name: "str",
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object { // 转换为字符串,字符串本身不加引号
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+
+			if s, ok := args[0].(*String); ok {
+				return s
+			}
+			return &String{Value: args[0].Inspect()}
+		}},
+	},
+	{
+		Name: "int",
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object { // 转换为整数,浮点数向零取整
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+
+			switch arg := args[0].(type) {
+			case *Integer, *BigInteger:
+				return arg
+			case *Float:
+				if math.IsInf(arg.Value, 0) || math.IsNaN(arg.Value) {
+					return newError("could not convert %s to integer", arg.Inspect())
+				}
+				value, _ := big.NewFloat(arg.Value).Int(nil) // 超出int64范围时得到BigInteger
+				return NewInteger(value)
+			case *Boolean:
+				if arg.Value {
+					return &Integer{Value: 1}
+				}
+				return &Integer{Value: 0}
+			case *String:
+				value, ok := new(big.Int).SetString(strings.TrimSpace(arg.Value), 0)
+				if !ok {
+					return newError("could not convert %q to integer", arg.Value)
+				}
+				return NewInteger(value)
+			default:
+				return newError("argument to `int` not supported, got %s", args[0].Type())
+			}
+		}},
+	},
+	{
+		Name: "keys",
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object {
+			hash, err := hashArgument("keys", args)
+			if err != nil {
+				return err
+			}
+			pairs := hash.Pairs()
+			elements := make([]Object, len(pairs))
+			for i, pair := range pairs { // 返回键的副本,修改它们不会影响哈希表
+				elements[i] = CopyKey(pair.Key)
+			}
+			return &Array{Elements: elements}
+		}},
+	},
+	{
+		Name: "values",
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object {
+			hash, err := hashArgument("values", args)
+			if err != nil {
+				return err
+			}
+			pairs := hash.Pairs()
+			elements := make([]Object, len(pairs))
+			for i, pair := range pairs {
+				elements[i] = pair.Value
+			}
+			return &Array{Elements: elements}
+		}},
+	},
+	{
+		Name: "delete",
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object { // 和push一样返回新的哈希表,不修改参数
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2", len(args))
+			}
+			hash, ok := args[0].(*Hash)
+			if !ok {
+				return newError("argument to `delete` must be HASH, got %s", args[0].Type())
+			}
+			if err := checkHashKey(args[1]); err != nil {
+				return err
+			}
+			return hash.Without(args[1])
+		}},
+	},
+	{
+		Name: "contains",
+		Builtin: &Builtin{Fn: func(_ CallContext, args ...Object) Object { // 数组是否包含元素,哈希表是否包含键,字符串是否包含子串
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2", len(args))
+			}
+
+			switch container := args[0].(type) {
+			case *Array:
+				for _, element := range container.Elements {
+					if Equals(element, args[1]) {
+						return TRUE
+					}
+				}
+				return FALSE
+			case *Hash:
+				if err := checkHashKey(args[1]); err != nil {
+					return err
+				}
+				_, ok := container.Lookup(args[1])
+				return NativeBool(ok)
+			case *String:
+				sub, ok := args[1].(*String)
+				if !ok {
+					return newError("second argument to `contains` must be STRING, got %s", args[1].Type())
+				}
+				return NativeBool(strings.Contains(container.Value, sub.Value))
+			default:
+				return newError("argument to `contains` not supported, got %s", args[0].Type())
+			}
+		}},
+	},
+	{
+		Name: "map",
+		Builtin: &Builtin{Fn: func(ctx CallContext, args ...Object) Object { // 返回对每个元素调用函数的结果组成的新数组
+			arr, err := callbackArguments("map", args)
+			if err != nil {
+				return err
+			}
+
+			elements := make([]Object, len(arr.Elements))
+			for i, element := range arr.Elements {
+				result := ctx.Call(args[1], element)
+				if isError(result) {
+					return result
 				}
-				newPairs[hashedKey] = HashPair{Key: key, Value: value}
+				elements[i] = result
+			}
+			return &Array{Elements: elements}
+		}},
+	},
+	{
+		Name: "filter",
+		Builtin: &Builtin{Fn: func(ctx CallContext, args ...Object) Object { // 返回函数结果为真的元素组成的新数组
+			arr, err := callbackArguments("filter", args)
+			if err != nil {
+				return err
+			}
+
+			elements := []Object{}
+			for _, element := range arr.Elements {
+				result := ctx.Call(args[1], element)
+				if isError(result) {
+					return result
+				}
+				if isTruthy(result) {
+					elements = append(elements, element)
+				}
+			}
+			return &Array{Elements: elements}
+		}},
+	},
+	{
+		Name: "reduce",
+		Builtin: &Builtin{Fn: func(ctx CallContext, args ...Object) Object { // reduce(arr, fn(acc, x), initial),省略initial时从第一个元素开始
+			if len(args) != 2 && len(args) != 3 {
+				return newError("wrong number of arguments. got=%d, want=2 or 3", len(args))
+			}
+			arr, err := callbackArguments("reduce", args[:2])
+			if err != nil {
+				return err
+			}
 
-				return &Hash{Pairs: newPairs}
+			elements := arr.Elements
+			var acc Object
+			if len(args) == 3 {
+				acc = args[2]
+			} else if len(elements) > 0 {
+				acc, elements = elements[0], elements[1:]
 			} else {
-				return newError("argument to `push` must be ARRAY or HASH, got %s", args[0].Type())
+				return nil
+			}
+
+			for _, element := range elements {
+				acc = ctx.Call(args[1], acc, element)
+				if isError(acc) {
+					return acc
+				}
 			}
+			return acc
+		}},
+	},
+	{
+		Name: "sort_by",
+		Builtin: &Builtin{Fn: func(ctx CallContext, args ...Object) Object { // 按函数返回的键稳定排序,返回新数组
+			arr, err := callbackArguments("sort_by", args)
+			if err != nil {
+				return err
+			}
+
+			keys := make([]Object, len(arr.Elements))
+			for i, element := range arr.Elements {
+				keys[i] = ctx.Call(args[1], element)
+				if isError(keys[i]) {
+					return keys[i]
+				}
+			}
+
+			order := make([]int, len(arr.Elements))
+			for i := range order {
+				order[i] = i
+			}
+			var sortErr *Error
+			sort.SliceStable(order, func(i, j int) bool {
+				c, err := compareKeys(keys[order[i]], keys[order[j]])
+				if err != nil && sortErr == nil {
+					sortErr = err
+				}
+				return c < 0
+			})
+			if sortErr != nil {
+				return sortErr
+			}
+
+			elements := make([]Object, len(order))
+			for i, idx := range order {
+				elements[i] = arr.Elements[idx]
+			}
+			return &Array{Elements: elements}
+		}},
+	},
+	{
+		Name: "each",
+		Builtin: &Builtin{Fn: func(ctx CallContext, args ...Object) Object { // 对每个元素调用函数,返回null
+			arr, err := callbackArguments("each", args)
+			if err != nil {
+				return err
+			}
+
+			for _, element := range arr.Elements {
+				if result := ctx.Call(args[1], element); isError(result) {
+					return result
+				}
+			}
+			return nil
 		}},
 	},
 }
@@ -66,6 +395,90 @@ func newError(format string, a ...interface{}) *Error {
 	return &Error{Message: fmt.Sprintf(format, a...)}
 }
 
+func arrayArgument(name string, args []Object) (*Array, *Error) { // 检查只有一个数组参数
+	if len(args) != 1 {
+		return nil, newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+	arr, ok := args[0].(*Array)
+	if !ok {
+		return nil, newError("argument to `%s` must be ARRAY, got %s", name, args[0].Type())
+	}
+	return arr, nil
+}
+
+func callbackArguments(name string, args []Object) (*Array, *Error) { // 检查参数为一个数组和一个函数
+	if len(args) != 2 {
+		return nil, newError("wrong number of arguments. got=%d, want=2", len(args))
+	}
+	arr, ok := args[0].(*Array)
+	if !ok {
+		return nil, newError("first argument to `%s` must be ARRAY, got %s", name, args[0].Type())
+	}
+	switch args[1].(type) {
+	case *Function, *Closure, *Builtin:
+	default:
+		return nil, newError("second argument to `%s` must be FUNCTION, got %s", name, args[1].Type())
+	}
+	return arr, nil
+}
+
+func hashArgument(name string, args []Object) (*Hash, *Error) { // 检查只有一个哈希表参数
+	if len(args) != 1 {
+		return nil, newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+	hash, ok := args[0].(*Hash)
+	if !ok {
+		return nil, newError("argument to `%s` must be HASH, got %s", name, args[0].Type())
+	}
+	return hash, nil
+}
+
+func checkHashKey(key Object) *Error { // 检查值能否作为哈希表的键
+	if _, ok := HashKeyOf(key); !ok {
+		return newError("unusable as hash key: %s", key.Type())
+	}
+	return nil
+}
+
+func isError(obj Object) bool {
+	_, ok := obj.(*Error)
+	return ok
+}
+
+func isTruthy(obj Object) bool { // 和两种引擎一致,只有false和null为假
+	switch obj := obj.(type) {
+	case *Boolean:
+		return obj.Value
+	case *Null:
+		return false
+	default:
+		return true
+	}
+}
+
+func compareKeys(a, b Object) (int, *Error) { // 比较sort_by的键,数字之间按大小,字符串之间按字典序
+	switch {
+	case IsInteger(a) && IsInteger(b):
+		return CompareIntegers(a, b), nil
+	case isNumber(a) && isNumber(b):
+		if c, ok := CompareNumbers(a, b); ok {
+			return c, nil
+		}
+		return cmp.Compare(toFloat(a), toFloat(b)), nil // NaN排在最前面
+	}
+	if a, ok := a.(*String); ok {
+		if b, ok := b.(*String); ok {
+			return strings.Compare(a.Value, b.Value), nil
+		}
+	}
+	return 0, newError("cannot compare sort keys %s and %s", a.Type(), b.Type())
+}
+
+func isNumber(obj Object) bool {
+	_, isFloat := obj.(*Float)
+	return isFloat || IsInteger(obj)
+}
+
 func GetBuiltinByName(name string) *Builtin { // 通过名字获取内置函数
 	for _, def := range Builtins {
 		if def.Name == name {
@@ -0,0 +1,73 @@
+package object
+
+import "fmt"
+
+// UnpackArray 按数组模式解构value,解释器和虚拟机共用
+// 返回前n个元素,数组不够长时用NULL补齐;rest为true时最后再加上剩余元素组成的新数组
+func UnpackArray(value Object, n int, rest bool) ([]Object, error) {
+	arr, ok := value.(*Array)
+	if !ok {
+		return nil, fmt.Errorf("cannot destructure %s as array", value.Type())
+	}
+
+	values := make([]Object, 0, n+1)
+	for i := 0; i < n; i++ {
+		if i < len(arr.Elements) {
+			values = append(values, arr.Elements[i])
+		} else {
+			values = append(values, NULL)
+		}
+	}
+	if rest {
+		elements := []Object{}
+		if len(arr.Elements) > n {
+			elements = append(elements, arr.Elements[n:]...)
+		}
+		values = append(values, &Array{Elements: elements})
+	}
+	return values, nil
+}
+
+// UnpackHash 按哈希模式解构value,返回每个键对应的值,没有的键为NULL
+func UnpackHash(value Object, keys []Object) ([]Object, error) {
+	hash, ok := value.(*Hash)
+	if !ok {
+		return nil, fmt.Errorf("cannot destructure %s as hash", value.Type())
+	}
+
+	values := make([]Object, 0, len(keys))
+	for _, key := range keys {
+		if pair, ok := hash.Lookup(key); ok {
+			values = append(values, pair.Value)
+		} else {
+			values = append(values, NULL)
+		}
+	}
+	return values, nil
+}
+
+// MatchArray 判断value能否匹配有n个元素的数组模式,有rest时数组可以更长
+func MatchArray(value Object, n int, rest bool) bool {
+	arr, ok := value.(*Array)
+	if !ok {
+		return false
+	}
+	if rest {
+		return len(arr.Elements) >= n
+	}
+	return len(arr.Elements) == n
+}
+
+// MatchHash 判断value是否为包含所有键的哈希表
+func MatchHash(value Object, keys []Object) bool {
+	hash, ok := value.(*Hash)
+	if !ok {
+		return false
+	}
+	for _, key := range keys {
+		if _, ok := hash.Lookup(key); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -3,17 +3,36 @@ package object //可以使用object.go中定义的Object接口
 func NewEnclosedEnvironment(outer *Environment) *Environment {
 	env := NewEnvironment()
 	env.outer = outer
+	env.CheckedArithmetic = outer.CheckedArithmetic // 内层环境继承外层的设置
 	return env
 }
 
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
-	return &Environment{store: s, outer: nil}
+	return &Environment{store: s, outer: nil, declared: make(map[string]bool)}
+}
+
+// NewFunctionEnvironment 为一次函数调用创建环境,记录被调用的函数
+func NewFunctionEnvironment(fn *Function) *Environment {
+	env := NewEnclosedEnvironment(fn.Env)
+	env.function = fn
+	return env
 }
 
 type Environment struct { //使用链表的结构来存储变量，使用Object接口来表示变量
-	store map[string]Object
-	outer *Environment
+	store    map[string]Object
+	outer    *Environment
+	function *Function       // 函数调用的环境中为被调用的函数,全局环境为nil
+	declared map[string]bool // 用fn声明的函数名
+
+	// CheckedArithmetic 为true时整数运算超出int64的范围会报错,默认把结果提升为BigInteger
+	// 需要在求值之前对全局环境设置,内层环境创建时会继承它
+	CheckedArithmetic bool
+}
+
+// Function 返回环境所属的函数调用,全局环境返回nil
+func (e *Environment) Function() *Function {
+	return e.function
 }
 
 func (e *Environment) Get(name string) (Object, bool) { //Get方法能够
@@ -28,3 +47,32 @@ func (e *Environment) Set(name string, val Object) Object {
 	e.store[name] = val
 	return val
 }
+
+// DeclareFunction 在声明语句执行之前定义fn声明的函数名,值为val
+func (e *Environment) DeclareFunction(name string, val Object) {
+	e.store[name] = val
+	e.declared[name] = true
+}
+
+// IsDeclaredFunction 判断名字所在的环境中它是否由fn声明定义
+func (e *Environment) IsDeclaredFunction(name string) bool {
+	if _, ok := e.store[name]; ok {
+		return e.declared[name]
+	}
+	if e.outer != nil {
+		return e.outer.IsDeclaredFunction(name)
+	}
+	return false
+}
+
+// Assign 修改已经定义的变量,沿着外层环境查找变量定义的位置,变量不存在时返回false
+func (e *Environment) Assign(name string, val Object) (Object, bool) {
+	if _, ok := e.store[name]; ok {
+		e.store[name] = val
+		return val, true
+	}
+	if e.outer != nil {
+		return e.outer.Assign(name, val)
+	}
+	return nil, false
+}
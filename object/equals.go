@@ -0,0 +1,136 @@
+package object
+
+import (
+	"cmp"
+	"math"
+	"math/big"
+)
+
+// Equals 判断两个值是否相等,==、!=、哈希表的键查找和contains都使用它
+// 整数和浮点数按精确的数值比较,字符串和布尔值按值比较,数组和哈希表递归比较元素,
+// 其他值(函数、内置函数等)比较是否为同一个对象
+func Equals(a, b Object) bool {
+	return equals(a, b, nil)
+}
+
+type objectPair struct{ a, b Object }
+
+// seen 记录正在比较的数组和哈希表,数组可以通过下标赋值包含自身,遇到环时视为相等
+func equals(a, b Object, seen map[objectPair]bool) bool {
+	switch a := a.(type) {
+	case *Integer, *BigInteger:
+		switch b := b.(type) {
+		case *Integer, *BigInteger:
+			return CompareIntegers(a, b) == 0
+		case *Float:
+			c, ok := CompareNumbers(a, b)
+			return ok && c == 0
+		}
+		return false
+	case *Float:
+		switch b := b.(type) {
+		case *Integer, *BigInteger:
+			c, ok := CompareNumbers(a, b)
+			return ok && c == 0
+		case *Float:
+			return a.Value == b.Value
+		}
+		return false
+	case *String:
+		b, ok := b.(*String)
+		return ok && a.Value == b.Value
+	case *Boolean:
+		b, ok := b.(*Boolean)
+		return ok && a.Value == b.Value
+	case *Null:
+		_, ok := b.(*Null)
+		return ok
+	case *Array:
+		b, ok := b.(*Array)
+		if !ok || len(a.Elements) != len(b.Elements) {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		seen, cycle := enter(seen, a, b)
+		if cycle {
+			return true
+		}
+		for i := range a.Elements {
+			if !equals(a.Elements[i], b.Elements[i], seen) {
+				return false
+			}
+		}
+		return true
+	case *Hash:
+		b, ok := b.(*Hash)
+		if !ok || a.Len() != b.Len() {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		seen, cycle := enter(seen, a, b)
+		if cycle {
+			return true
+		}
+		for _, pair := range a.Pairs() {
+			other, ok := b.Lookup(pair.Key)
+			if !ok || !equals(pair.Value, other.Value, seen) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return a == b
+}
+
+// CompareNumbers 比较两个数字的大小,返回-1、0或1,a和b必须是整数或浮点数
+// 整数与浮点数混合时按精确的数值比较,不会因为转换为float64丢失精度;有NaN时无法比较,ok为false
+func CompareNumbers(a, b Object) (result int, ok bool) {
+	if IsInteger(a) && IsInteger(b) {
+		return CompareIntegers(a, b), true
+	}
+	af, aIsFloat := a.(*Float)
+	bf, bIsFloat := b.(*Float)
+	if (aIsFloat && math.IsNaN(af.Value)) || (bIsFloat && math.IsNaN(bf.Value)) {
+		return 0, false
+	}
+	if aIsFloat && bIsFloat {
+		return cmp.Compare(af.Value, bf.Value), true
+	}
+	return exactValue(a).Cmp(exactValue(b)), true
+}
+
+func exactValue(obj Object) *big.Float { // 数字的精确值,浮点数不能是NaN
+	if f, ok := obj.(*Float); ok {
+		return big.NewFloat(f.Value)
+	}
+	return new(big.Float).SetInt(bigValue(obj))
+}
+
+func toFloat(obj Object) float64 { // 数字转换为最接近的浮点数,用于与浮点数混合运算
+	switch obj := obj.(type) {
+	case *Integer:
+		return float64(obj.Value)
+	case *BigInteger:
+		return obj.Float64()
+	case *Float:
+		return obj.Value
+	}
+	return 0
+}
+
+func enter(seen map[objectPair]bool, a, b Object) (map[objectPair]bool, bool) {
+	if seen == nil {
+		seen = map[objectPair]bool{}
+	}
+	key := objectPair{a, b}
+	if seen[key] {
+		return seen, true
+	}
+	seen[key] = true
+	return seen, false
+}
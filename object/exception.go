@@ -0,0 +1,28 @@
+package object
+
+// ErrorValue 把运行时错误包装成catch能够得到的值,
+// 一个包含"message"(错误信息)和"trace"(调用栈,每层为"函数名 (位置)")的哈希表
+func ErrorValue(message string, trace []string) *Hash {
+	frames := make([]Object, len(trace))
+	for i, entry := range trace {
+		frames[i] = &String{Value: entry}
+	}
+
+	hash := NewHash()
+	hash.Set(&String{Value: "message"}, &String{Value: message})
+	hash.Set(&String{Value: "trace"}, &Array{Elements: frames})
+	return hash
+}
+
+// ThrownMessage 返回没有被捕获的异常值的描述,
+// 重新抛出的运行时错误取其中的"message",其他值使用Inspect
+func ThrownMessage(value Object) string {
+	if hash, ok := value.(*Hash); ok {
+		if pair, ok := hash.Lookup(&String{Value: "message"}); ok {
+			if message, ok := pair.Value.(*String); ok {
+				return message.Value
+			}
+		}
+	}
+	return value.Inspect()
+}
@@ -0,0 +1,199 @@
+package object
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+)
+
+// HashKey 键的哈希值,不同的键可能有相同的HashKey,查找时还要用Equals比较键本身
+type HashKey struct {
+	Type  ObjectType
+	Value uint64
+}
+
+type HashPair struct {
+	Key   Object
+	Value Object
+}
+
+// Hash 哈希表,键值对按插入顺序保存,Inspect和遍历都按这个顺序
+// 作为键的数组和哈希表在插入时复制一份保存,之后修改原来的值不会影响已有的键
+type Hash struct {
+	pairs []HashPair        // 按插入顺序排列的键值对
+	index map[HashKey][]int // 哈希值到pairs下标的映射,哈希值相同的键放在同一个桶中
+}
+
+func NewHash() *Hash {
+	return &Hash{index: map[HashKey][]int{}}
+}
+
+func (h *Hash) Type() ObjectType { return HASH_OBJ }
+func (h *Hash) Inspect() string {
+	var out bytes.Buffer
+
+	pairs := []string{}
+	for _, pair := range h.pairs {
+		pairs = append(pairs, fmt.Sprintf("%s: %s",
+			pair.Key.Inspect(), pair.Value.Inspect()))
+	}
+
+	out.WriteString("{")
+	out.WriteString(strings.Join(pairs, ", "))
+	out.WriteString("}")
+
+	return out.String()
+}
+func (h *Hash) ToBoolean() bool { return true }
+
+// Len 返回键值对的数量
+func (h *Hash) Len() int { return len(h.pairs) }
+
+// Pairs 按插入顺序返回键值对,调用者不能修改返回的切片
+func (h *Hash) Pairs() []HashPair { return h.pairs }
+
+// Lookup 按键查找键值对,键不能作为哈希键时返回false
+func (h *Hash) Lookup(key Object) (HashPair, bool) {
+	hashKey, ok := HashKeyOf(key)
+	if !ok {
+		return HashPair{}, false
+	}
+	if i := h.find(hashKey, key); i >= 0 {
+		return h.pairs[i], true
+	}
+	return HashPair{}, false
+}
+
+// Set 设置键对应的值,已有的键保持原来的位置,键不能作为哈希键时返回false
+func (h *Hash) Set(key, value Object) bool {
+	hashKey, ok := HashKeyOf(key)
+	if !ok {
+		return false
+	}
+	if i := h.find(hashKey, key); i >= 0 {
+		h.pairs[i].Value = value
+		return true
+	}
+
+	if h.index == nil {
+		h.index = map[HashKey][]int{}
+	}
+	h.index[hashKey] = append(h.index[hashKey], len(h.pairs))
+	h.pairs = append(h.pairs, HashPair{Key: CopyKey(key), Value: value})
+	return true
+}
+
+// Copy 返回键值对相同的新哈希表
+func (h *Hash) Copy() *Hash {
+	c := &Hash{
+		pairs: make([]HashPair, len(h.pairs)),
+		index: make(map[HashKey][]int, len(h.index)),
+	}
+	copy(c.pairs, h.pairs)
+	for k, bucket := range h.index {
+		c.index[k] = append([]int(nil), bucket...)
+	}
+	return c
+}
+
+// Without 返回去掉key之后的新哈希表,其余键值对保持原来的顺序
+func (h *Hash) Without(key Object) *Hash {
+	c := NewHash()
+	for _, pair := range h.pairs {
+		if !Equals(pair.Key, key) {
+			c.Set(pair.Key, pair.Value)
+		}
+	}
+	return c
+}
+
+func (h *Hash) find(hashKey HashKey, key Object) int { // 在哈希值相同的桶中找到相等的键
+	for _, i := range h.index[hashKey] {
+		if Equals(h.pairs[i].Key, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// CopyKey 复制作为键的数组和哈希表及其中嵌套的数组和哈希表,其他值不可修改,原样返回
+// 键只能是HashKeyOf接受的值,所以不会包含自身
+func CopyKey(key Object) Object {
+	switch key := key.(type) {
+	case *Array:
+		elements := make([]Object, len(key.Elements))
+		for i, element := range key.Elements {
+			elements[i] = CopyKey(element)
+		}
+		return &Array{Elements: elements}
+	case *Hash:
+		c := NewHash()
+		for _, pair := range key.pairs {
+			c.Set(pair.Key, CopyKey(pair.Value))
+		}
+		return c
+	}
+	return key
+}
+
+// HashKeyOf 计算值作为哈希表键时的哈希值,与Equals一致:相等的值哈希值相同
+// 数组和哈希表按内容计算,包含函数等不能作为键的值或者包含自身时返回false
+func HashKeyOf(obj Object) (HashKey, bool) {
+	return hashKeyOf(obj, map[Object]bool{})
+}
+
+func hashKeyOf(obj Object, visiting map[Object]bool) (HashKey, bool) {
+	switch obj := obj.(type) {
+	case Hashable:
+		return obj.HashKey(), true
+	case *Array:
+		if visiting[obj] {
+			return HashKey{}, false
+		}
+		visiting[obj] = true
+		defer delete(visiting, obj)
+
+		h := fnv.New64a()
+		for _, element := range obj.Elements {
+			key, ok := hashKeyOf(element, visiting)
+			if !ok {
+				return HashKey{}, false
+			}
+			writeHashKey(h, key)
+		}
+		return HashKey{Type: ARRAY_OBJ, Value: h.Sum64()}, true
+	case *Hash:
+		if visiting[obj] {
+			return HashKey{}, false
+		}
+		visiting[obj] = true
+		defer delete(visiting, obj)
+
+		var sum uint64 // 键值对的哈希值相加,与插入顺序无关
+		for _, pair := range obj.pairs {
+			key, ok := hashKeyOf(pair.Key, visiting)
+			if !ok {
+				return HashKey{}, false
+			}
+			value, ok := hashKeyOf(pair.Value, visiting)
+			if !ok {
+				return HashKey{}, false
+			}
+
+			h := fnv.New64a()
+			writeHashKey(h, key)
+			writeHashKey(h, value)
+			sum += h.Sum64()
+		}
+		return HashKey{Type: HASH_OBJ, Value: sum}, true
+	}
+	return HashKey{}, false
+}
+
+func writeHashKey(w io.Writer, key HashKey) {
+	w.Write([]byte(key.Type))
+	w.Write(binary.LittleEndian.AppendUint64(nil, key.Value))
+}
@@ -0,0 +1,144 @@
+package object
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+// collidingKey 所有实例的哈希值都相同,用来测试冲突的处理
+type collidingKey struct{ name string }
+
+func (k *collidingKey) Type() ObjectType { return "COLLIDING" }
+func (k *collidingKey) Inspect() string  { return k.name }
+func (k *collidingKey) ToBoolean() bool  { return true }
+func (k *collidingKey) HashKey() HashKey { return HashKey{Type: "COLLIDING", Value: 42} }
+
+func TestHashCollisions(t *testing.T) {
+	a, b := &collidingKey{"a"}, &collidingKey{"b"}
+
+	h := NewHash()
+	h.Set(a, &Integer{Value: 1})
+	h.Set(b, &Integer{Value: 2})
+	h.Set(a, &Integer{Value: 3})
+
+	if h.Len() != 2 {
+		t.Fatalf("wrong number of pairs. got=%d, want=2", h.Len())
+	}
+	if pair, ok := h.Lookup(a); !ok || pair.Value.Inspect() != "3" {
+		t.Errorf("wrong value for a. got=%v, %t", pair.Value, ok)
+	}
+	if pair, ok := h.Lookup(b); !ok || pair.Value.Inspect() != "2" {
+		t.Errorf("wrong value for b. got=%v, %t", pair.Value, ok)
+	}
+	if _, ok := h.Lookup(&collidingKey{"c"}); ok {
+		t.Errorf("found a key that was never set")
+	}
+	if got := h.Inspect(); got != "{a: 3, b: 2}" {
+		t.Errorf("wrong order. got=%s", got)
+	}
+
+	without := h.Without(a)
+	if _, ok := without.Lookup(b); !ok || without.Len() != 1 {
+		t.Errorf("Without removed the wrong key: %s", without.Inspect())
+	}
+	if h.Len() != 2 {
+		t.Errorf("Without modified the original hash")
+	}
+}
+
+func TestHashKeyOf(t *testing.T) {
+	equalKeys := [][2]Object{
+		{&Integer{Value: 1}, &Float{Value: 1}},
+		{&Array{Elements: []Object{&String{Value: "a"}, &Integer{Value: 1}}}, &Array{Elements: []Object{&String{Value: "a"}, &Float{Value: 1}}}},
+	}
+	for _, keys := range equalKeys {
+		k1, ok1 := HashKeyOf(keys[0])
+		k2, ok2 := HashKeyOf(keys[1])
+		if !ok1 || !ok2 || k1 != k2 {
+			t.Errorf("equal values %s and %s have different hash keys", keys[0].Inspect(), keys[1].Inspect())
+		}
+	}
+
+	h1, h2 := NewHash(), NewHash()
+	h1.Set(&String{Value: "a"}, &Integer{Value: 1})
+	h1.Set(&String{Value: "b"}, &Integer{Value: 2})
+	h2.Set(&String{Value: "b"}, &Integer{Value: 2})
+	h2.Set(&String{Value: "a"}, &Integer{Value: 1})
+	k1, _ := HashKeyOf(h1)
+	k2, _ := HashKeyOf(h2)
+	if k1 != k2 {
+		t.Errorf("hash key depends on insertion order")
+	}
+
+	cyclic := &Array{Elements: []Object{nil}}
+	cyclic.Elements[0] = cyclic
+	unhashable := []Object{
+		&Builtin{},
+		&Array{Elements: []Object{&Builtin{}}},
+		cyclic,
+	}
+	for _, obj := range unhashable {
+		if _, ok := HashKeyOf(obj); ok {
+			t.Errorf("expected %T to be unusable as hash key", obj)
+		}
+	}
+}
+
+func TestNumberEqualsAndHashKey(t *testing.T) {
+	twoTo64 := NewInteger(new(big.Int).Lsh(big.NewInt(1), 64)) // 2^64
+	numbers := []Object{
+		&Integer{Value: 1 << 53},
+		&Integer{Value: 1<<53 + 1},
+		&Float{Value: 1 << 53},
+		&Float{Value: 1<<53 + 2},
+		twoTo64,
+		&Float{Value: 1 << 64},
+		&Float{Value: 0.5},
+		&Float{Value: math.NaN()},
+	}
+	// 相等的值哈希值必须相同,并且整数与浮点数按精确的数值比较
+	for _, a := range numbers {
+		for _, b := range numbers {
+			if !Equals(a, b) {
+				continue
+			}
+			k1, _ := HashKeyOf(a)
+			k2, _ := HashKeyOf(b)
+			if k1 != k2 {
+				t.Errorf("equal values %s and %s have different hash keys", a.Inspect(), b.Inspect())
+			}
+		}
+	}
+
+	if Equals(&Integer{Value: 1<<53 + 1}, &Float{Value: 1 << 53}) {
+		t.Errorf("2^53+1 should not equal 2^53 as a float")
+	}
+	if !Equals(twoTo64, &Float{Value: 1 << 64}) || Equals(NewInteger(new(big.Int).Add(twoTo64.(*BigInteger).Value, big.NewInt(1))), &Float{Value: 1 << 64}) {
+		t.Errorf("wrong comparison between BigInteger and Float")
+	}
+}
+
+func TestHashMutableKeys(t *testing.T) {
+	key := &Array{Elements: []Object{&Integer{Value: 1}}}
+	h := NewHash()
+	h.Set(key, &Integer{Value: 1})
+	key.Elements[0] = &Integer{Value: 2} // 修改原来的数组不影响已经插入的键
+
+	if pair, ok := h.Lookup(&Array{Elements: []Object{&Integer{Value: 1}}}); !ok || pair.Value.Inspect() != "1" {
+		t.Errorf("key [1] not found after mutating the inserted array")
+	}
+	if _, ok := h.Lookup(key); ok {
+		t.Errorf("found key [2] that was never set")
+	}
+
+	inner := NewHash()
+	inner.Set(&String{Value: "a"}, &Array{Elements: []Object{}})
+	h.Set(inner, &Integer{Value: 3})
+	inner.Set(&String{Value: "b"}, &Integer{Value: 4})
+	want := NewHash()
+	want.Set(&String{Value: "a"}, &Array{Elements: []Object{}})
+	if pair, ok := h.Lookup(want); !ok || pair.Value.Inspect() != "3" {
+		t.Errorf("hash key not found after mutating the inserted hash")
+	}
+}
@@ -0,0 +1,255 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// BigInteger 超出int64范围的整数,整数运算溢出时自动转换为它
+// 运算结果回到int64范围内时重新用Integer表示,所以BigInteger的值总是在int64范围之外
+type BigInteger struct {
+	Value *big.Int // 不会被修改,运算总是生成新的big.Int
+}
+
+func (bi *BigInteger) Type() ObjectType { return BIG_INTEGER_OBJ }
+func (bi *BigInteger) Inspect() string  { return bi.Value.String() }
+func (bi *BigInteger) ToBoolean() bool  { return true }
+
+// Float64 返回最接近的浮点数,与浮点数混合运算和比较时使用
+func (bi *BigInteger) Float64() float64 {
+	f, _ := new(big.Float).SetInt(bi.Value).Float64()
+	return f
+}
+
+// HashKey 与浮点数的比较按转换后的浮点数进行,所以哈希值也按浮点数计算,保证相等的值哈希值相同
+func (bi *BigInteger) HashKey() HashKey {
+	return (&Float{Value: bi.Float64()}).HashKey()
+}
+
+// NewInteger 返回v对应的整数对象,v在int64范围内时为*Integer,否则为*BigInteger
+func NewInteger(v *big.Int) Object {
+	if v.IsInt64() {
+		return &Integer{Value: v.Int64()}
+	}
+	return &BigInteger{Value: v}
+}
+
+// IsInteger 判断是否为Integer或BigInteger
+func IsInteger(obj Object) bool {
+	switch obj.(type) {
+	case *Integer, *BigInteger:
+		return true
+	}
+	return false
+}
+
+func bigValue(obj Object) *big.Int { // 整数对象的big.Int表示,调用者不能修改BigInteger返回的值
+	switch obj := obj.(type) {
+	case *Integer:
+		return big.NewInt(obj.Value)
+	case *BigInteger:
+		return obj.Value
+	}
+	return nil
+}
+
+// CompareIntegers 比较两个整数对象的大小,返回-1、0或1
+func CompareIntegers(left, right Object) int {
+	if l, ok := left.(*Integer); ok {
+		if r, ok := right.(*Integer); ok {
+			switch {
+			case l.Value < r.Value:
+				return -1
+			case l.Value > r.Value:
+				return 1
+			}
+			return 0
+		}
+	}
+	return bigValue(left).Cmp(bigValue(right))
+}
+
+// ErrDivisionByZero 整数除以0
+var ErrDivisionByZero = errors.New("division by zero")
+
+// IntegerArithmetic 计算两个整数对象的算术运算和位运算,解释器和虚拟机共用
+// 除数为0时返回错误;结果超出int64的范围时转换为BigInteger,checked为true时改为返回溢出错误
+// 负数次幂的结果为浮点数
+func IntegerArithmetic(operator string, left, right Object, checked bool) (Object, error) {
+	switch operator {
+	case "<<", ">>":
+		if CompareIntegers(right, &Integer{}) < 0 {
+			return nil, fmt.Errorf("negative shift count: %s", right.Inspect())
+		}
+		if _, ok := right.(*BigInteger); ok {
+			return nil, fmt.Errorf("shift count too large: %s", right.Inspect())
+		}
+	case "**":
+		if CompareIntegers(right, &Integer{}) < 0 {
+			return &Float{Value: math.Pow(toFloat(left), toFloat(right))}, nil
+		}
+		if _, ok := right.(*BigInteger); ok {
+			return nil, fmt.Errorf("exponent too large: %s", right.Inspect())
+		}
+	}
+
+	l, lok := left.(*Integer)
+	r, rok := right.(*Integer)
+	if lok && rok {
+		result, overflow, err := int64Arithmetic(operator, l.Value, r.Value)
+		if err != nil {
+			return nil, err
+		}
+		if !overflow {
+			return &Integer{Value: result}, nil
+		}
+	}
+
+	result, err := bigArithmetic(operator, bigValue(left), bigValue(right))
+	if err != nil {
+		return nil, err
+	}
+	if checked && !result.IsInt64() {
+		return nil, fmt.Errorf("integer overflow: %s %s %s", left.Inspect(), operator, right.Inspect())
+	}
+	return NewInteger(result), nil
+}
+
+func int64Arithmetic(operator string, left, right int64) (result int64, overflow bool, err error) {
+	switch operator {
+	case "+":
+		result = left + right
+		overflow = (left^result)&(right^result) < 0 // 两个同号的数相加得到异号的结果
+	case "-":
+		result = left - right
+		overflow = (left^right)&(left^result) < 0
+	case "*":
+		result = left * right
+		overflow = left != 0 && (result/left != right || (left == -1 && right == math.MinInt64))
+	case "/":
+		if right == 0 {
+			return 0, false, ErrDivisionByZero
+		}
+		result = left / right
+		overflow = left == math.MinInt64 && right == -1
+	case "%":
+		if right == 0 {
+			return 0, false, ErrDivisionByZero
+		}
+		result = left % right // 与除法一样向零取整,余数的符号与被除数相同
+	case "&":
+		result = left & right
+	case "|":
+		result = left | right
+	case "^":
+		result = left ^ right
+	case "<<":
+		if right >= 63 {
+			return 0, left != 0, nil
+		}
+		result = left << right
+		overflow = result>>right != left
+	case ">>":
+		if right >= 63 {
+			right = 63 // 算术右移,结果为0或-1
+		}
+		result = left >> right
+	case "**":
+		result, overflow = int64Power(left, right)
+	default:
+		return 0, false, fmt.Errorf("unknown operator: %s %s %s", INTEGER_OBJ, operator, INTEGER_OBJ)
+	}
+	return result, overflow, nil
+}
+
+// MaxIntegerBits 移位和乘方的结果允许的最大位数,超过时报错而不是耗尽内存
+const MaxIntegerBits = 1 << 20
+
+func bigArithmetic(operator string, left, right *big.Int) (*big.Int, error) {
+	result := new(big.Int)
+	switch operator {
+	case "+":
+		result.Add(left, right)
+	case "-":
+		result.Sub(left, right)
+	case "*":
+		result.Mul(left, right)
+	case "/":
+		if right.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		result.Quo(left, right) // 与int64的除法一样向零取整
+	case "%":
+		if right.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		result.Rem(left, right)
+	case "&":
+		result.And(left, right)
+	case "|":
+		result.Or(left, right)
+	case "^":
+		result.Xor(left, right)
+	case "<<":
+		if left.Sign() != 0 && right.Int64() > int64(MaxIntegerBits-left.BitLen()) {
+			return nil, fmt.Errorf("shift count too large: %s", right)
+		}
+		result.Lsh(left, uint(right.Int64()))
+	case ">>":
+		result.Rsh(left, uint(right.Int64()))
+	case "**":
+		// 底数的绝对值至少为2时,结果至少有(BitLen-1)*exponent位
+		if bits := int64(left.BitLen() - 1); bits > 0 && right.Int64() > MaxIntegerBits/bits {
+			return nil, fmt.Errorf("exponent too large: %s", right)
+		}
+		result.Exp(left, right, nil)
+	default:
+		return nil, fmt.Errorf("unknown operator: %s %s %s", INTEGER_OBJ, operator, INTEGER_OBJ)
+	}
+	return result, nil
+}
+
+func int64Power(base, exponent int64) (result int64, overflow bool) { // 快速幂,exponent不小于0
+	result = 1
+	for exponent > 0 {
+		if exponent&1 == 1 {
+			r, o, _ := int64Arithmetic("*", result, base)
+			if o {
+				return 0, true
+			}
+			result = r
+		}
+		exponent >>= 1
+		if exponent > 0 {
+			b, o, _ := int64Arithmetic("*", base, base)
+			if o {
+				return 0, true
+			}
+			base = b
+		}
+	}
+	return result, false
+}
+
+// NegateInteger 对整数对象取负,对最小的int64取负得到BigInteger,checked为true时改为返回溢出错误
+func NegateInteger(value Object, checked bool) (Object, error) {
+	if i, ok := value.(*Integer); ok && i.Value != math.MinInt64 {
+		return &Integer{Value: -i.Value}, nil
+	}
+
+	result := new(big.Int).Neg(bigValue(value))
+	if checked && !result.IsInt64() {
+		return nil, fmt.Errorf("integer overflow: -(%s)", value.Inspect())
+	}
+	return NewInteger(result), nil
+}
+
+// ComplementInteger 按位取反,结果为-x-1,不会溢出
+func ComplementInteger(value Object) Object {
+	if i, ok := value.(*Integer); ok {
+		return &Integer{Value: ^i.Value}
+	}
+	return NewInteger(new(big.Int).Not(bigValue(value)))
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"math"
+	"strconv"
 	"strings"
 
 	"my.com/myfile/ast"
 	"my.com/myfile/code"
+	"my.com/myfile/token"
 )
 
 type ObjectType string //增加了代码的可读性
@@ -16,9 +19,11 @@ const (
 	NULL_OBJ  = "NULL"
 	ERROR_OBJ = "ERROR"
 
-	INTEGER_OBJ = "INTEGER"
-	STRING_OBJ  = "STRING"
-	BOOLEAN_OBJ = "BOOLEAN"
+	INTEGER_OBJ     = "INTEGER"
+	BIG_INTEGER_OBJ = "BIG_INTEGER" // 超出int64范围的整数
+	FLOAT_OBJ       = "FLOAT"
+	STRING_OBJ      = "STRING"
+	BOOLEAN_OBJ     = "BOOLEAN"
 
 	RETURN_VALUE_OBJ   = "RETURN_VALUE"
 	CONTINUE_VALUE_OBJ = "CONTINUE_VALUE"
@@ -30,6 +35,8 @@ const (
 	HASH_OBJ     = "HASH"
 
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ" // 保存函数的字节码
+	CLOSURE_OBJ           = "CLOSURE"               // 字节码函数及其捕获的自由变量
+	CELL_OBJ              = "CELL"                  // 被闭包捕获的变量,只在虚拟机内部使用
 )
 
 // Object 定义了Object接口，接口提供了Type方法和Inspect方法
@@ -54,6 +61,21 @@ func (i *Integer) ToBoolean() bool {
 	}
 }
 
+// Float 浮点数的处理方法
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eEIN") { // 保留小数点,避免与整数混淆,例如3.0不显示为3
+		s += ".0"
+	}
+	return s
+}
+func (f *Float) ToBoolean() bool { return f.Value != 0 }
+
 // Boolean 这个函数非常灵活，支持多种格式化的占位符，用于将不同类型的值转化为字符串。
 // 布尔值的处理方法
 type Boolean struct {
@@ -67,6 +89,21 @@ func (b *Boolean) ToBoolean() bool  { return b.Value }
 // Null 空的处理方法
 type Null struct{}
 
+// 两种引擎共用的单例,解释器按指针比较布尔值和空值,内置函数也必须返回这些对象
+var (
+	NULL  = &Null{}
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
+)
+
+// NativeBool 返回对应的布尔值单例
+func NativeBool(b bool) *Boolean {
+	if b {
+		return TRUE
+	}
+	return FALSE
+}
+
 func (n *Null) Type() ObjectType { return NULL_OBJ }
 func (n *Null) Inspect() string  { return "null" }
 func (n *Null) ToBoolean() bool  { return false }
@@ -83,11 +120,21 @@ func (rv *ReturnValue) ToBoolean() bool  { return rv.Value.ToBoolean() }
 // Error 错误类型
 type Error struct {
 	Message string
+	Pos     token.Position // 产生错误的节点在源码中的位置
+	Value   Object         // throw抛出的值,运行时错误为nil
+	Calls   []CallSite     // 错误经过的函数调用,从最内层开始
+}
+
+// CallSite 错误向外传播时经过的一次函数调用,Pos是调用发生的位置
+type CallSite struct {
+	Function string
+	Pos      token.Position
 }
 
 // BreakValue break的处理方法
 type BreakValue struct {
 	Value Object
+	Pos   token.Position // break语句的位置,在循环之外使用时用来报错
 }
 
 func (bv *BreakValue) Type() ObjectType { return BREAK_VALUE_OBJ }
@@ -97,6 +144,7 @@ func (bv *BreakValue) ToBoolean() bool  { return bv.Value.ToBoolean() }
 // ContinueValue continue的处理方法
 type ContinueValue struct {
 	Value Object
+	Pos   token.Position
 }
 
 func (cv *ContinueValue) Type() ObjectType { return CONTINUE_VALUE_OBJ }
@@ -111,22 +159,24 @@ func (e *Error) ToBoolean() bool  { return false }
 // Function 函数的处理方法
 type Function struct {
 	Parameters []*ast.Identifier
+	Defaults   []ast.Expression // 参数的默认值,与ast.FunctionLiteral.Defaults相同
+	Patterns   []ast.Expression // 解构参数的模式,与ast.FunctionLiteral.Patterns相同
+	Rest       *ast.Identifier  // 剩余参数,没有时为nil
 	Body       *ast.BlockStatement
 	Env        *Environment
+	Name       string // 函数名,来自fn声明或者定义函数的let语句,匿名函数为空
 }
 
 func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
 func (f *Function) Inspect() string {
 	var out bytes.Buffer
 
-	params := []string{}
-	for _, p := range f.Parameters {
-		params = append(params, p.String())
-	}
-
 	out.WriteString("fn")
+	if f.Name != "" {
+		out.WriteString(" " + f.Name)
+	}
 	out.WriteString("(")
-	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(ast.ParameterList(f.Parameters, f.Defaults, f.Patterns, f.Rest))
 	out.WriteString(") {\n")
 	out.WriteString(f.Body.String())
 	out.WriteString("\n}")
@@ -135,6 +185,32 @@ func (f *Function) Inspect() string {
 }
 func (f *Function) ToBoolean() bool { return true }
 
+// ArgumentCountMessage 参数个数不对时的错误信息,解释器和虚拟机共用
+// 可以传入required到max个参数,有剩余参数时没有上限
+func ArgumentCountMessage(name string, required, max int, variadic bool, got int) string {
+	want := fmt.Sprintf("=%d", required)
+	if variadic {
+		want = fmt.Sprintf(">=%d", required)
+	} else if max != required {
+		want = fmt.Sprintf("=%d..%d", required, max)
+	}
+	if name != "" {
+		return fmt.Sprintf("wrong number of arguments to %s: want%s, got=%d", name, want, got)
+	}
+	return fmt.Sprintf("wrong number of arguments: want%s, got=%d", want, got)
+}
+
+// RequiredParameters 必须传入的参数个数,即没有默认值的参数个数
+func (f *Function) RequiredParameters() int {
+	required := 0
+	for i := range f.Parameters {
+		if f.Defaults == nil || f.Defaults[i] == nil {
+			required++
+		}
+	}
+	return required
+}
+
 // String 字符串的处理方法
 type String struct {
 	Value string
@@ -150,8 +226,14 @@ func (s *String) ToBoolean() bool {
 	}
 }
 
-// BuiltinFunction 接收任意数量的参数
-type BuiltinFunction func(args ...Object) Object
+// CallContext 内置函数通过它调用用户传入的函数,解释器和虚拟机各自实现
+type CallContext interface {
+	// Call 执行fn(args...)并返回结果,出错时返回*Error
+	Call(fn Object, args ...Object) Object
+}
+
+// BuiltinFunction 接收调用上下文和任意数量的参数
+type BuiltinFunction func(ctx CallContext, args ...Object) Object
 
 type Builtin struct {
 	Fn BuiltinFunction
@@ -182,50 +264,24 @@ func (ao *Array) Inspect() string {
 }
 func (ao *Array) ToBoolean() bool { return true }
 
-// 哈希表实现
-type HashKey struct {
-	Type  ObjectType
-	Value uint64
+// Hashable 可以直接计算哈希值的标量类型,数组和哈希表的哈希值由HashKeyOf按内容计算
+type Hashable interface {
+	HashKey() HashKey
 }
 
-type HashPair struct {
-	Key   Object
-	Value Object
+func (n *Null) HashKey() HashKey {
+	return HashKey{Type: n.Type()}
 }
 
-type Hash struct {
-	Name  string
-	Pairs map[HashKey]HashPair
+func (i *Integer) HashKey() HashKey {
+	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
 
-func (h *Hash) Type() ObjectType { return HASH_OBJ }
-func (h *Hash) Inspect() string {
-	var out bytes.Buffer
-
-	pairs := []string{}
-	for _, pair := range h.Pairs {
-		pairs = append(pairs, fmt.Sprintf("%s: %s",
-			pair.Key.Inspect(), pair.Value.Inspect()))
+func (f *Float) HashKey() HashKey { // 整数值的浮点数与对应的整数哈希值相同,因为两者相等
+	if f.Value == math.Trunc(f.Value) && f.Value >= math.MinInt64 && f.Value < math.MaxInt64 {
+		return (&Integer{Value: int64(f.Value)}).HashKey()
 	}
-
-	out.WriteString("{")
-	out.WriteString(strings.Join(pairs, ", "))
-	out.WriteString("}")
-
-	return out.String()
-}
-func (h *Hash) ToBoolean() bool { return true }
-func (h *Hash) HashKey() HashKey {
-	return HashKey{}
-}
-
-// hashable 接口实现
-type Hashable interface {
-	HashKey() HashKey
-}
-
-func (i *Integer) HashKey() HashKey {
-	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
+	return HashKey{Type: f.Type(), Value: math.Float64bits(f.Value)}
 }
 
 func (b *Boolean) HashKey() HashKey {
@@ -248,12 +304,44 @@ func (s *String) HashKey() HashKey {
 
 type CompiledFunction struct {
 	Instructions  code.Instructions
-	NumLocals     int // 反馈函数有多少个局部绑定
-	NumParameters int
+	NumLocals     int            // 反馈函数有多少个局部绑定
+	NumParameters int            // 不包括剩余参数
+	NumDefaults   int            // 有默认值的参数个数,它们总是在最后
+	Variadic      bool           // 是否有剩余参数,剩余参数是NumParameters之后的局部变量
+	Lines         code.LineTable // 指令对应的源码位置,用于运行时错误
+	Name          string         // 函数名,来自fn声明或者定义函数的let语句,匿名函数为空
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
 func (cf *CompiledFunction) Inspect() string {
+	if cf.Name != "" {
+		return fmt.Sprintf("CompiledFunction[%s]", cf.Name)
+	}
 	return fmt.Sprintf("CompiledFunction[%p]", cf)
 }
 func (cf *CompiledFunction) ToBoolean() bool { return true }
+
+// Closure 闭包,虚拟机中所有函数调用都通过闭包完成
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []*Cell // 创建闭包时捕获的自由变量
+}
+
+func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
+func (c *Closure) Inspect() string {
+	if c.Fn.Name != "" {
+		return fmt.Sprintf("Closure[%s]", c.Fn.Name)
+	}
+	return fmt.Sprintf("Closure[%p]", c)
+}
+func (c *Closure) ToBoolean() bool { return true }
+
+// Cell 被闭包捕获的变量,外层函数和所有捕获它的闭包共用同一个Cell,
+// 任何一方的赋值其他方都能看到,与解释器中共用同一个环境的行为一致
+type Cell struct {
+	Value Object
+}
+
+func (c *Cell) Type() ObjectType { return CELL_OBJ }
+func (c *Cell) Inspect() string  { return c.Value.Inspect() }
+func (c *Cell) ToBoolean() bool  { return c.Value.ToBoolean() }
@@ -1,8 +1,11 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"math/big"
 	"strconv"
+	"strings"
 
 	"my.com/myfile/ast"
 	"my.com/myfile/lexer"
@@ -13,19 +16,26 @@ import (
 const (
 	_           int = iota //_ int = iota 表示从0开始自增
 	LOWEST                 //
-	EQUALS                 // ==
-	LESSGREATER            // > or < or <= or >=
+	ASSIGN                 // =
 	LOGIGACLOR             //||
 	LOGIGALAND             //&&
+	EQUALS                 // ==
+	LESSGREATER            // > or < or <= or >=
+	BITOR                  // |
+	BITXOR                 // ^
+	BITAND                 // &
+	SHIFT                  // << or >>
 	SUM                    // +
-	PRODUCT                // *
-	PREFIX                 // -X or !X
+	PRODUCT                // * or / or %
+	PREFIX                 // -X or !X or ~X
+	POWER                  // **,比前缀运算符优先,-2 ** 2为-(2 ** 2)
 	CALL                   // myFunction(X)
 	INDEX
 )
 
 // 让优先级与token类型相匹配
 var precedences = map[token.TokenType]int{
+	token.ASSIGN:   ASSIGN,
 	token.EQ:       EQUALS,
 	token.NOT_EQ:   EQUALS,
 	token.LT:       LESSGREATER,
@@ -36,6 +46,13 @@ var precedences = map[token.TokenType]int{
 	token.MINUS:    SUM,
 	token.SLASH:    PRODUCT,
 	token.ASTERISK: PRODUCT,
+	token.PERCENT:  PRODUCT,
+	token.POWER:    POWER,
+	token.BIT_AND:  BITAND,
+	token.BIT_OR:   BITOR,
+	token.BIT_XOR:  BITXOR,
+	token.SHL:      SHIFT,
+	token.SHR:      SHIFT,
 	token.LPAREN:   CALL,
 	token.LBRACKET: INDEX,
 	token.OR:       LOGIGACLOR,
@@ -48,12 +65,15 @@ type (
 ) //其中ast.Expression是一个接口
 
 type Parser struct { //parser结构体
-	l      *lexer.Lexer //指向Lexer结构体的指针
-	errors []string     //储存解析过程中的错误信息
+	l      *lexer.Lexer  //指向Lexer结构体的指针
+	errors []*ParseError //储存解析过程中的错误信息
 
 	curToken  token.Token //当前的token
 	peekToken token.Token //预览token来进一步判断
 
+	curDoc  []string //curToken前面的文档注释
+	peekDoc []string //peekToken前面的文档注释
+
 	prefixParseFns map[token.TokenType]prefixParseFn //储存前缀表达式相关的解析函数
 	infixParseFns  map[token.TokenType]infixParseFn  //...后缀...
 }
@@ -61,28 +81,40 @@ type Parser struct { //parser结构体
 func New(l *lexer.Lexer) *Parser { //返回一个parser结构体
 	p := &Parser{ //定义p为一个Parser结构体
 		l:      l,
-		errors: []string{},
+		errors: []*ParseError{},
 	}
 
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn) //make()函数被用来创建一个空的映射，其中键的类型是token.TokenType，值的类型是prefixParseFn
 	p.registerPrefix(token.ID, p.parseIdentifier)              //定义了对于不同类型的Token需要使用怎样的解析函数，ID的解析函数
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
+	p.registerPrefix(token.BIT_NOT, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
 	p.registerPrefix(token.FALSE, p.parseBoolean)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.IF, p.parseIfExpression)
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
+	p.registerPrefix(token.TEMPLATE, p.parseTemplateLiteral)
 	p.registerPrefix(token.WHILE, p.parseWhileExpression)
 	p.registerPrefix(token.FOR, p.parserForExpression)
+	p.registerPrefix(token.TRY, p.parseTryExpression)
+	p.registerPrefix(token.MATCH, p.parseMatchExpression)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
 	p.registerInfix(token.MINUS, p.parseInfixExpression)
 	p.registerInfix(token.SLASH, p.parseInfixExpression)
 	p.registerInfix(token.ASTERISK, p.parseInfixExpression)
+	p.registerInfix(token.PERCENT, p.parseInfixExpression)
+	p.registerInfix(token.POWER, p.parseInfixExpression)
+	p.registerInfix(token.BIT_AND, p.parseInfixExpression)
+	p.registerInfix(token.BIT_OR, p.parseInfixExpression)
+	p.registerInfix(token.BIT_XOR, p.parseInfixExpression)
+	p.registerInfix(token.SHL, p.parseInfixExpression)
+	p.registerInfix(token.SHR, p.parseInfixExpression)
 	p.registerInfix(token.EQ, p.parseInfixExpression)
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
@@ -91,7 +123,7 @@ func New(l *lexer.Lexer) *Parser { //返回一个parser结构体
 	p.registerInfix(token.GE, p.parseInfixExpression)
 	p.registerInfix(token.AND, p.parseInfixExpression)
 	p.registerInfix(token.OR, p.parseInfixExpression)
-	//p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
 
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
@@ -108,6 +140,13 @@ func New(l *lexer.Lexer) *Parser { //返回一个parser结构体
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken      //让curToken往前移
 	p.peekToken = p.l.NextToken() //调用了lexer的NextToken方法，不准确地说，就是通过p访问l，再通过l的NextToken方法创建token，使用这种方法tokens不会保留
+
+	p.curDoc = p.peekDoc
+	p.peekDoc = nil
+	for p.peekToken.Type == token.DOC { //文档注释不参与语法分析，记录下来交给后面的语句
+		p.peekDoc = append(p.peekDoc, p.peekToken.Literal)
+		p.peekToken = p.l.NextToken()
+	}
 }
 
 func (p *Parser) curTokenIs(t token.TokenType) bool { //匹配token类型
@@ -128,20 +167,56 @@ func (p *Parser) expectPeek(t token.TokenType) bool { //匹配token类型
 	}
 }
 
+// ParseError 语法错误,记录出错token的位置
+type ParseError struct {
+	Pos     token.Position
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	if !e.Pos.IsValid() {
+		return e.Message
+	}
+	return e.Pos.String() + ": " + e.Message
+}
+
 // 下面定义了几种类型的错误
-func (p *Parser) Errors() []string {
+func (p *Parser) Errors() []string { //带有位置前缀的错误信息
+	msgs := make([]string, len(p.errors))
+	for i, e := range p.errors {
+		msgs[i] = e.Error()
+	}
+	return msgs
+}
+
+func (p *Parser) ParseErrors() []*ParseError { //返回结构化的错误,用于打印出错的源码
 	return p.errors
 }
 
+func (p *Parser) addError(pos token.Position, msg string) {
+	if n := len(p.errors); n > 0 && p.errors[n-1].Pos == pos { //同一位置的后续错误通常是前一个错误引起的
+		return
+	}
+	p.errors = append(p.errors, &ParseError{Pos: pos, Message: msg})
+}
+
 func (p *Parser) peekError(t token.TokenType) {
+	if p.peekTokenIs(token.ILLEGAL) { //词法错误,token的内容就是错误信息
+		p.addError(p.peekToken.Pos, p.peekToken.Literal)
+		return
+	}
 	msg := fmt.Sprintf("expected next token to be %s, got %s instead",
 		t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	p.addError(p.peekToken.Pos, msg)
 }
 
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
+	if t == token.ILLEGAL {
+		p.addError(p.curToken.Pos, p.curToken.Literal)
+		return
+	}
 	msg := fmt.Sprintf("no prefix parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+	p.addError(p.curToken.Pos, msg)
 }
 
 func (p *Parser) ParseProgram() *ast.Program {
@@ -169,34 +244,157 @@ func (p *Parser) parseStatement() ast.Statement { //判断应该返回什么类
 		return p.parseBreakStatement()
 	case token.CONTINUE:
 		return p.parseContinueStatement()
+	case token.THROW:
+		return p.parseThrowStatement()
+	case token.FUNCTION:
+		if p.peekTokenIs(token.ID) { //fn后面紧跟名字的是函数声明,否则是函数字面量
+			return p.parseFunctionStatement()
+		}
+		return p.parseExpressionStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
 }
 
 func (p *Parser) parseLetStatement() *ast.LetStatement {
-	stmt := &ast.LetStatement{Token: p.curToken, Index: ""} //p.curToken应该是Let
+	stmt := &ast.LetStatement{Token: p.curToken, Doc: strings.Join(p.curDoc, "\n")} //p.curToken应该是Let
 
-	if !p.expectPeek(token.ID) {
+	if p.peekTokenIs(token.LBRACKET) || p.peekTokenIs(token.LBRACE) { //解构赋值 let [a, b] = arr; let {name} = hash;
+		p.nextToken()
+		stmt.Pattern = p.parsePattern(false)
+		if stmt.Pattern == nil {
+			return nil
+		}
+	} else {
+		if !p.expectPeek(token.ID) {
+			return nil
+		}
+		stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal} //ID名称
+	}
+	if !p.expectPeek(token.ASSIGN) {
 		return nil
 	}
-	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal} //ID名称
-	if p.peekTokenIs(token.LBRACKET) {
+
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST) //ID的值
+
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok && stmt.Name != nil { //记录函数名,用于运行时错误的调用栈
+		fl.Name = stmt.Name.Value
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
-		if p.expectPeek(token.INT) {
-			if p.peekTokenIs(token.RBRACKET) {
-				stmt.Index = p.curToken.Literal
-				p.nextToken()
+	}
+
+	return stmt
+}
+
+// parsePattern 解析解构模式中的一项,当前token为变量名、[或者{
+// literals为true时是match的模式,还可以是数字、字符串和布尔值字面量
+func (p *Parser) parsePattern(literals bool) ast.Expression {
+	switch p.curToken.Type {
+	case token.ID:
+		return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	case token.LBRACKET:
+		return p.parseArrayPattern(literals)
+	case token.LBRACE:
+		return p.parseHashPattern(literals)
+	case token.INT, token.FLOAT, token.STRING, token.TRUE, token.FALSE:
+		if literals {
+			return p.prefixParseFns[p.curToken.Type]()
+		}
+	case token.MINUS: // 负数
+		if literals && (p.peekTokenIs(token.INT) || p.peekTokenIs(token.FLOAT)) {
+			return p.parsePrefixExpression()
+		}
+	}
+	p.addError(p.curToken.Pos, fmt.Sprintf("expected identifier or pattern, got %s instead", p.curToken.Type))
+	return nil
+}
+
+func (p *Parser) parseArrayPattern(literals bool) ast.Expression { // [a, [b, c], ...rest],剩余元素的变量只能在最后
+	pattern := &ast.ArrayPattern{Token: p.curToken}
+
+	for !p.peekTokenIs(token.RBRACKET) {
+		if p.peekTokenIs(token.ELLIPSIS) {
+			p.nextToken()
+			if !p.expectPeek(token.ID) {
+				return nil
+			}
+			pattern.Rest = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			break
+		}
+
+		p.nextToken()
+		el := p.parsePattern(literals)
+		if el == nil {
+			return nil
+		}
+		pattern.Elements = append(pattern.Elements, el)
+
+		if !p.peekTokenIs(token.COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+
+	if !p.expectPeek(token.RBRACKET) {
+		return nil
+	}
+	return pattern
+}
+
+func (p *Parser) parseHashPattern(literals bool) ast.Expression { // {name, age: years, "key": value},键是变量名或者字符串
+	pattern := &ast.HashPattern{Token: p.curToken}
+
+	for !p.peekTokenIs(token.RBRACE) {
+		p.nextToken()
+		if !p.curTokenIs(token.ID) && !p.curTokenIs(token.STRING) {
+			p.addError(p.curToken.Pos, fmt.Sprintf("expected identifier or string key, got %s instead", p.curToken.Type))
+			return nil
+		}
+		pair := ast.HashPatternPair{Key: &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}}
+
+		if p.curTokenIs(token.ID) && !p.peekTokenIs(token.COLON) { //简写,变量名与键相同
+			pair.Value = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		} else {
+			if !p.expectPeek(token.COLON) {
+				return nil
 			}
+			p.nextToken()
+			pair.Value = p.parsePattern(literals)
+			if pair.Value == nil {
+				return nil
+			}
+		}
+		pattern.Pairs = append(pattern.Pairs, pair)
+
+		if !p.peekTokenIs(token.COMMA) {
+			break
 		}
+		p.nextToken()
 	}
-	if !p.expectPeek(token.ASSIGN) {
+
+	if !p.expectPeek(token.RBRACE) {
 		return nil
 	}
+	return pattern
+}
+
+func (p *Parser) parseFunctionStatement() ast.Statement { //函数声明 fn name(params) { body }
+	stmt := &ast.FunctionStatement{Token: p.curToken, Doc: strings.Join(p.curDoc, "\n")}
 
 	p.nextToken()
+	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 
-	stmt.Value = p.parseExpression(LOWEST) //ID的值
+	fn, ok := p.parseFunctionLiteral().(*ast.FunctionLiteral) //从名字开始解析,与函数字面量的(params) { body }相同
+	if !ok {
+		return nil
+	}
+	fn.Token = stmt.Token
+	fn.Name = stmt.Name.Value
+	stmt.Function = fn
 
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
@@ -238,6 +436,23 @@ func (p *Parser) parseContinueStatement() *ast.ContinueStatement { //继续语
 	return stmt
 }
 
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement { //抛出异常
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement { //创建表达式结构体
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 
@@ -296,9 +511,30 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
+	if errors.Is(err, strconv.ErrRange) { //超出int64范围的整数用big.Int保存
+		if bigValue, ok := new(big.Int).SetString(p.curToken.Literal, 0); ok {
+			lit.Big = bigValue
+			return lit
+		}
+	}
 	if err != nil {
 		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.addError(p.curToken.Pos, msg)
+		return nil
+	}
+
+	lit.Value = value
+
+	return lit
+}
+
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+
+	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse %q as float", p.curToken.Literal)
+		p.addError(p.curToken.Pos, msg)
 		return nil
 	}
 
@@ -328,12 +564,34 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression { //
 	}
 
 	precedence := p.curPrecedence() //返回当前Token的优先级给parseExpression判断
+	if p.curTokenIs(token.POWER) {  //**是右结合的,右边遇到同样优先级的**时继续向右结合
+		precedence--
+	}
 	p.nextToken()
 	expression.Right = p.parseExpression(precedence)
 
 	return expression
 }
 
+func (p *Parser) parseAssignExpression(target ast.Expression) ast.Expression { //处理赋值表达式
+	expression := &ast.AssignExpression{Token: p.curToken, Target: target}
+
+	switch target.(type) {
+	case *ast.Identifier, *ast.IndexExpression:
+	case nil: //左边的表达式解析失败,错误已经记录
+		return nil
+	default:
+		msg := fmt.Sprintf("invalid assignment target %s", target.String())
+		p.addError(target.Pos(), msg)
+		return nil
+	}
+
+	p.nextToken()
+	expression.Value = p.parseExpression(ASSIGN - 1) //赋值是右结合的,a = b = 1等价于a = (b = 1)
+
+	return expression
+}
+
 func (p *Parser) parseBoolean() ast.Expression { //处理布尔值
 	return &ast.Boolean{Token: p.curToken, Value: p.curTokenIs(token.TRUE)}
 }
@@ -383,6 +641,59 @@ func (p *Parser) parseIfExpression() ast.Expression { //处理if语句
 	return expression
 }
 
+func (p *Parser) parseMatchExpression() ast.Expression { // match subject { pattern if guard => result, ... }
+	expression := &ast.MatchExpression{Token: p.curToken}
+
+	p.nextToken()
+	expression.Subject = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	for !p.peekTokenIs(token.RBRACE) {
+		p.nextToken()
+		arm := ast.MatchArm{Pattern: p.parsePattern(true)}
+		if arm.Pattern == nil {
+			return nil
+		}
+
+		if p.peekTokenIs(token.IF) {
+			p.nextToken()
+			p.nextToken()
+			arm.Guard = p.parseExpression(LOWEST)
+		}
+
+		if !p.expectPeek(token.ARROW) {
+			return nil
+		}
+		p.nextToken()
+
+		if p.curTokenIs(token.LBRACE) { //分支的结果是语句块,之后的逗号可以省略
+			arm.Body = p.parseBlockStatement()
+			expression.Arms = append(expression.Arms, arm)
+			if p.peekTokenIs(token.COMMA) {
+				p.nextToken()
+			}
+			continue
+		}
+
+		body := &ast.ExpressionStatement{Token: p.curToken, Expression: p.parseExpression(LOWEST)}
+		arm.Body = &ast.BlockStatement{Token: body.Token, Statements: []ast.Statement{body}}
+		expression.Arms = append(expression.Arms, arm)
+
+		if !p.peekTokenIs(token.COMMA) { //结果是表达式时,分支之间必须用逗号分隔
+			break
+		}
+		p.nextToken()
+	}
+
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+	return expression
+}
+
 func (p *Parser) parseBlockStatement() *ast.BlockStatement { //块的解析函数
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = []ast.Statement{}
@@ -407,7 +718,9 @@ func (p *Parser) parseFunctionLiteral() ast.Expression { //处理函数的定义
 		return nil
 	}
 
-	lit.Parameters = p.parseFunctionParameters()
+	if !p.parseFunctionParameters(lit) {
+		return nil
+	}
 
 	if !p.expectPeek(token.LBRACE) {
 		return nil
@@ -418,31 +731,74 @@ func (p *Parser) parseFunctionLiteral() ast.Expression { //处理函数的定义
 	return lit
 }
 
-func (p *Parser) parseFunctionParameters() []*ast.Identifier { //处理函数的参数
-	identifiers := []*ast.Identifier{}
+// parseFunctionParameters 处理函数的参数,例如 (x, y = 10, ...rest)
+// 有默认值的参数必须在没有默认值的参数之后,剩余参数必须是最后一个
+func (p *Parser) parseFunctionParameters(fl *ast.FunctionLiteral) bool {
+	fl.Parameters = []*ast.Identifier{}
 
 	if p.peekTokenIs(token.RPAREN) {
 		p.nextToken()
-		return identifiers
+		return true
 	}
 
-	p.nextToken()
+	for {
+		if p.peekTokenIs(token.ELLIPSIS) { // 剩余参数之后只能是)
+			p.nextToken()
+			if !p.expectPeek(token.ID) {
+				return false
+			}
+			fl.Rest = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			return p.expectPeek(token.RPAREN)
+		}
 
-	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-	identifiers = append(identifiers, ident)
+		var ident *ast.Identifier
+		if p.peekTokenIs(token.LBRACKET) || p.peekTokenIs(token.LBRACE) { //解构参数,用参数的位置作为参数名,它不是合法的标识符,不会与其他变量重名
+			p.nextToken()
+			tok := p.curToken
+			pattern := p.parsePattern(false)
+			if pattern == nil {
+				return false
+			}
+			ident = &ast.Identifier{Token: tok, Value: "#" + strconv.Itoa(len(fl.Parameters))}
+			if fl.Patterns == nil {
+				fl.Patterns = make([]ast.Expression, len(fl.Parameters))
+			}
+			fl.Patterns = append(fl.Patterns, pattern)
+		} else {
+			if !p.expectPeek(token.ID) {
+				return false
+			}
+			ident = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			if fl.Patterns != nil {
+				fl.Patterns = append(fl.Patterns, nil)
+			}
+		}
+		fl.Parameters = append(fl.Parameters, ident)
+
+		var def ast.Expression
+		if p.peekTokenIs(token.ASSIGN) {
+			p.nextToken()
+			p.nextToken()
+			def = p.parseExpression(LOWEST)
+			if def == nil {
+				return false
+			}
+			if fl.Defaults == nil {
+				fl.Defaults = make([]ast.Expression, len(fl.Parameters)-1)
+			}
+		} else if fl.Defaults != nil {
+			p.addError(ident.Pos(), fmt.Sprintf("parameter %s without default value follows parameter with default value", ident.Value))
+			return false
+		}
+		if fl.Defaults != nil {
+			fl.Defaults = append(fl.Defaults, def)
+		}
 
-	for p.peekTokenIs(token.COMMA) {
-		p.nextToken()
+		if !p.peekTokenIs(token.COMMA) {
+			return p.expectPeek(token.RPAREN)
+		}
 		p.nextToken()
-		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-		identifiers = append(identifiers, ident)
-	}
-
-	if !p.expectPeek(token.RPAREN) {
-		return nil
 	}
-
-	return identifiers
 }
 
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
@@ -488,7 +844,7 @@ func (p *Parser) parserForExpression() ast.Expression { //处理for循环
 	if !p.peekTokenIs(token.COLON) { //匹配冒号
 		//如果匹配失败，则初始化
 		p.nextToken() //跳过for
-		exp.Initialize = p.parseLetStatement()
+		exp.Initialize = p.parseStatement()
 		if !p.expectPeek(token.COLON) { //继续匹配冒号
 			return nil
 		}
@@ -504,7 +860,7 @@ func (p *Parser) parserForExpression() ast.Expression { //处理for循环
 		return nil
 	}
 	p.nextToken()
-	exp.Cycleop = p.parseLetStatement()
+	exp.Cycleop = p.parseStatement() //循环操作可以是let语句或者赋值表达式
 	if !p.expectPeek(token.LBRACE) {
 		return nil
 	}
@@ -536,10 +892,81 @@ func (p *Parser) parseWhileExpression() ast.Expression { //处理While循环
 	return exp
 }
 
+func (p *Parser) parseTryExpression() ast.Expression { //处理try/catch/finally
+	exp := &ast.TryExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	exp.Body = p.parseBlockStatement()
+
+	if p.peekTokenIs(token.CATCH) {
+		p.nextToken()
+
+		if p.peekTokenIs(token.LPAREN) { //catch的参数可以省略
+			p.nextToken()
+			if !p.expectPeek(token.ID) {
+				return nil
+			}
+			exp.CatchParam = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			if !p.expectPeek(token.RPAREN) {
+				return nil
+			}
+		}
+
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		exp.Catch = p.parseBlockStatement()
+	}
+
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		exp.Finally = p.parseBlockStatement()
+	}
+
+	if exp.Catch == nil && exp.Finally == nil {
+		p.addError(exp.Token.Pos, "expected catch or finally after try block")
+		return nil
+	}
+
+	return exp
+}
+
 func (p *Parser) parseStringLiteral() ast.Expression {
 	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
 
+func (p *Parser) parseTemplateLiteral() ast.Expression { //字符串插值,TEMPLATE和TEMPLATE_END之间交替出现字符串片段和插值表达式
+	template := &ast.TemplateLiteral{Token: p.curToken}
+
+	for {
+		if p.curToken.Literal != "" {
+			template.Parts = append(template.Parts, &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal})
+		}
+		if p.curTokenIs(token.TEMPLATE_END) {
+			return template
+		}
+
+		p.nextToken()
+		expr := p.parseExpression(LOWEST)
+		if expr == nil {
+			return nil
+		}
+		template.Parts = append(template.Parts, expr)
+
+		if !p.peekTokenIs(token.TEMPLATE) && !p.peekTokenIs(token.TEMPLATE_END) { //插值表达式之后必须是结束它的}
+			p.peekError(token.RBRACE)
+			return nil
+		}
+		p.nextToken()
+	}
+}
+
 func (p *Parser) parseArrayLiteral() ast.Expression {
 	array := &ast.ArrayLiteral{Token: p.curToken}
 	array.Elements = p.parseExpressionList(token.RBRACKET)
@@ -553,11 +980,11 @@ func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 		return list
 	}
 	p.nextToken()
-	list = append(list, p.parseExpression(LOWEST))
+	list = append(list, p.parseListElement())
 	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
 		p.nextToken()
-		list = append(list, p.parseExpression(LOWEST))
+		list = append(list, p.parseListElement())
 	}
 	if !p.expectPeek(end) {
 		return nil
@@ -565,6 +992,20 @@ func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 	return list
 }
 
+func (p *Parser) parseListElement() ast.Expression { //调用参数和数组元素,可以是展开的数组 ...arr
+	if !p.curTokenIs(token.ELLIPSIS) {
+		return p.parseExpression(LOWEST)
+	}
+
+	spread := &ast.SpreadExpression{Token: p.curToken}
+	p.nextToken()
+	spread.Value = p.parseExpression(LOWEST)
+	if spread.Value == nil {
+		return nil
+	}
+	return spread
+}
+
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
 
@@ -580,7 +1021,7 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 
 func (p *Parser) parseHashLiteral() ast.Expression {
 	hash := &ast.HashLiteral{Token: p.curToken}
-	hash.Pairs = make(map[ast.Expression]ast.Expression)
+	hash.Pairs = []ast.HashLiteralPair{}
 
 	for !p.peekTokenIs(token.RBRACE) {
 		p.nextToken()
@@ -593,7 +1034,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 		p.nextToken()
 		value := p.parseExpression(LOWEST)
 
-		hash.Pairs[key] = value
+		hash.Pairs = append(hash.Pairs, ast.HashLiteralPair{Key: key, Value: value})
 
 		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
 			return nil
@@ -0,0 +1,86 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"my.com/myfile/compiler"
+	"my.com/myfile/parser"
+	"my.com/myfile/token"
+	"my.com/myfile/vm"
+)
+
+// FormatError 生成带位置的错误信息,并摘录出错的源码行,在下一行用^标出出错的列
+//
+//	in[1]:2:9: undefined variable y
+//	   2 | let x = y + 1;
+//	     |         ^
+func FormatError(source string, pos token.Position, msg string) string {
+	if !pos.IsValid() {
+		return msg + "\n"
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s: %s\n", pos, msg)
+
+	lines := strings.Split(source, "\n")
+	if pos.Line > len(lines) { // 没有对应的源码时只输出错误信息
+		return out.String()
+	}
+
+	line := strings.TrimRight(lines[pos.Line-1], "\r")
+	gutter := fmt.Sprintf("%4d | ", pos.Line)
+	out.WriteString(gutter + line + "\n")
+	out.WriteString(strings.Repeat(" ", len(gutter)-2) + "| ")
+
+	column := 1
+	for _, ch := range line { // 保留制表符并考虑中文等宽字符,使^与出错的字符对齐
+		if column >= pos.Column {
+			break
+		}
+		switch {
+		case ch == '\t':
+			out.WriteRune('\t')
+		case isWide(ch):
+			out.WriteString("  ")
+		default:
+			out.WriteRune(' ')
+		}
+		column++
+	}
+	out.WriteString("^\n")
+
+	return out.String()
+}
+
+func isWide(ch rune) bool { // 判断字符在终端中是否占两列
+	return unicode.In(ch, unicode.Han, unicode.Hangul, unicode.Hiragana, unicode.Katakana) ||
+		ch >= 0x3000 && ch <= 0x303F || // 中文标点
+		ch >= 0xFF01 && ch <= 0xFF60 // 全角字符
+}
+
+// PrintError 输出错误,sources保存文件名到源码的映射,用于摘录出错的源码
+func PrintError(out io.Writer, sources map[string]string, err error) {
+	var (
+		parseErr   *parser.ParseError
+		compileErr *compiler.CompileError
+		runtimeErr *vm.RuntimeError
+	)
+
+	switch {
+	case errors.As(err, &parseErr):
+		io.WriteString(out, FormatError(sources[parseErr.Pos.File], parseErr.Pos, parseErr.Message))
+	case errors.As(err, &compileErr):
+		io.WriteString(out, FormatError(sources[compileErr.Pos.File], compileErr.Pos, compileErr.Message))
+	case errors.As(err, &runtimeErr):
+		io.WriteString(out, FormatError(sources[runtimeErr.Pos.File], runtimeErr.Pos, runtimeErr.Message))
+		if len(runtimeErr.Trace) > 1 { // 错误发生在函数中时才显示调用栈
+			io.WriteString(out, runtimeErr.StackTrace())
+		}
+	default:
+		io.WriteString(out, err.Error()+"\n")
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	"my.com/myfile/code"
 	"my.com/myfile/compiler"
+	"my.com/myfile/evaluator"
 	"my.com/myfile/lexer"
 	"my.com/myfile/object"
 	"my.com/myfile/parser"
@@ -18,7 +19,20 @@ import (
 const PROMPT = ">> "
 const MULTILINE_PROMPT = "... "
 
+// Engine 执行程序使用的引擎
+type Engine string
+
+const (
+	EngineVM   Engine = "vm"   // 编译为字节码后由虚拟机执行
+	EngineEval Engine = "eval" // 直接遍历抽象语法树求值
+)
+
 func Start(in io.Reader, out io.Writer) {
+	StartWithEngine(in, out, EngineVM)
+}
+
+// StartWithEngine 启动交互式环境,engine决定输入的代码由虚拟机还是解释器执行
+func StartWithEngine(in io.Reader, out io.Writer, engine Engine) {
 	scanner := bufio.NewScanner(in)
 	var input strings.Builder
 
@@ -28,6 +42,8 @@ func Start(in io.Reader, out io.Writer) {
 	for i, v := range object.Builtins {
 		symbolTable.DefineBuiltin(i, v.Name)
 	}
+	sources := map[string]string{} // 保存每次输入的源码,运行时错误可能发生在之前输入定义的函数中
+	env := object.NewEnvironment()
 
 	fmt.Fprintf(out, PROMPT)
 	for scanner.Scan() {
@@ -35,7 +51,13 @@ func Start(in io.Reader, out io.Writer) {
 		input.WriteString(line + "\n")
 
 		if isCompleteInput(input.String()) {
-			processInput(input.String(), out, &constants, globals, symbolTable)
+			name := fmt.Sprintf("in[%d]", len(sources)+1)
+			sources[name] = input.String()
+			if engine == EngineEval && !isDisassembleCommand(input.String()) {
+				handleEvalCommand(input.String(), name, out, env, sources)
+			} else {
+				processInput(input.String(), name, out, &constants, globals, symbolTable, sources)
+			}
 			input.Reset()
 			fmt.Fprintf(out, PROMPT)
 		} else {
@@ -47,10 +69,10 @@ func Start(in io.Reader, out io.Writer) {
 		fmt.Fprintf(out, "error: %v\n", err)
 	}
 }
-func printParserErrors(out io.Writer, errors []string) { //错误输出
+func printParserErrors(out io.Writer, sources map[string]string, errors []*parser.ParseError) { //错误输出
 	io.WriteString(out, " parser errors:\n")
-	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\n")
+	for _, err := range errors {
+		PrintError(out, sources, err)
 	}
 }
 
@@ -86,11 +108,11 @@ func isCompleteInput(input string) bool {
 	return openBraces == 0 && openParens == 0
 }
 
-func processInput(input string, out io.Writer, constants *[]object.Object, globals []object.Object, symbolTable *compiler.SymbolTable) {
+func processInput(input string, name string, out io.Writer, constants *[]object.Object, globals []object.Object, symbolTable *compiler.SymbolTable, sources map[string]string) {
 	if isDisassembleCommand(input) {
 		handleDisassembleCommand(input, out)
 	} else {
-		handleNormalCommand(input, out, constants, globals, symbolTable)
+		handleNormalCommand(input, name, out, constants, globals, symbolTable, sources)
 	}
 }
 
@@ -98,13 +120,13 @@ func isDisassembleCommand(input string) bool {
 	return strings.HasPrefix(strings.TrimSpace(input), "dis(") && strings.HasSuffix(strings.TrimSpace(input), ")")
 }
 
-func handleNormalCommand(input string, out io.Writer, constants *[]object.Object, globals []object.Object, symbolTable *compiler.SymbolTable) {
-	l := lexer.New(input)
+func handleNormalCommand(input string, name string, out io.Writer, constants *[]object.Object, globals []object.Object, symbolTable *compiler.SymbolTable, sources map[string]string) {
+	l := lexer.NewWithFile(input, name)
 	p := parser.New(l)
 	program := p.ParseProgram()
 
 	if len(p.Errors()) != 0 {
-		printParserErrors(out, p.Errors())
+		printParserErrors(out, sources, p.ParseErrors())
 		return
 	}
 
@@ -112,7 +134,8 @@ func handleNormalCommand(input string, out io.Writer, constants *[]object.Object
 	comp := compiler.NewWithState(symbolTable, *constants)
 	err := comp.Compile(program)
 	if err != nil {
-		fmt.Fprintf(out, "编译失败:\n %s\n", err)
+		fmt.Fprintf(out, "编译失败:\n")
+		PrintError(out, sources, err)
 		return
 	}
 
@@ -122,7 +145,8 @@ func handleNormalCommand(input string, out io.Writer, constants *[]object.Object
 	machine := vm.NewWithGlobalsStore(code, globals)
 	err = machine.Run()
 	if err != nil {
-		fmt.Fprintf(out, "执行失败\n %s\n", err)
+		fmt.Fprintf(out, "执行失败:\n")
+		PrintError(out, sources, err)
 		return
 	}
 
@@ -133,6 +157,29 @@ func handleNormalCommand(input string, out io.Writer, constants *[]object.Object
 	}
 }
 
+func handleEvalCommand(input string, name string, out io.Writer, env *object.Environment, sources map[string]string) { // 使用解释器执行输入
+	l := lexer.NewWithFile(input, name)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+		printParserErrors(out, sources, p.ParseErrors())
+		return
+	}
+
+	evaluated := evaluator.Eval(program, env)
+	if errObj, ok := evaluated.(*object.Error); ok {
+		fmt.Fprintf(out, "执行失败:\n")
+		io.WriteString(out, FormatError(sources[errObj.Pos.File], errObj.Pos, errObj.Message))
+		return
+	}
+
+	if evaluated != nil {
+		io.WriteString(out, evaluated.Inspect())
+		io.WriteString(out, "\n")
+	}
+}
+
 func handleDisassembleCommand(input string, out io.Writer) {
 	codeStr := extractCodeFromDisCommand(input)
 	if codeStr == "" {
@@ -143,25 +190,28 @@ func handleDisassembleCommand(input string, out io.Writer) {
 	l := lexer.New(codeStr)
 	p := parser.New(l)
 	program := p.ParseProgram()
+	sources := map[string]string{"": codeStr}
 
 	if len(p.Errors()) != 0 {
-		printParserErrors(out, p.Errors())
+		printParserErrors(out, sources, p.ParseErrors())
 		return
 	}
 
 	comp := compiler.New()
 	err := comp.Compile(program)
 	if err != nil {
-		fmt.Fprintf(out, "编译失败:\n %s\n", err)
+		fmt.Fprintf(out, "编译失败:\n")
+		PrintError(out, sources, err)
 		return
 	}
 
 	bytecode := comp.Bytecode()
-	disassembled := disassemble(bytecode)
+	disassembled := Disassemble(bytecode)
 	fmt.Fprintf(out, "字节码反汇编:\n%s\n", disassembled)
 }
 
-func disassemble(bytecode *compiler.Bytecode) string {
+// Disassemble 返回字节码的可读形式,常量池中的函数会同时列出其指令
+func Disassemble(bytecode *compiler.Bytecode) string {
 	var out strings.Builder
 
 	out.WriteString("Instructions:\n")
@@ -169,7 +219,18 @@ func disassemble(bytecode *compiler.Bytecode) string {
 	out.WriteString("\nConstants:\n")
 
 	for i, constant := range bytecode.Constants {
-		out.WriteString(fmt.Sprintf("%04d %s\n", i, constant.Inspect()))
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			out.WriteString(fmt.Sprintf("%04d %s\n", i, constant.Inspect()))
+			continue
+		}
+
+		out.WriteString(fmt.Sprintf("%04d CompiledFunction (params=%d, locals=%d)\n", i, fn.NumParameters, fn.NumLocals))
+		for _, line := range strings.SplitAfter(formatInstructions(fn.Instructions), "\n") {
+			if line != "" {
+				out.WriteString("     " + line)
+			}
+		}
 	}
 
 	return out.String()
@@ -192,6 +253,8 @@ func formatInstruction(def *code.Definition, operands []int) string {
 		return def.Name
 	case 1:
 		return fmt.Sprintf("%s %d", def.Name, operands[0])
+	case 2:
+		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
 	}
 
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
@@ -205,7 +268,7 @@ func formatInstructions(ins code.Instructions) string {
 		def, err := code.Lookup(ins[i])
 		if err != nil {
 			fmt.Fprintf(&out, "ERROR: %s\n", err)
-			continue
+			break
 		}
 
 		operands, read := code.ReadOperands(def, ins[i+1:])
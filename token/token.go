@@ -1,10 +1,38 @@
 package token
 
+import "fmt"
+
 type TokenType string
 
 type Token struct {
 	Type    TokenType //token的类型
 	Literal string    //token的值
+	Pos     Position  //token第一个字符在源码中的位置
+}
+
+// Position 源码中的位置,行号和列号都从1开始,列号按字符而不是字节计算
+type Position struct {
+	File   string //文件名,交互式输入时可以为空
+	Line   int
+	Column int
+}
+
+// IsValid 判断位置是否有效,手动构造的token没有位置信息
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	if !p.IsValid() {
+		if p.File != "" {
+			return p.File
+		}
+		return "-"
+	}
+	if p.File != "" {
+		return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
 }
 
 const (
@@ -16,12 +44,20 @@ const (
 	INT   = "INT"
 	FLOAT = "FLOAT"
 
+	// 带插值的字符串"a${x}b${y}c"依次得到TEMPLATE(a) x TEMPLATE(b) y TEMPLATE_END(c)
+	TEMPLATE     = "TEMPLATE"
+	TEMPLATE_END = "TEMPLATE_END"
+
+	DOC = "DOC" // 文档注释 /// ...
+
 	// 运算符
 	ASSIGN   = "="
 	PLUS     = "+"
 	MINUS    = "-"
 	BANG     = "!"
 	ASTERISK = "*"
+	PERCENT  = "%"
+	POWER    = "**"
 	SLASH    = "/"
 	EQ       = "=="
 	NOT_EQ   = "!="
@@ -35,10 +71,20 @@ const (
 	OR  = "||"
 	AND = "&&"
 
+	// 位运算符
+	BIT_AND = "&"
+	BIT_OR  = "|"
+	BIT_XOR = "^"
+	BIT_NOT = "~"
+	SHL     = "<<"
+	SHR     = ">>"
+
 	// 分隔符
 	COMMA     = ","
 	SEMICOLON = ";"
 	COLON     = ":"
+	ELLIPSIS  = "..." // 剩余参数和展开
+	ARROW     = "=>"  // match分支的模式与结果之间
 
 	LPAREN = "("
 	RPAREN = ")"
@@ -62,6 +108,11 @@ const (
 	WHILE    = "WHILE"
 	STRING   = "STRING"
 	FOR      = "for"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	FINALLY  = "FINALLY"
+	THROW    = "THROW"
+	MATCH    = "MATCH"
 )
 
 // 判断是否是关键字
@@ -78,6 +129,11 @@ var keywords = map[string]TokenType{
 	"continue": CONTINUE,
 	"break":    BREAK,
 	"for":      FOR,
+	"try":      TRY,
+	"catch":    CATCH,
+	"finally":  FINALLY,
+	"throw":    THROW,
+	"match":    MATCH,
 }
 
 // LookupId 查找关键字，如果不是关键字则返回ID
@@ -8,14 +8,15 @@ import (
 )
 
 type Frame struct { // 帧
-	fn          *object.CompiledFunction // 指向帧已引用的已编译函数
-	ip          int                      // 该帧指令指针
+	cl          *object.Closure // 指向帧正在执行的闭包
+	ip          int             // 该帧指令指针
 	basePointer int
+	numArgs     int // 调用时传入的参数个数,用于判断是否需要计算参数的默认值
 }
 
-func NewFrame(fn *object.CompiledFunction, basePointer int) *Frame {
+func NewFrame(cl *object.Closure, basePointer int) *Frame {
 	f := &Frame{
-		fn:          fn,
+		cl:          cl,
 		ip:          -1,
 		basePointer: basePointer, // 基指针,指向栈帧底部
 	}
@@ -24,5 +25,5 @@ func NewFrame(fn *object.CompiledFunction, basePointer int) *Frame {
 }
 
 func (f *Frame) Instructions() code.Instructions {
-	return f.fn.Instructions
+	return f.cl.Fn.Instructions
 }
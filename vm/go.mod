@@ -9,6 +9,7 @@ require (
     my.com/myfile/ast v0.0.0
     my.com/myfile/object v0.0.0
     my.com/myfile/compiler v0.0.0
+    my.com/myfile/parser v0.0.0
 )
 
 replace (
@@ -18,4 +19,5 @@ replace (
     my.com/myfile/ast => ../ast
     my.com/myfile/object => ../object
     my.com/myfile/compiler => ../compiler
+    my.com/myfile/parser => ../parser
 )
\ No newline at end of file
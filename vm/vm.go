@@ -3,10 +3,15 @@ package vm
 // 定义虚拟机
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
+	"math"
 	"my.com/myfile/code"
 	"my.com/myfile/compiler"
 	"my.com/myfile/object"
+	"my.com/myfile/token"
+	"strings"
 )
 
 const StackSize = 2048
@@ -14,9 +19,9 @@ const GlobalsSize = 65536 // 定义全局变量的数量绑定上线
 const MaxFrames = 1024
 
 // 定义全局变量True,False,Null
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
-var Null = &object.Null{}
+var True = object.TRUE
+var False = object.FALSE
+var Null = object.NULL
 
 type VM struct {
 	constants []object.Object // 常量池
@@ -28,11 +33,32 @@ type VM struct {
 
 	frames      []*Frame
 	framesIndex int
+
+	handlers []handler // OpSetupTry登记的异常处理器,最后登记的在末尾
+
+	CheckedArithmetic bool // 为true时整数运算超出int64的范围会报错,默认把结果提升为BigInteger
+}
+
+// handler 一个try的异常处理器,记录登记时的帧和栈,出错时恢复到这个状态后跳转到catch
+type handler struct {
+	catchIP     int
+	sp          int
+	framesIndex int
+}
+
+// thrownError throw抛出的值,没有被捕获时作为运行时错误报告
+type thrownError struct {
+	value object.Object
+}
+
+func (e *thrownError) Error() string {
+	return "uncaught exception: " + object.ThrownMessage(e.value)
 }
 
 func New(bytecode *compiler.Bytecode) *VM { // 创建栈
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
-	mainFrame := NewFrame(mainFn, 0)
+	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions, Lines: bytecode.Lines}
+	mainClosure := &object.Closure{Fn: mainFn}
+	mainFrame := NewFrame(mainClosure, 0)
 
 	frames := make([]*Frame, MaxFrames)
 	frames[0] = mainFrame
@@ -57,7 +83,121 @@ func (vm *VM) StackTop() object.Object { // 访问栈顶元素
 	return vm.stack[vm.sp-1]
 }
 
-func (vm *VM) Run() error { // 运行虚拟机，执行操作并对每个操作结果进行压栈
+// RuntimeError 虚拟机执行时的错误,记录出错指令对应的源码位置和出错时的调用栈
+type RuntimeError struct {
+	Message string
+	Pos     token.Position
+	Trace   []TraceEntry // 从出错的函数开始,依次是各层调用者,最后是主程序
+}
+
+// TraceEntry 调用栈中的一层,Pos是该函数正在执行的位置(对调用者来说就是调用发生的位置)
+type TraceEntry struct {
+	Function string
+	Pos      token.Position
+}
+
+const maxTraceLines = 20 // 调用栈太深时(例如无穷递归)只显示两端
+
+func (e *RuntimeError) Error() string {
+	if !e.Pos.IsValid() {
+		return e.Message
+	}
+	return e.Pos.String() + ": " + e.Message
+}
+
+// StackTrace 返回可读的调用栈,每层一行
+func (e *RuntimeError) StackTrace() string {
+	var out strings.Builder
+	out.WriteString("stack trace:\n")
+
+	for i, entry := range e.Trace {
+		if len(e.Trace) > maxTraceLines && i == maxTraceLines/2 {
+			fmt.Fprintf(&out, "  ... %d more\n", len(e.Trace)-maxTraceLines)
+		}
+		if len(e.Trace) > maxTraceLines && i >= maxTraceLines/2 && i < len(e.Trace)-maxTraceLines/2 {
+			continue
+		}
+		fmt.Fprintf(&out, "  at %s (%s)\n", entry.Function, entry.Pos)
+	}
+
+	return out.String()
+}
+
+func (vm *VM) Run() error { // 运行虚拟机，出错时返回带有源码位置的*RuntimeError
+	err := vm.run(0)
+	if err != nil {
+		return vm.newRuntimeError(err)
+	}
+	return nil
+}
+
+func (vm *VM) newRuntimeError(err error) *RuntimeError { // 根据各帧的指令指针查找出错的源码位置和调用栈
+	trace := make([]TraceEntry, 0, vm.framesIndex)
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		pos, _ := frame.cl.Fn.Lines.Lookup(frame.ip)
+		trace = append(trace, TraceEntry{Function: functionName(frame.cl.Fn, i), Pos: pos})
+	}
+
+	return &RuntimeError{Message: err.Error(), Pos: trace[0].Pos, Trace: trace}
+}
+
+func functionName(fn *object.CompiledFunction, frameIndex int) string {
+	switch {
+	case frameIndex == 0:
+		return "<main>"
+	case fn.Name == "":
+		return "<anonymous>"
+	default:
+		return fn.Name
+	}
+}
+
+// run 执行指令直到帧的数量降到stopAt,从主程序调用时stopAt为0,即执行到主程序结束
+// 内置函数回调用户函数时会重新进入run,在被调用函数的帧返回后停止
+// 出错时如果有属于这次执行的异常处理器,就跳转到它的catch继续执行
+func (vm *VM) run(stopAt int) error {
+	for {
+		err := vm.execute(stopAt)
+		if err == nil || !vm.handleError(err, stopAt) {
+			return err
+		}
+	}
+}
+
+// handleError 把错误交给最近登记的异常处理器,处理器属于stopAt之外的帧时返回false,
+// 由内置函数把错误传给外层的run处理
+func (vm *VM) handleError(err error, stopAt int) bool {
+	if len(vm.handlers) == 0 {
+		return false
+	}
+	h := vm.handlers[len(vm.handlers)-1]
+	if h.framesIndex <= stopAt {
+		return false
+	}
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+	var exception object.Object
+	if thrown, ok := err.(*thrownError); ok {
+		exception = thrown.value
+	} else { // 运行时错误的调用栈从出错的函数到捕获它的函数为止
+		runtimeErr := vm.newRuntimeError(err)
+		trace := make([]string, vm.framesIndex-h.framesIndex+1)
+		for i := range trace {
+			entry := runtimeErr.Trace[i]
+			trace[i] = fmt.Sprintf("%s (%s)", entry.Function, entry.Pos)
+		}
+		exception = object.ErrorValue(err.Error(), trace)
+	}
+
+	vm.framesIndex = h.framesIndex
+	vm.sp = h.sp
+	vm.currentFrame().ip = h.catchIP - 1
+
+	return vm.push(exception) == nil
+}
+
+func (vm *VM) execute(stopAt int) error { // 执行操作并对每个操作结果进行压栈
 	var ip int
 	var ins code.Instructions
 	//var op code.Opcode
@@ -67,7 +207,7 @@ func (vm *VM) Run() error { // 运行虚拟机，执行操作并对每个操作
 	//
 	//
 	//	}
-	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+	for vm.framesIndex > stopAt && vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
 		vm.currentFrame().ip++
 
 		ip = vm.currentFrame().ip
@@ -82,7 +222,8 @@ func (vm *VM) Run() error { // 运行虚拟机，执行操作并对每个操作
 			if err != nil {
 				return err
 			}
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv: // 加法
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPow,
+			code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShl, code.OpShr: // 二元算术运算和位运算
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
 				return err
@@ -99,7 +240,8 @@ func (vm *VM) Run() error { // 运行虚拟机，执行操作并对每个操作
 			if err != nil {
 				return err
 			}
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan: // 比较运算，压栈
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan,
+			code.OpLessThan, code.OpLessEqual, code.OpGreaterEqual: // 比较运算，压栈
 			err := vm.executeComparison(op)
 			if err != nil {
 				return err
@@ -114,6 +256,11 @@ func (vm *VM) Run() error { // 运行虚拟机，执行操作并对每个操作
 			if err != nil {
 				return err
 			}
+		case code.OpBitNot:
+			err := vm.executeBitNotOperator()
+			if err != nil {
+				return err
+			}
 		case code.OpJump:
 			pos := int(code.ReadUint16(ins[ip+1:])) // 解码操作数
 			vm.currentFrame().ip = pos - 1          // 将指令指针ip设置为跳转指令的目标处
@@ -155,6 +302,20 @@ func (vm *VM) Run() error { // 运行虚拟机，执行操作并对每个操作
 			if err != nil {
 				return err
 			}
+		case code.OpConcat: // 字符串插值
+			numParts := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			var out strings.Builder
+			for _, part := range vm.stack[vm.sp-numParts : vm.sp] {
+				out.WriteString(part.Inspect()) // 与str()一致,字符串本身不加引号
+			}
+			vm.sp = vm.sp - numParts
+
+			err := vm.push(&object.String{Value: out.String()})
+			if err != nil {
+				return err
+			}
 		case code.OpHash:
 			numElements := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip += 2
@@ -185,6 +346,97 @@ func (vm *VM) Run() error { // 运行虚拟机，执行操作并对每个操作
 			if err != nil {
 				return err
 			}
+		case code.OpCallSpread: // 参数在栈顶的数组中
+			args := vm.pop().(*object.Array)
+			for _, arg := range args.Elements {
+				err := vm.push(arg)
+				if err != nil {
+					return err
+				}
+			}
+
+			err := vm.executeCall(len(args.Elements))
+			if err != nil {
+				return err
+			}
+		case code.OpSpread:
+			numParts := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			elements := []object.Object{}
+			for _, part := range vm.stack[vm.sp-numParts : vm.sp] {
+				arr, ok := part.(*object.Array)
+				if !ok {
+					return fmt.Errorf("spread operand must be ARRAY, got %s", part.Type())
+				}
+				elements = append(elements, arr.Elements...)
+			}
+			vm.sp = vm.sp - numParts
+
+			err := vm.push(&object.Array{Elements: elements})
+			if err != nil {
+				return err
+			}
+		case code.OpUnpackArray: // 解构数组,第一个元素留在栈顶
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			rest := code.ReadUint8(ins[ip+3:]) == 1
+			vm.currentFrame().ip += 3
+
+			values, err := object.UnpackArray(vm.pop(), numElements, rest)
+			if err != nil {
+				return err
+			}
+			err = vm.pushReversed(values)
+			if err != nil {
+				return err
+			}
+		case code.OpUnpackHash: // 解构哈希表,第一个键的值留在栈顶
+			numKeys := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			keys := make([]object.Object, numKeys)
+			copy(keys, vm.stack[vm.sp-numKeys:vm.sp])
+			vm.sp = vm.sp - numKeys
+
+			values, err := object.UnpackHash(vm.pop(), keys)
+			if err != nil {
+				return err
+			}
+			err = vm.pushReversed(values)
+			if err != nil {
+				return err
+			}
+		case code.OpMatchArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			rest := code.ReadUint8(ins[ip+3:]) == 1
+			vm.currentFrame().ip += 3
+
+			matched := object.MatchArray(vm.pop(), numElements, rest)
+			err := vm.push(nativeBooleanToBooleanObject(matched))
+			if err != nil {
+				return err
+			}
+		case code.OpMatchHash:
+			numKeys := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			keys := make([]object.Object, numKeys)
+			copy(keys, vm.stack[vm.sp-numKeys:vm.sp])
+			vm.sp = vm.sp - numKeys
+
+			matched := object.MatchHash(vm.pop(), keys)
+			err := vm.push(nativeBooleanToBooleanObject(matched))
+			if err != nil {
+				return err
+			}
+		case code.OpJumpIfPassed: // 参数已经传入时跳过默认值
+			paramIndex := int(code.ReadUint8(ins[ip+1:]))
+			pos := int(code.ReadUint16(ins[ip+2:]))
+			vm.currentFrame().ip += 3
+
+			if paramIndex < vm.currentFrame().numArgs {
+				vm.currentFrame().ip = pos - 1
+			}
 		case code.OpReturnValue:
 			returnValue := vm.pop()
 
@@ -209,14 +461,45 @@ func (vm *VM) Run() error { // 运行虚拟机，执行操作并对每个操作
 
 			frame := vm.currentFrame()
 
-			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+			slot := &vm.stack[frame.basePointer+int(localIndex)]
+			if cell, ok := (*slot).(*object.Cell); ok { // 被闭包捕获的变量,修改共用的Cell
+				cell.Value = vm.pop()
+			} else {
+				*slot = vm.pop()
+			}
 		case code.OpGetLocal: // 获取局部变量
 			localIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
 
 			frame := vm.currentFrame()
 
-			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+			value := vm.stack[frame.basePointer+int(localIndex)]
+			if cell, ok := value.(*object.Cell); ok {
+				value = cell.Value
+			}
+			err := vm.push(value)
+			if err != nil {
+				return err
+			}
+		case code.OpCaptureLocal: // 局部变量第一次被捕获时转换为Cell,之后读写局部变量都通过这个Cell
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			slot := &vm.stack[vm.currentFrame().basePointer+int(localIndex)]
+			cell, ok := (*slot).(*object.Cell)
+			if !ok {
+				cell = &object.Cell{Value: *slot}
+				*slot = cell
+			}
+			err := vm.push(cell)
+			if err != nil {
+				return err
+			}
+		case code.OpCaptureFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.push(vm.currentFrame().cl.Free[freeIndex])
 			if err != nil {
 				return err
 			}
@@ -230,6 +513,55 @@ func (vm *VM) Run() error { // 运行虚拟机，执行操作并对每个操作
 			if err != nil {
 				return err
 			}
+		case code.OpSetFree: // 修改当前闭包捕获的自由变量
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			currentClosure := vm.currentFrame().cl
+			currentClosure.Free[freeIndex].Value = vm.pop()
+		case code.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+
+			err := vm.executeSetIndex(left, index, value)
+			if err != nil {
+				return err
+			}
+		case code.OpClosure: // 创建闭包
+			constIndex := code.ReadUint16(ins[ip+1:])
+			numFree := code.ReadUint8(ins[ip+3:])
+			vm.currentFrame().ip += 3
+
+			err := vm.pushClosure(int(constIndex), int(numFree))
+			if err != nil {
+				return err
+			}
+		case code.OpGetFree: // 获取当前闭包捕获的自由变量
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			currentClosure := vm.currentFrame().cl
+			err := vm.push(currentClosure.Free[freeIndex].Value)
+			if err != nil {
+				return err
+			}
+		case code.OpCheckDecl:
+			nameIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			if vm.StackTop() == Null {
+				return fmt.Errorf("function %s called before its declaration", vm.constants[nameIndex].Inspect())
+			}
+		case code.OpSetupTry:
+			catchIP := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			vm.handlers = append(vm.handlers, handler{catchIP: catchIP, sp: vm.sp, framesIndex: vm.framesIndex})
+		case code.OpPopTry:
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+		case code.OpThrow:
+			return &thrownError{value: vm.pop()}
 		}
 	}
 	return nil
@@ -249,7 +581,7 @@ func isTruthy(obj object.Object) bool { // 判断是否为真
 
 func (vm *VM) push(o object.Object) error { // 压栈操作
 	if vm.sp >= StackSize {
-		return fmt.Errorf("stack overFlow")
+		return fmt.Errorf("stack overflow")
 	}
 
 	vm.stack[vm.sp] = o
@@ -263,6 +595,16 @@ func (vm *VM) pop() object.Object { // 出栈操作
 	return o
 }
 
+func (vm *VM) pushReversed(values []object.Object) error { // 逆序压栈,第一个值在栈顶
+	for i := len(values) - 1; i >= 0; i-- {
+		err := vm.push(values[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (vm *VM) LastPoppedStackElem() object.Object { // 返回最近弹栈的元素
 	return vm.stack[vm.sp]
 }
@@ -274,22 +616,38 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error { // 做类型断言
 	leftType := left.Type()
 	rightType := right.Type()
 	switch {
-	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
+	case object.IsInteger(left) && object.IsInteger(right):
 		return vm.executeBinaryIntegerOperation(op, left, right)
+	case isNumber(left) && isNumber(right): // 整数与浮点数混合运算时统一按浮点数处理
+		return vm.executeBinaryFloatOperation(op, left, right)
 	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
 		return vm.executeBinaryStringOperation(op, left, right)
+	case leftType != rightType: // 错误信息与解释器的evalInfixExpression相同,catch得到的message在两种引擎中一致
+		return fmt.Errorf("type mismatch: %s %s %s", leftType, arithmeticOperators[op], rightType)
 	default:
-		return fmt.Errorf("unsupported types for binary operation: %s %s", leftType, rightType)
+		return fmt.Errorf("unknown operator: %s %s %s", leftType, arithmeticOperators[op], rightType)
+	}
+}
+
+func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.Object) error { // 处理整数操作,溢出时得到BigInteger
+	operator, ok := arithmeticOperators[op]
+	if !ok {
+		return fmt.Errorf("unkoown integer operator: %d", op)
 	}
 
-	return fmt.Errorf("unsupported types for binary operator: %s %s", leftType, rightType)
+	result, err := object.IntegerArithmetic(operator, left, right, vm.CheckedArithmetic)
+	if err != nil {
+		return err
+	}
+
+	return vm.push(result)
 }
 
-func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.Object) error { // 处理整数操作
-	leftValue := left.(*object.Integer).Value
-	rightValue := right.(*object.Integer).Value
+func (vm *VM) executeBinaryFloatOperation(op code.Opcode, left, right object.Object) error { // 处理浮点数操作
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
 
-	var result int64
+	var result float64
 
 	switch op {
 	case code.OpAdd:
@@ -300,68 +658,143 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.O
 		result = leftValue * rightValue
 	case code.OpDiv:
 		result = leftValue / rightValue
-	default:
-		return fmt.Errorf("unkoown integer operator: %d", op)
+	case code.OpMod:
+		result = math.Mod(leftValue, rightValue)
+	case code.OpPow:
+		result = math.Pow(leftValue, rightValue)
+	default: // 位运算只能用于整数
+		return fmt.Errorf("unknown operator: %s %s %s", left.Type(), arithmeticOperators[op], right.Type())
 	}
 
-	return vm.push(&object.Integer{Value: result})
+	return vm.push(&object.Float{Value: result})
+}
+
+// arithmeticOperators 算术操作码对应的运算符,整数运算与解释器共用object.IntegerArithmetic
+var arithmeticOperators = map[code.Opcode]string{
+	code.OpAdd:    "+",
+	code.OpSub:    "-",
+	code.OpMul:    "*",
+	code.OpDiv:    "/",
+	code.OpMod:    "%",
+	code.OpPow:    "**",
+	code.OpBitAnd: "&",
+	code.OpBitOr:  "|",
+	code.OpBitXor: "^",
+	code.OpShl:    "<<",
+	code.OpShr:    ">>",
+}
+
+// comparisonOperators 比较操作码对应的运算符,用于生成与解释器一致的错误信息
+var comparisonOperators = map[code.Opcode]string{
+	code.OpEqual:        "==",
+	code.OpNotEqual:     "!=",
+	code.OpGreaterThan:  ">",
+	code.OpLessThan:     "<",
+	code.OpLessEqual:    "<=",
+	code.OpGreaterEqual: ">=",
 }
 
-func (vm *VM) executeComparison(op code.Opcode) error { // 执行比较
+func (vm *VM) executeComparison(op code.Opcode) error { // 执行比较,规则与解释器的evalInfixExpression一致
 	right := vm.pop()
 	left := vm.pop()
 
-	if left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ { // 只有当左右字面量都为整型时才进行比较
-		return vm.executeIntegerComparison(op, left, right)
+	switch {
+	case object.IsInteger(left) && object.IsInteger(right): // 用比较结果与0比较,BigInteger也一样处理
+		return vm.pushComparison(compareValues(op, object.CompareIntegers(left, right), 0))
+	case isNumber(left) && isNumber(right): // 整数与浮点数混合比较时按精确的数值比较
+		result, ok := object.CompareNumbers(left, right)
+		if !ok { // NaN与任何数都不相等,也没有大小
+			return vm.pushComparison(op == code.OpNotEqual, nil)
+		}
+		return vm.pushComparison(compareValues(op, result, 0))
+	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ: // 字符串按字典序比较
+		return vm.pushComparison(compareValues(op, left.(*object.String).Value, right.(*object.String).Value))
 	}
 
-	switch op {
-	case code.OpEqual:
-		return vm.push(nativeBooleanToBooleanObject(right == left)) // 转换go的布尔类型
-	case code.OpNotEqual:
-		return vm.push(nativeBooleanToBooleanObject(right != left))
+	switch {
+	case op == code.OpEqual: // 数组和哈希表按内容比较
+		return vm.push(nativeBooleanToBooleanObject(object.Equals(left, right))) // 转换go的布尔类型
+	case op == code.OpNotEqual:
+		return vm.push(nativeBooleanToBooleanObject(!object.Equals(left, right)))
+	case left.Type() != right.Type():
+		return fmt.Errorf("type mismatch: %s %s %s", left.Type(), comparisonOperators[op], right.Type())
 	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)", op, left.Type(), right.Type())
+		return fmt.Errorf("unknown operator: %s %s %s", left.Type(), comparisonOperators[op], right.Type())
 	}
 }
 
-func (vm *VM) executeIntegerComparison(op code.Opcode, left object.Object, right object.Object) error { // 整数比较运算
-	leftValue := left.(*object.Integer).Value
-	rightValue := right.(*object.Integer).Value
+func (vm *VM) pushComparison(result bool, err error) error { // 将比较结果压栈
+	if err != nil {
+		return err
+	}
+	return vm.push(nativeBooleanToBooleanObject(result))
+}
 
+func compareValues[T cmp.Ordered](op code.Opcode, left, right T) (bool, error) { // 整数、浮点数和字符串共用的比较运算
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBooleanToBooleanObject(rightValue == leftValue))
+		return left == right, nil
 	case code.OpNotEqual:
-		return vm.push(nativeBooleanToBooleanObject(rightValue != leftValue))
+		return left != right, nil
 	case code.OpGreaterThan:
-		return vm.push(nativeBooleanToBooleanObject(rightValue < leftValue))
+		return left > right, nil
+	case code.OpLessThan:
+		return left < right, nil
+	case code.OpLessEqual:
+		return left <= right, nil
+	case code.OpGreaterEqual:
+		return left >= right, nil
 	default:
-		return fmt.Errorf("unknown operator: %d", op)
+		return false, fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func isNumber(obj object.Object) bool { // 判断是否为整数或浮点数
+	return object.IsInteger(obj) || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 { // 将整数或浮点数转换为go的float64
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.BigInteger:
+		return obj.Float64()
+	case *object.Float:
+		return obj.Value
 	}
+	return 0
 }
 
 func (vm *VM) executeBangOperator() error { // 布尔取反
 	operand := vm.pop() // 操作数出栈
 
-	switch operand {
-	case True:
-		return vm.push(False)
-	case False:
-		return vm.push(True)
-	default:
-		return vm.push(False)
-	}
+	return vm.push(nativeBooleanToBooleanObject(!isTruthy(operand))) // 与if和逻辑运算使用同样的真值判断,!null为true
 }
 
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
-	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("unsupported type for nagation: %s", operand.Type())
+
+	switch operand := operand.(type) {
+	case *object.Integer, *object.BigInteger:
+		value, err := object.NegateInteger(operand, vm.CheckedArithmetic)
+		if err != nil {
+			return err
+		}
+		return vm.push(value)
+	case *object.Float:
+		return vm.push(&object.Float{Value: -operand.Value})
+	default:
+		return fmt.Errorf("unknown operator: -%s", operand.Type())
 	}
+}
 
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
+func (vm *VM) executeBitNotOperator() error { // 按位取反,只能用于整数
+	operand := vm.pop()
+
+	if !object.IsInteger(operand) {
+		return fmt.Errorf("unknown operator: ~%s", operand.Type())
+	}
+	return vm.push(object.ComplementInteger(operand))
 }
 
 func nativeBooleanToBooleanObject(input bool) object.Object { // 转换bool为Wizard的bool类型
@@ -382,7 +815,7 @@ func (vm *VM) executeBinaryStringOperation( // 字符串拼接运算
 	left, right object.Object,
 ) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("enknown string operator: %d", op)
+		return fmt.Errorf("unknown operator: %s %s %s", left.Type(), arithmeticOperators[op], right.Type())
 	}
 
 	leftValue := left.(*object.String).Value
@@ -402,29 +835,28 @@ func (vm *VM) buildArray(startIndex, endIndex int) object.Object { // 创建数
 }
 
 func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
-	hashedParis := make(map[object.HashKey]object.HashPair)
+	hash := object.NewHash()
 
 	for i := startIndex; i < endIndex; i += 2 {
 		key := vm.stack[i]
 		value := vm.stack[i+1]
 
-		pair := object.HashPair{Key: key, Value: value}
-
-		hashKey, ok := key.(object.Hashable)
-		if !ok {
-			return nil, fmt.Errorf("unusuable as hash key %s:", key.Type())
+		if !hash.Set(key, value) {
+			return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
 		}
-
-		hashedParis[hashKey.HashKey()] = pair
 	}
 
-	return &object.Hash{Pairs: hashedParis}, nil
+	return hash, nil
 }
 
 func (vm *VM) executeIndexExpression(left object.Object, index object.Object) error { // 返回left索引为index的元素,对数组和哈希表单独处理
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return vm.executeArrayIndex(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return vm.executeStringIndex(left, index)
+	case (left.Type() == object.ARRAY_OBJ || left.Type() == object.STRING_OBJ) && index.Type() == object.BIG_INTEGER_OBJ:
+		return vm.push(Null) // 超出int64的下标不可能在范围内,与其他越界的下标一样得到null
 	case left.Type() == object.HASH_OBJ:
 		return vm.executeHashIndex(left, index)
 	default:
@@ -445,15 +877,25 @@ func (vm *VM) executeArrayIndex(array object.Object, index object.Object) error
 	return vm.push(arrayObject.Elements[i])
 }
 
+func (vm *VM) executeStringIndex(str object.Object, index object.Object) error { // 字符串按字符下标取值
+	runes := []rune(str.(*object.String).Value)
+	i := index.(*object.Integer).Value
+
+	if i < 0 || i >= int64(len(runes)) {
+		return vm.push(Null)
+	}
+
+	return vm.push(&object.String{Value: string(runes[i])})
+}
+
 func (vm *VM) executeHashIndex(hash object.Object, index object.Object) error {
 	hashObject := hash.(*object.Hash) // go的类型断言,将array转换成*object.Hash类型,若转换失败会引发异常
 
-	key, ok := index.(object.Hashable)
-	if !ok {
-		return fmt.Errorf("unusble as hash key: %s", index.Type())
+	if _, ok := object.HashKeyOf(index); !ok {
+		return fmt.Errorf("unusable as hash key: %s", index.Type())
 	}
 
-	pair, ok := hashObject.Pairs[key.HashKey()]
+	pair, ok := hashObject.Lookup(index)
 	if !ok {
 		return vm.push(Null)
 	}
@@ -461,6 +903,31 @@ func (vm *VM) executeHashIndex(hash object.Object, index object.Object) error {
 	return vm.push(pair.Value)
 }
 
+func (vm *VM) executeSetIndex(left, index, value object.Object) error { // 修改数组元素或哈希表的值,并把值压栈
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		arrayObject := left.(*object.Array)
+		i := index.(*object.Integer).Value
+
+		if i < 0 || i >= int64(len(arrayObject.Elements)) {
+			return fmt.Errorf("index out of range: %d", i)
+		}
+		arrayObject.Elements[i] = value
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.BIG_INTEGER_OBJ:
+		return fmt.Errorf("index out of range: %s", index.Inspect())
+	case left.Type() == object.HASH_OBJ:
+		hashObject := left.(*object.Hash)
+
+		if !hashObject.Set(index, value) {
+			return fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
+	default:
+		return fmt.Errorf("index assignment not supported: %s", left.Type())
+	}
+
+	return vm.push(value)
+}
+
 func (vm *VM) currentFrame() *Frame { // 返回当前栈帧栈顶元素
 	return vm.frames[vm.framesIndex-1]
 }
@@ -475,26 +942,60 @@ func (vm *VM) pushFrame(f *Frame) { // 栈帧压栈
 	vm.framesIndex++
 }
 
-func (vm *VM) callFunction(fn *object.CompiledFunction, numArgs int) error { // 调用编译后的函数
-	if numArgs != fn.NumParameters {
-		return fmt.Errorf("wrong number of arguments: want=%d, got=%d",
-			fn.NumParameters, numArgs)
+func (vm *VM) callClosure(cl *object.Closure, numArgs int) error { // 调用闭包
+	fn := cl.Fn
+	required := fn.NumParameters - fn.NumDefaults
+	if numArgs < required || (!fn.Variadic && numArgs > fn.NumParameters) {
+		return errors.New(object.ArgumentCountMessage(fn.Name, required, fn.NumParameters, fn.Variadic, numArgs))
+	}
+
+	basePointer := vm.sp - numArgs
+	if vm.framesIndex >= MaxFrames || basePointer+fn.NumLocals >= StackSize { // 递归太深
+		return fmt.Errorf("stack overflow")
 	}
 
-	frame := NewFrame(fn, vm.sp-numArgs)
+	for i := numArgs; i < fn.NumParameters; i++ { // 没有传入的参数先置为null,由函数开头的指令计算默认值
+		vm.stack[basePointer+i] = Null
+	}
+	if fn.Variadic { // 多余的参数收集为数组,作为剩余参数
+		restStart := basePointer + fn.NumParameters
+		rest := &object.Array{Elements: []object.Object{}}
+		if vm.sp > restStart {
+			rest = vm.buildArray(restStart, vm.sp).(*object.Array)
+		}
+		vm.stack[restStart] = rest
+	}
+	firstLocal := fn.NumParameters
+	if fn.Variadic {
+		firstLocal++
+	}
+	for i := firstLocal; i < fn.NumLocals; i++ { // 清除栈上残留的值,避免新定义的局部变量写入之前的调用留下的Cell
+		vm.stack[basePointer+i] = Null
+	}
+
+	frame := NewFrame(cl, basePointer)
+	frame.numArgs = numArgs
 	vm.pushFrame(frame)
 
-	vm.sp = frame.basePointer + fn.NumLocals
+	vm.sp = frame.basePointer + cl.Fn.NumLocals
 
 	return nil
 }
 
 func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error { // 调用内置函数
-	args := vm.stack[vm.sp-numArgs : vm.sp]
+	args := make([]object.Object, numArgs) // 复制参数,内置函数回调时会继续使用栈
+	copy(args, vm.stack[vm.sp-numArgs:vm.sp])
 
-	result := builtin.Fn(args...)
+	result := builtin.Fn(vm, args...)
 	vm.sp = vm.sp - numArgs - 1
 
+	if errObj, ok := result.(*object.Error); ok { // 内置函数的错误和解释器一样终止执行
+		if errObj.Value != nil { // 回调函数抛出的值继续向外抛出
+			return &thrownError{value: errObj.Value}
+		}
+		return errors.New(errObj.Message)
+	}
+
 	if result != nil {
 		vm.push(result)
 	} else {
@@ -507,11 +1008,68 @@ func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error { // 调
 func (vm *VM) executeCall(numArgs int) error {
 	callee := vm.stack[vm.sp-1-numArgs]
 	switch callee := callee.(type) {
-	case *object.CompiledFunction:
-		return vm.callFunction(callee, numArgs)
+	case *object.Closure:
+		return vm.callClosure(callee, numArgs)
 	case *object.Builtin:
 		return vm.callBuiltin(callee, numArgs)
 	default:
 		return fmt.Errorf("calling non-function and non-built-in")
 	}
 }
+
+// Call 实现object.CallContext,供内置函数在当前虚拟机中执行函数并取得返回值
+func (vm *VM) Call(fn object.Object, args ...object.Object) object.Object {
+	result, err := vm.callFunction(fn, args)
+	if err != nil { // 不恢复帧,出错的位置和调用栈由处理错误的run根据当前帧查找
+		errObj := &object.Error{Message: err.Error()}
+		if thrown, ok := err.(*thrownError); ok {
+			errObj.Value = thrown.value
+		}
+		return errObj
+	}
+	return result
+}
+
+func (vm *VM) callFunction(fn object.Object, args []object.Object) (object.Object, error) {
+	if err := vm.push(fn); err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		if err := vm.push(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	stopAt := vm.framesIndex
+	if err := vm.executeCall(len(args)); err != nil {
+		return nil, err
+	}
+	if vm.framesIndex > stopAt { // 调用的是闭包,执行到它的帧返回为止
+		if err := vm.run(stopAt); err != nil {
+			return nil, err
+		}
+	}
+
+	return vm.pop(), nil
+}
+
+func (vm *VM) pushClosure(constIndex int, numFree int) error { // 将函数与栈顶的自由变量打包成闭包
+	constant := vm.constants[constIndex]
+	function, ok := constant.(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %+v", constant)
+	}
+
+	free := make([]*object.Cell, numFree)
+	for i := 0; i < numFree; i++ { // 自由变量都由OpCaptureLocal或OpCaptureFree压栈,是与外层共用的Cell
+		cell, ok := vm.stack[vm.sp-numFree+i].(*object.Cell)
+		if !ok {
+			return fmt.Errorf("free variable %d of %s is not captured", i, functionName(function, 1))
+		}
+		free[i] = cell
+	}
+	vm.sp = vm.sp - numFree
+
+	closure := &object.Closure{Fn: function, Free: free}
+	return vm.push(closure)
+}
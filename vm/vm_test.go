@@ -0,0 +1,1068 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"my.com/myfile/ast"
+	"my.com/myfile/code"
+	"my.com/myfile/compiler"
+	"my.com/myfile/lexer"
+	"my.com/myfile/object"
+	"my.com/myfile/parser"
+)
+
+type vmTestCase struct {
+	input    string
+	expected interface{}
+}
+
+func parse(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
+func runVmTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s\ninput: %s", err, tt.input)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s\ninput: %s", err, tt.input)
+		}
+
+		stackElem := vm.LastPoppedStackElem()
+		testExpectedObject(t, tt.input, tt.expected, stackElem)
+	}
+}
+
+// inspectTestCase 用结果的Inspect比较,可以同时测试正常结果和运行时错误
+type inspectTestCase struct {
+	input    string
+	expected string // 结果的Inspect,出错时为错误信息
+}
+
+func runInspectTests(t *testing.T, tests []inspectTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		if got := runInspect(t, tt.input, false); got != tt.expected {
+			t.Errorf("%s: wrong result. got=%q, want=%q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+// runInspect 编译并执行input,返回结果的Inspect,出错时返回错误信息;checked开启整数溢出检查
+func runInspect(t *testing.T, input string, checked bool) string {
+	t.Helper()
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("%s: compiler error: %s", input, err)
+	}
+
+	vm := New(comp.Bytecode())
+	vm.CheckedArithmetic = checked
+	if err := vm.Run(); err != nil {
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("%s: expected *RuntimeError. got=%T (%v)", input, err, err)
+		}
+		return runtimeErr.Message
+	}
+	return vm.LastPoppedStackElem().Inspect()
+}
+
+func testExpectedObject(t *testing.T, input string, expected interface{}, actual object.Object) {
+	t.Helper()
+
+	switch expected := expected.(type) {
+	case int:
+		result, ok := actual.(*object.Integer)
+		if !ok {
+			t.Errorf("%s: object is not Integer. got=%T (%+v)", input, actual, actual)
+			return
+		}
+		if result.Value != int64(expected) {
+			t.Errorf("%s: object has wrong value. got=%d, want=%d", input, result.Value, expected)
+		}
+	case float64:
+		result, ok := actual.(*object.Float)
+		if !ok {
+			t.Errorf("%s: object is not Float. got=%T (%+v)", input, actual, actual)
+			return
+		}
+		if result.Value != expected {
+			t.Errorf("%s: object has wrong value. got=%g, want=%g", input, result.Value, expected)
+		}
+	case bool:
+		result, ok := actual.(*object.Boolean)
+		if !ok {
+			t.Errorf("%s: object is not Boolean. got=%T (%+v)", input, actual, actual)
+			return
+		}
+		if result.Value != expected {
+			t.Errorf("%s: object has wrong value. got=%t, want=%t", input, result.Value, expected)
+		}
+	case string:
+		result, ok := actual.(*object.String)
+		if !ok {
+			t.Errorf("%s: object is not String. got=%T (%+v)", input, actual, actual)
+			return
+		}
+		if result.Value != expected {
+			t.Errorf("%s: object has wrong value. got=%q, want=%q", input, result.Value, expected)
+		}
+	case *object.Null:
+		if actual != Null {
+			t.Errorf("%s: object is not Null. got=%T (%+v)", input, actual, actual)
+		}
+	}
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let newAddr = fn(x) {
+				fn(y) { x + y }
+			};
+			let addTwo = newAddr(2);
+			addTwo(3);
+			`,
+			expected: 5,
+		},
+		{
+			input: `
+			let newAdderOuter = fn(a, b) {
+				let c = a + b;
+				fn(d) {
+					let e = d + c;
+					fn(f) { e + f; };
+				};
+			};
+			let newAdderInner = newAdderOuter(1, 2);
+			let adder = newAdderInner(3);
+			adder(8);
+			`,
+			expected: 14,
+		},
+		{
+			input: `
+			let a = 1;
+			let newAdderOuter = fn(b) {
+				fn(c) {
+					fn(d) { a + b + c + d };
+				};
+			};
+			let newAdderInner = newAdderOuter(2);
+			let adder = newAdderInner(3);
+			adder(8);
+			`,
+			expected: 14,
+		},
+		{
+			input: `
+			let newClosure = fn(a, b) {
+				let one = fn() { a; };
+				let two = fn() { b; };
+				fn() { one() + two(); };
+			};
+			let closure = newClosure(9, 90);
+			closure();
+			`,
+			expected: 99,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{`let i = 0; while (i > 5) { let i = i + 1; } i`, 0},
+		{`let i = 0; while (5 > i) { let i = i + 1; } i`, 5},
+		{`while (false) { 1 }`, Null},
+		{`let i = 0; while (true) { let i = i + 1; if (i == 3) { break; } } i`, 3},
+		{`let i = 0; let n = 0; while (5 > i) { let i = i + 1; if (i == 2) { continue; } let n = n + 1; } n`, 4},
+		{`let n = 0; for let i = 0 : 5 > i : let i = i + 1 { if (i == 1) { continue; } let n = n + i; } n`, 9},
+		{
+			input: `
+			let n = 0;
+			let i = 0;
+			while (3 > i) {
+				let i = i + 1;
+				let j = 0;
+				while (true) {
+					let j = j + 1;
+					if (j > 2) { break; }
+					let n = n + 1;
+				}
+			}
+			n`,
+			expected: 6,
+		},
+		{
+			input: `
+			let f = fn(n) {
+				let i = 0;
+				let sum = 0;
+				while (n > i) {
+					let i = i + 1;
+					if (i == 2) { continue; }
+					let sum = sum + i;
+				}
+				sum
+			};
+			f(4)`,
+			expected: 8,
+		},
+		{`let f = fn() { let i = 0; while (true) { let i = i + 1; if (i == 7) { return i; } } 0 }; f()`, 7},
+		{`if (true) { let x = 1; }`, Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLoopControlInsideExpressions(t *testing.T) { // 跳出表达式时要弹出已经压栈的值,循环次数超过栈的大小也不会溢出
+	tests := []inspectTestCase{
+		{`let n = 0; for let i = 0 : i < 3000 : i = i + 1 { n = n + 1; [1, 2, if (true) { continue; }] }; n`, "3000"},
+		{`let n = 0; for let i = 0 : i < 3000 : i = i + 1 { n = n + 1; push([], if (true) { continue; }) }; n`, "3000"},
+		{`let a = [0]; let n = 0; for let i = 0 : i < 3000 : i = i + 1 { n = n + 1; a[0] = if (true) { continue; } }; n`, "3000"},
+		{`let n = 0; for let i = 0 : i < 3000 : i = i + 1 { try { [1, if (true) { continue; }] } finally { n = n + 1 } }; n`, "3000"},
+		{`let a = [0]; let n = 0; while (n < 5000) { n = n + 1; a[0] = if (n == 3000) { break; } }; n`, "3000"},
+		{`let f = fn() { let n = 0; while (n < 3000) { n = n + 1; {"a": [n, if (true) { continue; }]} }; n }; f()`, "3000"},
+		{`let i = 0; let n = 0; while (i < 3) { let v = match i { 2 => { break; }, _ => i }; n = n + v; i = i + 1 }; [i, n]`, "[2, 1]"},
+		{`let out = []; let i = 0; while (i < 3) { i = i + 1; out = push(out, [1, if (i == 2) { break; } else { 2 }]) }; out`, "[[1, 2]]"},
+		{`let s = 0; let i = 0; while (true) { i = i + 1; s = s + if (i > 3) { break; } else { i } }; s`, "6"},
+		{`let n = 0; while (true) { n = n + 1; len(if (n == 3) { break; } else { "ab" }) }; n`, "3"},
+		{`let n = 0; for let i = 0 : i < 5 : i = i + 1 { n = n + {"a": if (i % 2 == 0) { continue; } else { i }}["a"] }; n`, "4"},
+		{`let f = fn(c) { let v = if (c) { return 5; } else { 1 }; v + 10 }; [f(true), f(false)]`, "[5, 11]"},
+		{`let f = fn() { let n = 0; while (true) { n = n + 1; "${if (n == 2) { return n * 10; } else { n }}" } }; f()`, "20"},
+		{`let n = 0; while (n < 5) { n = n + 1; while (if (n == 3) { break; } else { false }) { } }; n`, "3"}, // 条件中的break属于外层循环
+		{`let n = 0; for let i = 0 : i < 10 : i = if (i == 4) { break; } else { i + 1 } { n = n + 1 }; n`, "5"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestRedefinition(t *testing.T) {
+	tests := []inspectTestCase{
+		{`let x = 1; let x = x + 1; x`, "2"},
+		{`fn(a, a) { a }(1, 2)`, "2"},
+		{`let f = fn(a, a) { let a = a + 1; a }; f(1, 2)`, "3"},
+		{`fn(a, ...a) { a }(1, 2)`, "[2]"},
+		{`fn(a, b, a) { [a, b] }(1, 2, 3)`, "[3, 2]"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestLoopControlOutsideLoop(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string // 编译错误,与解释器运行时的错误相同
+	}{
+		{`break;`, "1:1: break outside loop"},
+		{`if (true) { continue; }`, "1:13: continue outside loop"},
+		{`let f = fn() { break; }; let n = 0; while (n < 3) { n = n + 1; f() }; n`, "1:16: break outside loop"},
+		{`while (true) { map([1], fn(x) { continue; }) }`, "1:33: continue outside loop"},
+	}
+
+	for _, tt := range tests {
+		err := compiler.New().Compile(parse(tt.input))
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("%s: wrong compile error. got=%v, want=%q", tt.input, err, tt.expected)
+		}
+	}
+}
+
+func TestTooManyLocals(t *testing.T) {
+	var body strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&body, "let x%d = %d; ", i, i)
+	}
+	tests := []struct {
+		input    string
+		expected string // 编译错误,空字符串表示编译成功
+	}{
+		{"fn() { " + body.String() + "}", ""},
+		{"fn() { " + body.String() + "let y = 1; }", "1:1: too many local variables in function: 257, max 256"},
+		{"fn([a], " + strings.Repeat("b, ", 255) + "c) { }", "1:1: too many local variables in function: 258, max 256"},
+	}
+
+	for _, tt := range tests {
+		err := compiler.New().Compile(parse(tt.input))
+		if (tt.expected == "" && err != nil) || (tt.expected != "" && (err == nil || err.Error() != tt.expected)) {
+			t.Errorf("wrong compile error. got=%v, want=%q", err, tt.expected)
+		}
+	}
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"3.14", 3.14},
+		{"1e-3", 0.001},
+		{"2.5e2", 250.0},
+		{"1.5 + 1.5", 3.0},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2.0},
+		{"7 / 2.0", 3.5},
+		{"7 / 2", 3},
+		{"-2.5", -2.5},
+		{"1.0 == 1", true},
+		{"1.5 != 1.5", false},
+		{"2.5 > 2", true},
+		{"2 > 2.5", false},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`let x = 1; x = 5; x`, 5},
+		{`let x = 1; let y = 2; x = y = 7; x + y`, 14},
+		{`let x = 1; x = x + 1`, 2},
+		{`let f = fn() { let a = 1; a = a + 2; a }; f()`, 3},
+		{`let arr = [1, 2, 3]; arr[1] = 20; arr[1]`, 20},
+		{`let h = {"a": 1}; h["b"] = 2; h["a"] + h["b"]`, 3},
+		{
+			input: `
+			let i = 1;
+			let count = 0;
+			while (101 > i) {
+				count = count + i;
+				i = i + 1;
+			}
+			count`,
+			expected: 5050,
+		},
+		{
+			input: `
+			let newCounter = fn() {
+				let c = 0;
+				fn() { c = c + 1; c }
+			};
+			let counter = newCounter();
+			counter();
+			counter();
+			counter()`,
+			expected: 3,
+		},
+		{`let n = 0; for let i = 0 : 4 > i : i = i + 1 { n = n + i; } n`, 6},
+		// 闭包修改捕获的变量,外层函数和其他闭包都能看到
+		{`let f = fn() { let c = 0; let inc = fn() { c = c + 1 }; inc(); inc(); c }; f()`, 2},
+		{`let f = fn() { let n = 0; let inc = fn() { n = n + 1 }; let get = fn() { n }; inc(); inc(); get() }; f()`, 2},
+		{`let f = fn() { let x = 1; let mid = fn() { let inner = fn() { x = x * 10 }; inner() }; mid(); x }; f()`, 10},
+		{`let f = fn(x) { let g = fn() { x = x + 1 }; g(); x }; f(5)`, 6},
+		{`let f = fn() { let c = 0; let g = fn() { c }; c = 7; g() }; f()`, 7},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 && 0", true},
+		{`"" || false`, true},
+		{"!(if (false) { 1 })", true},
+		{"if (false) { 1 } || false", false},
+		{"1 == 1 && 2 == 2", true},
+		{"false && true || true", true},
+		{"let x = 0; false && (x = 1); x", 0},
+		{"let x = 0; true || (x = 1); x", 0},
+		{"let x = 0; true && (x = 1); x", 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestComparisonOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"1 < 2", true},
+		{"2 < 1", false},
+		{"1 > 2", false},
+		{"2 > 1", true},
+		{"1 <= 1", true},
+		{"2 <= 1", false},
+		{"1 >= 1", true},
+		{"1 >= 2", false},
+		{"1 != 2", true},
+		{"1 != 1", false},
+		{"1.5 < 2", true},
+		{"2 >= 2.0", true},
+		{`"a" < "b"`, true},
+		{`"b" <= "a"`, false},
+		{`"abc" == "abc"`, true},
+		{`"abc" != "abd"`, true},
+		{"true != false", true},
+		{`1 == "1"`, false},
+		{"(1 < 2) == true", true},
+	}
+
+	runVmTests(t, tests)
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`1 < "a"`, "type mismatch: INTEGER < STRING"},
+		{`true >= false`, "unknown operator: BOOLEAN >= BOOLEAN"},
+	}
+
+	for _, tt := range errorTests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err := New(comp.Bytecode()).Run()
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok || runtimeErr.Message != tt.expected {
+			t.Errorf("%s: wrong error. got=%v, want=%q", tt.input, err, tt.expected)
+		}
+	}
+}
+
+func TestUnicodeStrings(t *testing.T) {
+	tests := []vmTestCase{
+		{`let 计数 = 3; 计数 + 1`, 4},
+		{`len("你好")`, 2},
+		{`len("abc")`, 3},
+		{`"你好世界"[1]`, "好"},
+		{`"你好"[2]`, Null},
+		{`"你好" + "世界"`, "你好世界"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRuntimeErrorPosition(t *testing.T) {
+	input := `let f = fn(a) {
+	a + "s"
+};
+f(1);`
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err := New(comp.Bytecode()).Run()
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("expected *RuntimeError. got=%T (%v)", err, err)
+	}
+	if runtimeErr.Pos.Line != 2 || runtimeErr.Pos.Column != 4 {
+		t.Errorf("wrong error position. got=%s, want=2:4", runtimeErr.Pos)
+	}
+}
+
+func TestSerializedBytecode(t *testing.T) {
+	tests := []vmTestCase{
+		{`let add = fn(a, b) { a + b }; add(1, 2)`, 3},
+		{`let s = "你好"; s + "世界"`, "你好世界"},
+		{`1.5 * 2.0`, 3.0},
+		{`let f = fn(x) { fn(y) { x - y } }; f(10)(-3)`, 13},
+		{`100000000000000000000 / 1000000000000`, 100000000},
+		{`fn f(a, b = 2, ...c) { a + b + len(c) }; f(1) + f(1, 1, 1, 1)`, 7},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		data, err := compiler.Marshal(comp.Bytecode())
+		if err != nil {
+			t.Fatalf("marshal error: %s", err)
+		}
+		bytecode, err := compiler.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("unmarshal error: %s", err)
+		}
+
+		vm := New(bytecode)
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s\ninput: %s", err, tt.input)
+		}
+		testExpectedObject(t, tt.input, tt.expected, vm.LastPoppedStackElem())
+
+		for i := 0; i < len(data); i++ { // 截断的数据不能被加载
+			if _, err := compiler.Unmarshal(data[:i]); err == nil {
+				t.Fatalf("%s: expected error for data truncated to %d bytes", tt.input, i)
+			}
+		}
+	}
+}
+
+func TestSerializedErrorPosition(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let f = fn(a) {\n\ta + \"s\"\n};\nf(1);")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	data, err := compiler.Marshal(comp.Bytecode())
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	bytecode, err := compiler.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+
+	runtimeErr, ok := New(bytecode).Run().(*RuntimeError)
+	if !ok {
+		t.Fatalf("expected *RuntimeError")
+	}
+	if runtimeErr.Pos.Line != 2 || runtimeErr.Pos.Column != 4 {
+		t.Errorf("wrong error position. got=%s, want=2:4", runtimeErr.Pos)
+	}
+
+	data[4], data[5] = 0xff, 0xff // 版本号不匹配
+	if _, err := compiler.Unmarshal(data); err == nil {
+		t.Errorf("expected version mismatch error")
+	}
+}
+
+func TestSerializedInvalidOperands(t *testing.T) {
+	fn := &object.CompiledFunction{Instructions: concat(code.Make(code.OpGetLocal, 1), code.Make(code.OpReturnValue)), NumLocals: 1}
+	tests := []struct {
+		name         string
+		instructions []code.Instructions
+		constants    []object.Object
+	}{
+		{"constant index", []code.Instructions{code.Make(code.OpConstant, 1), code.Make(code.OpPop)},
+			[]object.Object{&object.Integer{Value: 1}}},
+		{"builtin index", []code.Instructions{code.Make(code.OpGetBuiltin, len(object.Builtins)), code.Make(code.OpPop)}, nil},
+		{"local in main", []code.Instructions{code.Make(code.OpGetLocal, 0), code.Make(code.OpPop)}, nil},
+		{"local index", []code.Instructions{code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)},
+			[]object.Object{fn}},
+		{"jump past end", []code.Instructions{code.Make(code.OpJump, 100)}, nil},
+		{"jump into operands", []code.Instructions{code.Make(code.OpTrue), code.Make(code.OpJump, 2)}, nil},
+		{"closure of non-function", []code.Instructions{code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)},
+			[]object.Object{&object.Integer{Value: 1}}},
+		{"missing free variables", []code.Instructions{code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)},
+			[]object.Object{&object.CompiledFunction{Instructions: concat(code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue))}}},
+	}
+
+	for _, tt := range tests {
+		data, err := compiler.Marshal(&compiler.Bytecode{Instructions: concat(tt.instructions...), Constants: tt.constants})
+		if err != nil {
+			t.Fatalf("%s: marshal error: %s", tt.name, err)
+		}
+		if _, err := compiler.Unmarshal(data); err == nil {
+			t.Errorf("%s: expected error for invalid operand", tt.name)
+		}
+	}
+}
+
+func concat(instructions ...code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range instructions {
+		out = append(out, ins...)
+	}
+	return out
+}
+
+func TestBuiltinFunctions(t *testing.T) {
+	tests := []inspectTestCase{
+		{`len([1, 2, 3])`, "3"},
+		{`len({"a": 1, "b": 2})`, "2"},
+		{`len(1)`, "argument to `len` not supported, got INTEGER"},
+		{`first([1, 2, 3])`, "1"},
+		{`first([])`, "null"},
+		{`last([1, 2, 3])`, "3"},
+		{`rest([1, 2, 3])`, "[2, 3]"},
+		{`rest([])`, "null"},
+		{`first(1)`, "argument to `first` must be ARRAY, got INTEGER"},
+		{`type(1)`, "INTEGER"},
+		{`type("a")`, "STRING"},
+		{`type(fn(x) { x })`, "FUNCTION"},
+		{`type(len)`, "BUILTIN"},
+		{`str(12) + str(true)`, "12true"},
+		{`str("a")`, "a"},
+		{`int("42") + int(2.9) + int(true)`, "45"},
+		{`int("4x")`, `could not convert "4x" to integer`},
+		{`keys({"b": 2, "a": 1})`, `[b, a]`},
+		{`values({"b": 2, "a": 1})`, "[2, 1]"},
+		{`let h = {"a": 1, "b": 2}; let d = delete(h, "a"); len(h) * 10 + len(d)`, "21"},
+		{`contains([1, "a", true], "a")`, "true"},
+		{`contains([1, 2], 3)`, "false"},
+		{`contains({"a": 1}, "a")`, "true"},
+		{`contains("你好世界", "世界")`, "true"},
+		{`if (contains([1], 1)) { 1 } else { 2 }`, "1"},
+		{`contains([1], 1) == true`, "true"},
+		{`delete({}, [len])`, "unusable as hash key: ARRAY"},
+		{`len("a", "b")`, "wrong number of arguments. got=2, want=1"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestHigherOrderBuiltins(t *testing.T) {
+	tests := []inspectTestCase{
+		{`map([1, 2, 3], fn(x) { x * 2 })`, "[2, 4, 6]"},
+		{`map([], fn(x) { x })`, "[]"},
+		{`map(["a", "b"], len)`, "[1, 1]"},
+		{`filter([1, 2, 3, 4], fn(x) { x > 2 })`, "[3, 4]"},
+		{`filter([1, if (false) { 2 }, false, 0], fn(x) { x })`, "[1, 0]"},
+		{`reduce([1, 2, 3, 4], fn(acc, x) { acc + x }, 10)`, "20"},
+		{`reduce([1, 2, 3, 4], fn(acc, x) { acc * x })`, "24"},
+		{`reduce([], fn(acc, x) { acc + x })`, "null"},
+		{`sort_by([3, 1, 2], fn(x) { x })`, "[1, 2, 3]"},
+		{`sort_by(["bb", "a", "ccc"], fn(s) { -len(s) })`, "[ccc, bb, a]"},
+		{`sort_by([[2, "a"], [1, "b"], [2, "c"]], fn(p) { p[0] })`, "[[1, b], [2, a], [2, c]]"},
+		{`sort_by([1, "a"], fn(x) { x })`, "cannot compare sort keys STRING and INTEGER"},
+		{`let n = 0; each([1, 2, 3], fn(x) { n = n + x }); n`, "6"},
+		{`let total = fn(arr) { reduce(map(arr, fn(x) { x * x }), fn(a, b) { a + b }, 0) }; map([[1, 2], [3]], total)`, "[5, 9]"},
+		{`let k = 3; map([1, 2], fn(x) { x + k })`, "[4, 5]"},
+		{`map([1], fn(x, y) { x })`, "wrong number of arguments: want=2, got=1"},
+		{`map([[1], 2], fn(x) { len(x) })`, "argument to `len` not supported, got INTEGER"},
+		{`map(1, fn(x) { x })`, "first argument to `map` must be ARRAY, got INTEGER"},
+		{`filter([1], 2)`, "second argument to `filter` must be FUNCTION, got INTEGER"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestStructuralEquality(t *testing.T) {
+	tests := []inspectTestCase{
+		{`"a" + "b" == "ab"`, "true"},
+		{`"a" + "b" != "ab"`, "false"},
+		{`1 == 1.0`, "true"},
+		{`[1, 2, [3]] == [1, 2, [3]]`, "true"},
+		{`[1, 2] == [1, 2, 3]`, "false"},
+		{`[1, "a"] != [1, "b"]`, "true"},
+		{`{"a": [1], "b": 2} == {"b": 2, "a": [1]}`, "true"},
+		{`{"a": 1} == {"a": 2}`, "false"},
+		{`{"a": 1} == {"b": 1}`, "false"},
+		{`[] == {}`, "false"},
+		{`let f = fn() { 1 }; f == f`, "true"},
+		{`fn() { 1 } == fn() { 1 }`, "false"},
+		{`let a = [1]; a[0] = a; let b = [1]; b[0] = b; a == b`, "true"},
+		{`{1: "one"}[1.0]`, "one"},
+		{`contains([[1, 2], [3]], [3])`, "true"},
+		{`contains({2: 1}, 2.0)`, "true"},
+		{`9007199254740993 == 9007199254740992.0`, "false"},
+		{`9007199254740992 == 9007199254740992.0`, "true"},
+		{`[9007199254740993 > 9007199254740992.0, 9007199254740993 <= 9007199254740992.0]`, "[true, false]"},
+		{`{9007199254740992.0: "f"}[9007199254740993]`, "null"},
+		{`{9007199254740992.0: "f"}[9007199254740992]`, "f"},
+		{`contains([9007199254740992.0], 9007199254740993)`, "false"},
+		{`[(1 << 64) == 18446744073709551616.0, (1 << 64) + 1 == 18446744073709551616.0]`, "[true, false]"},
+		{`let n = 0.0 / 0; [n == n, n != n, n < 1, 1 < n, n == 1]`, "[false, true, false, false, false]"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestHashes(t *testing.T) {
+	tests := []inspectTestCase{
+		{`{"b": 1, "a": 2, "c": 3}`, "{b: 1, a: 2, c: 3}"},
+		{`let h = {"x": 1, "y": 2}; h["x"] = 10; h["z"] = 3; h`, "{x: 10, y: 2, z: 3}"},
+		{`{"a": 1, "a": 2}`, "{a: 2}"},
+		{`push(push({}, "a", 1), "b", 2)`, "{a: 1, b: 2}"},
+		{`let h = push({1: "x"}, true, "y"); h[1] + h[true]`, "xy"},
+		{`delete({"a": 1, "b": 2, "c": 3}, "b")`, "{a: 1, c: 3}"},
+		{`{[1, 2]: "pair"}[[1, 2]]`, "pair"},
+		{`{[1, [2]]: "nested"}[[1.0, [2]]]`, "nested"},
+		{`{{"a": 1, "b": 2}: "h"}[{"b": 2, "a": 1}]`, "h"},
+		{`{[1]: "x"}[[2]]`, "null"},
+		{`{[len]: 1}`, "unusable as hash key: ARRAY"},
+		{`{}[len]`, "unusable as hash key: BUILTIN"},
+		{`keys({3: "c", 1: "a", 2: "b"})`, "[3, 1, 2]"},
+		{`let k = [1]; let h = {}; h[k] = 1; k[0] = 2; [h[[1]], h[[2]], h]`, "[1, null, {[1]: 1}]"},
+		{`let h = {[1]: 1}; let k = keys(h); k[0][0] = 2; h[[1]]`, "1"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestRuntimeErrorStackTrace(t *testing.T) {
+	input := `let inner = fn(x) {
+	x + "s"
+};
+let outer = fn(x) { inner(x) };
+let apply = fn(f) { f(1) };
+apply(fn(y) { outer(y) });`
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err := New(comp.Bytecode()).Run()
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("expected *RuntimeError. got=%T (%v)", err, err)
+	}
+
+	expected := []struct {
+		function string
+		line     int
+	}{
+		{"inner", 2},
+		{"outer", 4},
+		{"<anonymous>", 6},
+		{"apply", 5},
+		{"<main>", 6},
+	}
+	if len(runtimeErr.Trace) != len(expected) {
+		t.Fatalf("wrong trace length. got=%d, want=%d\n%s", len(runtimeErr.Trace), len(expected), runtimeErr.StackTrace())
+	}
+	for i, want := range expected {
+		got := runtimeErr.Trace[i]
+		if got.Function != want.function || got.Pos.Line != want.line {
+			t.Errorf("trace[%d] wrong. got=%s at line %d, want=%s at line %d", i, got.Function, got.Pos.Line, want.function, want.line)
+		}
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse(`let f = fn(g, n) { g(g, n + 1) }; f(f, 0)`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	runtimeErr, ok := New(comp.Bytecode()).Run().(*RuntimeError)
+	if !ok || runtimeErr.Message != "stack overflow" {
+		t.Fatalf("expected stack overflow error. got=%v", runtimeErr)
+	}
+	if len(runtimeErr.Trace) <= maxTraceLines {
+		t.Errorf("trace too short. got=%d", len(runtimeErr.Trace))
+	}
+	if strings.Count(runtimeErr.StackTrace(), "\n") > maxTraceLines+2 {
+		t.Errorf("stack trace is not truncated:\n%s", runtimeErr.StackTrace())
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	tests := []inspectTestCase{
+		{`try { throw "boom"; 1 } catch (e) { e + "!" }`, "boom!"},
+		{`try { 1 } catch (e) { 2 }`, "1"},
+		{`try { throw 1 } catch { 2 }`, "2"},
+		{`let f = fn(x) { x }; try { f(1, 2) } catch (e) { e["message"] }`, "wrong number of arguments to f: want=1, got=2"},
+		{`try { 1 + "a" } catch (e) { e["message"] }`, "type mismatch: INTEGER + STRING"},
+		{`try { [1] * 2.5 } catch (e) { e["message"] }`, "type mismatch: ARRAY * FLOAT"},
+		{`try { true + false } catch (e) { e["message"] }`, "unknown operator: BOOLEAN + BOOLEAN"},
+		{`try { "a" - "b" } catch (e) { e["message"] }`, "unknown operator: STRING - STRING"},
+		{`try { 1.5 & 1 } catch (e) { e["message"] }`, "unknown operator: FLOAT & INTEGER"},
+		{`try { -true } catch (e) { e["message"] }`, "unknown operator: -BOOLEAN"},
+		{`let g = fn() { let a = [1]; a[5] = 1 }; let h = fn() { try { g() } catch (e) { e } }; h()["trace"]`, "[g (1:34), h (1:63)]"},
+		{`try { map([1], fn(x) { [][1] = x }) } catch (e) { e["trace"] }`, "[<anonymous> (1:30), <main> (1:10)]"},
+		{`try { map([1, 2], fn(x) { throw x * 10 }) } catch (e) { e }`, "10"},
+		{`try { try { throw "a" } catch (e) { throw e + "b" } } catch (e) { e }`, "ab"},
+		{`let log = []; try { try { throw 1 } finally { log = push(log, "f") } } catch (e) { log = push(log, e) }; log`, "[f, 1]"},
+		{`let log = []; let f = fn() { try { return 1 } finally { log = push(log, "f") } }; [f(), log]`, "[1, [f]]"},
+		{`let log = []; for let i = 0 : i < 3 : i = i + 1 { try { if (i == 1) { break; } } finally { log = push(log, i) } }; log`, "[0, 1]"},
+		{`let f = fn() { try { throw "x" } finally { return 2 } }; f()`, "2"},
+		{`try { 1 } finally { 2 }`, "1"},
+		{`throw {"code": 1}`, "uncaught exception: {code: 1}"},
+		{`try { [][0] = 1 } catch (e) { throw e }`, "uncaught exception: index out of range: 0"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestIntegerArithmeticErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		checked  bool
+		expected string // 结果的Inspect,出错时为错误信息
+	}{
+		{`1 / 0`, false, "division by zero"},
+		{`let f = fn(x) { 10 / x }; try { f(0) } catch (e) { e["message"] }`, false, "division by zero"},
+		{`9223372036854775807 + 1`, false, "9223372036854775808"},
+		{`9223372036854775807 + 1`, true, "integer overflow: 9223372036854775807 + 1"},
+		{`-9223372036854775807 - 2`, true, "integer overflow: -9223372036854775807 - 2"},
+		{`4611686018427387904 * 2`, true, "integer overflow: 4611686018427387904 * 2"},
+		{`let min = -9223372036854775807 - 1; min / -1`, true, "integer overflow: -9223372036854775808 / -1"},
+		{`let min = -9223372036854775807 - 1; -min`, true, "integer overflow: -(-9223372036854775808)"},
+		{`3037000499 * 3037000499`, true, "9223372030926249001"},
+		{`let inc = fn(x) { x + 1 }; inc(9223372036854775807)`, true, "integer overflow: 9223372036854775807 + 1"},
+		{`1.5 / 0`, true, "+Inf"},
+	}
+
+	for _, tt := range tests {
+		if got := runInspect(t, tt.input, tt.checked); got != tt.expected {
+			t.Errorf("%s: wrong result. got=%q, want=%q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestBigIntegers(t *testing.T) {
+	tests := []inspectTestCase{
+		{`let fact = fn(n, f) { if (n < 2) { 1 } else { n * f(n - 1, f) } }; fact(25, fact)`, "15511210043330985984000000"},
+		{`123456789012345678901234567890`, "123456789012345678901234567890"},
+		{`-9223372036854775808`, "-9223372036854775808"},
+		{`type(-9223372036854775808)`, "INTEGER"},
+		{`type(9223372036854775808)`, "BIG_INTEGER"},
+		{`9223372036854775808 - 1`, "9223372036854775807"},
+		{`type(9223372036854775808 - 1)`, "INTEGER"},
+		{`100000000000000000000 / 3`, "33333333333333333333"},
+		{`-100000000000000000000 / 7`, "-14285714285714285714"},
+		{`100000000000000000000 / 0`, "division by zero"},
+		{`-(-9223372036854775807 - 1)`, "9223372036854775808"},
+		{`99999999999999999999 < 100000000000000000000`, "true"},
+		{`100000000000000000000 > 1`, "true"},
+		{`100000000000000000000 == 99999999999999999999 + 1`, "true"},
+		{`100000000000000000000 == 1e20`, "true"},
+		{`100000000000000000000 + 0.5`, "1e+20"},
+		{`{100000000000000000000: "big"}[99999999999999999999 + 1]`, "big"},
+		{`{1e20: "float"}[100000000000000000000]`, "float"},
+		{`int("123456789012345678901234567890") + 1`, "123456789012345678901234567891"},
+		{`int(1e20)`, "100000000000000000000"},
+		{`sort_by([100000000000000000000, 1, -100000000000000000000], fn(x) { x })`, "[-100000000000000000000, 1, 100000000000000000000]"},
+		{`100000000000000000000 < "a"`, "type mismatch: BIG_INTEGER < STRING"},
+		{`[1, 2][100000000000000000000]`, "null"},
+		{`"ab"[-100000000000000000000]`, "null"},
+		{`let a = [1]; a[100000000000000000000] = 2`, "index out of range: 100000000000000000000"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestArithmeticAndBitwiseOperators(t *testing.T) {
+	tests := []inspectTestCase{
+		{`7 % 3`, "1"},
+		{`-7 % 3`, "-1"},
+		{`7 % -3`, "1"},
+		{`7 % 0`, "division by zero"},
+		{`7.5 % 2`, "1.5"},
+		{`2 ** 10`, "1024"},
+		{`2 ** 3 ** 2`, "512"},
+		{`(2 ** 3) ** 2`, "64"},
+		{`-2 ** 2`, "-4"},
+		{`2 ** -1`, "0.5"},
+		{`2.0 ** 0.5 > 1.41`, "true"},
+		{`2 ** 64`, "18446744073709551616"},
+		{`3 ** 40 % 1000`, "801"},
+		{`2 * 3 ** 2`, "18"},
+		{`12 & 10`, "8"},
+		{`12 | 10`, "14"},
+		{`12 ^ 10`, "6"},
+		{`~5`, "-6"},
+		{`~-1`, "0"},
+		{`1 << 4`, "16"},
+		{`-16 >> 2`, "-4"},
+		{`1 << 64`, "18446744073709551616"},
+		{`(1 << 100) >> 99`, "2"},
+		{`1 << -1`, "negative shift count: -1"},
+		{`1 << 9223372036854775807`, "shift count too large: 9223372036854775807"},
+		{`(1 << 64) << 1048576`, "shift count too large: 1048576"},
+		{`0 << 9223372036854775807`, "0"},
+		{`(1 << 64) >> 9223372036854775807`, "0"},
+		{`10 ** 10000000000`, "exponent too large: 10000000000"},
+		{`(1 << 64) ** 100000`, "exponent too large: 100000"},
+		{`1 ** 9223372036854775807`, "1"},
+		{`-1 ** 9223372036854775807`, "-1"},
+		{`len(str(2 ** 100000))`, "30103"},
+		{`1 + 2 << 3`, "24"},
+		{`1 | 2 ^ 3 & 4`, "3"},
+		{`6 & 3 == 2`, "true"},
+		{`1 < 2 == 2 < 3`, "true"},
+		{`~(1 << 64)`, "-18446744073709551617"},
+		{`(1 << 64) & ((1 << 64) - 1)`, "0"},
+		{`1.5 & 1`, "unknown operator: FLOAT & INTEGER"},
+		{`~1.5`, "unknown operator: ~FLOAT"},
+		{`let n = 0; for let i = 0 : i < 10 : i = i + 1 { if (i % 2 == 0) { n = n + i } }; n`, "20"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestStringInterpolation(t *testing.T) {
+	tests := []inspectTestCase{
+		{`let name = "Bob"; let n = 2; "Hello ${name}, you have ${n + 1} items"`, "Hello Bob, you have 3 items"},
+		{`"${1}${2}"`, "12"},
+		{`"${"a"}"`, "a"},
+		{`let x = 5; "x = ${x}, x * 2 = ${x * 2}"`, "x = 5, x * 2 = 10"},
+		{`"list: ${[1, "b", 2.5]} hash: ${{"k": true}}"`, "list: [1, b, 2.5] hash: {k: true}"},
+		{`let v = "in"; "out ${"[${v}]"} ${ {"k": 1}["k"] }"`, "out [in] 1"},
+		{`let f = fn(s) { "<${s}>" }; f(f("x"))`, "<<x>>"},
+		{`"${len("héllo")} ${first([])} ${2 ** 64}"`, "5 null 18446744073709551616"},
+		{`"a\"b\\c\$\u{4e2d}\u{1F600}"`, "a\"b\\c$中😀"},
+		{"`raw ${x} \\n`", "raw ${x} \\n"},
+		{`"${1 / 0}"`, "division by zero"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestFunctionDeclarations(t *testing.T) {
+	tests := []inspectTestCase{
+		{`fn add(a, b) { a + b }; add(1, 2)`, "3"},
+		{`fn outer() { fn fib(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(15) }; outer()`, "610"},
+		{`let f = fn() { let fact = fn(n) { if (n == 0) { 1 } else { n * fact(n - 1) } }; fact(5) }; f()`, "120"},
+		{`fn outer(n) { fn even(k) { if (k == 0) { true } else { odd(k - 1) } } fn odd(k) { if (k == 0) { false } else { even(k - 1) } } [even(n), odd(n)] }; outer(7)`, "[false, true]"},
+		{`fn outer() { fn f() { g() }; fn g() { 42 }; f() }; outer()`, "42"},
+		{`fn a() { b() }; fn b() { "b" }; a()`, "b"},
+		{`fn f() { g }; let early = f(); fn g() { 1 }; early`, "null"},
+		{`let f = first([]); f()`, "calling non-function and non-built-in"},
+		{`let g = fn() { puts(even(4)); fn even(n) { n % 2 == 0 } }; g()`, "function even called before its declaration"},
+		{`fn outer() { fn f() { g() }; let r = f(); fn g() { 1 }; r }; outer()`, "function g called before its declaration"},
+		{`early(); fn early() { 1 }`, "function early called before its declaration"},
+		{`let xs = [1]; f(...xs); fn f(x) { x }`, "function f called before its declaration"},
+		{`fn make() { let n = 0; fn inc() { n = n + 1; n }; inc }; let c = make(); c(); c()`, "2"},
+		{`fn f(f) { f }; f(3)`, "3"},
+		{`if (true) { fn h() { 5 }; h() }`, "5"},
+		{`fn loop(n) { let total = 0; while (n > 0) { fn step(x) { x * 2 }; total = total + step(n); n = n - 1 }; total }; loop(3)`, "12"},
+		{`fn two(a, b) { a }; two(1)`, "wrong number of arguments to two: want=2, got=1"},
+		{`let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; let g = f; f = fn(n) { 100 }; g(5)`, "100"},
+		{`let f = fn(n) { f = 7; f }; [f(1), f]`, "[7, 7]"},
+		{`let h = fn() { let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; let g = f; f = fn(n) { 100 }; g(5) }; h()`, "100"},
+		{`let h = fn() { let f = fn() { f = 7; f }; [f(), f] }; h()`, "[7, 7]"},
+		{`fn f(n) { if (n == 0) { 0 } else { f(n - 1) } } let g = f; f = fn(n) { 100 }; g(5)`, "100"},
+		{`let x = if (true) { fn h() { 1 } }; x`, "null"},
+		{`let x = if (true) { let y = 1 }; x`, "null"},
+		{`let f = fn() { fn g() { 1 } }; f()`, "null"},
+		{`let x = try { let y = 1 } catch (e) { 2 }; x`, "null"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestDefaultRestAndSpread(t *testing.T) {
+	tests := []inspectTestCase{
+		{`fn f(x, y = 10) { x + y }; [f(1), f(1, 2)]`, "[11, 3]"},
+		{`fn f(x, y = x * 2, z = x + y) { [x, y, z] }; [f(1), f(1, 5), f(1, 5, 0)]`, "[[1, 2, 3], [1, 5, 6], [1, 5, 0]]"},
+		{`fn f(x = "d") { x }; f(first([]))`, "null"},
+		{`fn f(first, ...rest) { [first, rest] }; [f(1), f(1, 2, 3)]`, "[[1, []], [1, [2, 3]]]"},
+		{`fn f(a, b = 0, ...c) { [a, b, c] }; f(1, 2, 3)`, "[1, 2, [3]]"},
+		{`let f = fn(...all) { len(all) }; f() + f(1, 2)`, "2"},
+		{`let xs = [1, 2, 3]; fn add(a, b, c) { a + b + c }; add(...xs)`, "6"},
+		{`let xs = [2, 3]; fn add(a, b, c) { a + b + c }; add(1, ...xs)`, "6"},
+		{`let a = [1, 2]; let b = [3]; [0, ...a, ...b, 4, ...[]]`, "[0, 1, 2, 3, 4]"},
+		{`let a = [1, 2]; let b = [...a]; b[0] = 9; [a, b]`, "[[1, 2], [9, 2]]"},
+		{`fn count(...xs) { len(xs) }; count(...[1, 2], 3, ...[4, 5])`, "5"},
+		{`len(...["abc"])`, "3"},
+		{`map([1, 2], fn(x, inc = 10) { x + inc })`, "[11, 12]"},
+		{`fn f(x, y = 1) { x }; f()`, "wrong number of arguments to f: want=1..2, got=0"},
+		{`fn f(x, y = 1) { x }; f(1, 2, 3)`, "wrong number of arguments to f: want=1..2, got=3"},
+		{`fn f(x, ...r) { x }; f()`, "wrong number of arguments to f: want>=1, got=0"},
+		{`fn f(x, y = x / 0) { y }; f(1)`, "division by zero"},
+		{`let n = 5; [...n]`, "spread operand must be ARRAY, got INTEGER"},
+		{`fn f(...r) { r }; f(..."ab")`, "spread operand must be ARRAY, got STRING"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestDestructuring(t *testing.T) {
+	tests := []inspectTestCase{
+		{`let [a, b] = [1, 2]; a + b`, "3"},
+		{`let [a, b, c] = [1]; [a, b, c]`, "[1, null, null]"},
+		{`let [head, ...tail] = [1, 2, 3]; [head, tail]`, "[1, [2, 3]]"},
+		{`let [x, ...rest] = []; [x, rest]`, "[null, []]"},
+		{`let [a, [b, c]] = [1, [2, 3]]; a + b + c`, "6"},
+		{`let f = fn([a], [a]) { let b = 7; a }; f([1], [2])`, "2"},
+		{`let g = fn([_, x], [_, y]) { let z = 0; [x, y, z] }; g([1, 2], [3, 4])`, "[2, 4, 0]"},
+		{`let {name, age: years} = {"name": "Ann", "age": 30}; [name, years]`, "[Ann, 30]"},
+		{`let {missing} = {}; missing`, "null"},
+		{`let {"full name": n, tags: [first]} = {"full name": "Bo", "tags": ["x", "y"]}; n + first`, "Box"},
+		{`fn f() { let [a, b] = [1, 2]; let {c} = {"c": 3}; a + b + c }; f()`, "6"},
+		{`fn sum([a, b]) { a + b }; sum([3, 4])`, "7"},
+		{`let f = fn({x, y} = {"x": 1, "y": 2}, [z] = [x + y]) { [x, y, z] }; [f(), f({"x": 5, "y": 1})]`, "[[1, 2, 3], [5, 1, 6]]"},
+		{`let pair = fn([k, v]) { k + v }; map([["a", "b"], ["c", "d"]], pair)`, "[ab, cd]"},
+		{`fn outer([a]) { fn() { a } }; outer([8])()`, "8"},
+		{`let [a] = 5;`, "cannot destructure INTEGER as array"},
+		{`let {a} = [1];`, "cannot destructure ARRAY as hash"},
+		{`fn f([a]) { a }; f("s")`, "cannot destructure STRING as array"},
+	}
+
+	runInspectTests(t, tests)
+}
+
+func TestConstantReuse(t *testing.T) {
+	tests := []struct {
+		input     string
+		constants int
+	}{
+		{`match [1, "a"] { [1, "a"] => 1, [1, "b"] => 1, {"a": 1} => "a" }`, 4},                                                  // 1, "a", 下标0, "b"
+		{`let f = fn(x) { match x { [0, 1] => 0, [1, 0] => 1 } }; f([1, 0])`, 3},                                                 // 0, 1和函数
+		{`for let i = 0 : i < 3 : i = i + 1 { try { if (i == 1) { break; } if (i == 2) { continue; } } finally { "done" } }`, 5}, // 0, 3, 1, "done", 2,每次内联的finally共用"done"
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		if got := len(comp.Bytecode().Constants); got != tt.constants {
+			t.Errorf("%s: wrong number of constants. got=%d, want=%d", tt.input, got, tt.constants)
+		}
+	}
+}
+
+func TestDestructuringErrorPosition(t *testing.T) {
+	input := `let f = fn(a,
+    [b, c]) { b };
+f(1, 2);`
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err := New(comp.Bytecode()).Run()
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("expected *RuntimeError. got=%T (%v)", err, err)
+	}
+	if runtimeErr.Pos.Line != 2 || runtimeErr.Pos.Column != 5 { // 参数模式的位置,与解释器一致
+		t.Errorf("wrong error position. got=%s, want=2:5", runtimeErr.Pos)
+	}
+}
+
+func TestMatchExpression(t *testing.T) {
+	tests := []inspectTestCase{
+		{`match 1 { 0 => "zero", 1 => "one", _ => "many" }`, "one"},
+		{`match 7 { 0 => "zero", _ => "many" }`, "many"},
+		{`match 7 { 0 => "zero" }`, "null"},
+		{`match 1 { 2 => "two", x if (match 5 { 5 => false, _ => true }) => "inner", 1 => "one", _ => "none" }`, "one"},
+		{`match [1, 2] { [a, b] => match b { 2 => match a { 1 => "both" }, _ => "b" }, _ => "none" }`, "both"},
+		{`let f = fn(n) { match n { 0 => "zero", x if (match x { 1 => true, _ => false }) => "one", _ => match n { 2 => "two", _ => "many" } } }; [f(0), f(1), f(2), f(3)]`, "[zero, one, two, many]"},
+		{`match -2 { -2 => "neg", _ => "pos" }`, "neg"},
+		{`match 2.0 { 2 => "int", _ => "other" }`, "int"},
+		{`match "b" { "a" => 1, "b" => 2 }`, "2"},
+		{`match false { true => 1, false => 0 }`, "0"},
+		{`match 5 { n => n * 2 }`, "10"},
+		{`match [1, 2] { [x] => x, [x, y] => x + y, _ => 0 }`, "3"},
+		{`match [1, 2, 3] { [1, 2] => "exact", [1, ...rest] => rest }`, "[2, 3]"},
+		{`match [] { [x, ...rest] => x, [] => "empty" }`, "empty"},
+		{`match [1, [2, 3]] { [a, [b, c]] => a + b + c }`, "6"},
+		{`match {"type": "ok", "v": 5} { {"type": "err"} => 0, {"type": "ok", "v": v} => v }`, "5"},
+		{`match {"name": "Ann"} { {name, age} => age, {name} => name }`, "Ann"},
+		{`match 5 { [x] => x, {x} => x, _ => "scalar" }`, "scalar"},
+		{`match 15 { n if n < 10 => "small", n if n < 100 => "medium", _ => "large" }`, "medium"},
+		{`match 3 { x if false => 1 }`, "null"},
+		{`match [1, 2] { [x, 1] => "no", [x, 2] => x }`, "1"},
+		{`match 1 { 1 => { let a = 10; a + 1 } _ => 0 }`, "11"},
+		{`match 1 { 1 => { let a = 10; } }`, "null"},
+		{`let n = 0; fn next() { n = n + 1; n }; match next() { 2 => "two", 1 => "one", _ => "?" }; n`, "1"},
+		{`match match 2 { 2 => [1, 2] } { [a, b] => match b { 2 => a + b } }`, "3"},
+		{`fn fib(n) { match n { 0 => 0, 1 => 1, _ => fib(n - 1) + fib(n - 2) } }; fib(10)`, "55"},
+		{`fn f(v) { match v { [x, y] => { return x * y; } _ => 0 } }; f([3, 4])`, "12"},
+		{`let [_, b] = [1, 2]; b`, "2"},
+		{`match 1 { x if x / 0 => 1 }`, "division by zero"},
+	}
+
+	runInspectTests(t, tests)
+}